@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"embed"
 	"flag"
 	"log"
@@ -18,10 +19,12 @@ var statAssets embed.FS
 var statTemplates embed.FS
 
 func main() {
-	addr := flag.String("addr", ":8080", "The addr of the application.")
 	test := flag.String("test", "", "send \"mac\", \"linux\", or \"web\" to test the code on mac or linux or to test only the web interface.")
-	debug := flag.Bool("debug", false, "print extra information for debugging.")
+	printConfig := flag.Bool("print-config", false, "print the effective config, with flags and environment variables applied and secrets redacted, then exit.")
 	// dlv := flag.Bool("dlv", false, "Let the program know if delve is being used to debug so the application directory can be changed.")
+	// Every config field can be overridden with a flag or a PIPLAYER_* environment variable.
+	// Precedence is flag > environment variable > config file > default.
+	overrides := piplayer.NewOverrides(flag.CommandLine)
 	flag.Parse()
 
 	ex, err := os.Executable()
@@ -30,22 +33,39 @@ func main() {
 	}
 	exPath := filepath.Dir(ex)
 
-	conf, err := piplayer.ConfigLoad(statAssets)
+	conf, err := piplayer.ConfigLoad(statAssets, overrides)
 	if err != nil {
 		log.Printf("Current directory: %s\n", exPath)
 		log.Fatalf("Error loading config.\n%v", err)
 	}
 
-	if *debug || conf.Debug {
-		conf.Debug = true
+	if *printConfig {
+		if err := conf.Print(os.Stdout); err != nil {
+			log.Fatalf("Error printing config.\n%v", err)
+		}
+		return
+	}
+
+	if conf.Debug {
 		log.Println("Debug mode enabled")
-		log.Printf("Config file: %v", conf)
+		log.Println("Config file:")
+		if err := conf.Print(log.Writer()); err != nil {
+			log.Printf("error trying to print the config:\n%v\n", err)
+		}
 	}
 
 	a := piplayer.NewAPIHandler(conf.Debug, test, statAssets, statTemplates)
 	kl := keylogger.NewKeyLogger(conf.Remote.Names)
-	p := piplayer.NewPlayer(&a, conf, kl)
-	p.Server = piplayer.NewServer(p, *addr)
+	p := piplayer.NewPlayer(a, conf, kl)
+	if p == nil {
+		log.Fatalf("Error creating player for media folder %s", conf.Mount.Dir)
+	}
+	p.Server = piplayer.NewServer(p, conf.ListenAddr())
+
+	// Apply changes to config.json without restarting.
+	if err := p.WatchConfig(context.Background()); err != nil {
+		log.Printf("Config changes won't be applied until restart.\n%v", err)
+	}
 
 	// Start the browser
 	// We have to start it async because the code has
@@ -7,19 +7,20 @@ import (
 	"io/fs"
 	"log"
 	"net/http"
+	"sync/atomic"
 )
 
 // APIHandler handles requests to the API
 type APIHandler struct {
-	debug         bool
+	// debug is changed when the config is reloaded, while requests read it.
+	debug         atomic.Bool
 	test          string
-	message       reqMessage
 	statAssets    fs.FS
 	statTemplates fs.FS
 }
 
 // NewAPIHandler creates a new APIHandler
-func NewAPIHandler(debug bool, test *string, statAssets, statTemplates embed.FS) APIHandler {
+func NewAPIHandler(debug bool, test *string, statAssets, statTemplates embed.FS) *APIHandler {
 	subAssets, err := fs.Sub(statAssets, "pkg/piplayer/assets")
 	if err != nil {
 		if debug {
@@ -32,7 +33,9 @@ func NewAPIHandler(debug bool, test *string, statAssets, statTemplates embed.FS)
 			log.Println("Error loading templates:", err)
 		}
 	}
-	return APIHandler{debug: debug, test: *test, statAssets: subAssets, statTemplates: subTemplates}
+	a := &APIHandler{test: *test, statAssets: subAssets, statTemplates: subTemplates}
+	a.debug.Store(debug)
+	return a
 }
 
 // Handles requests to the index page as well as any other requests
@@ -87,48 +90,69 @@ func (a *APIHandler) Handle(p *Player) http.HandlerFunc {
 		}
 
 		// decode message
-		a.message = reqMessage{}
+		var req reqMessage
 		decoder := json.NewDecoder(r.Body)
-		err := decoder.Decode(&a.message)
+		err := decoder.Decode(&req)
+		r.Body.Close()
 		if err != nil {
 			m := &resMessage{Success: false, Message: "Error decoding JSON request: " + err.Error()}
 			log.Println(m.Message)
 			json.NewEncoder(w).Encode(m)
-			r.Body.Close()
 			return
 		}
 
-		a.handleMessage(p, w, r)
+		session, _, err := CheckLogin(w, r)
+		if err != nil {
+			log.Println("error trying to retrieve session for an api request:", err)
+		}
+		json.NewEncoder(w).Encode(a.dispatch(p, req, sessionAccess(session)))
 	}
 }
 
-func (a *APIHandler) handleMessage(p *Player, w http.ResponseWriter, r *http.Request) {
-	if a.debug {
-		log.Printf("message received: %#v\n", a.message)
-	}
-
-	// displach execution based on which component was called
-	// in this case, the Player component
-	if a.message.Component == "player" {
-		p.ServeHTTP(w, r)
-		return
+// dispatch sends the request to the component it's meant for and returns
+// the response. It's used for requests from both the /api endpoint and
+// the websockets. from is what the sender is allowed to do.
+func (a *APIHandler) dispatch(p *Player, req reqMessage, from access) resMessage {
+	if a.debug.Load() {
+		log.Printf("message received: %#v\n", req)
 	}
 
-	if a.message.Component == "playlist" {
-		p.playlist.handleAPI(p, w, r)
-		return
+	if err := validateRequest(req); err != nil {
+		log.Printf("invalid request: %v\n", err)
+		return resMessage{ID: req.ID, Success: false, Event: "invalidRequest", Message: err.Error()}
 	}
-
-	// return a generic success message for debugging
-	m := &resMessage{
-		Success: true,
-		Message: fmt.Sprintf("Message Received:\ncomponent: %s\nmethod: %s\narguments: %v\n", a.message.Component, a.message.Method, a.message.Arguments),
+	if need := requiredAccess(req.Component, req.Method); from < need {
+		log.Printf("refusing %s %s request, it needs %s\n", req.Component, req.Method, need)
+		return resMessage{ID: req.ID, Success: false, Event: "forbidden", Message: fmt.Sprintf("%s %s needs %s", req.Component, req.Method, need)}
 	}
-	json.NewEncoder(w).Encode(m)
 
-	r.Body.Close()
+	var res resMessage
 
-	if p.api.debug {
-		log.Println(m.Message)
+	// displach execution based on which component was called
+	switch req.Component {
+	case "player":
+		res = p.handleAPI(req)
+	case "playlist":
+		res = p.playlist.handleAPI(p, req)
+	case "pairing":
+		res = p.pairing.handleAPI(p, req)
+	case "profile":
+		res = handleProfileAPI(p, req)
+	case "usb":
+		res = handleUSBAPI(p, req)
+	case "connection":
+		res = handleConnectionAPI(p, req)
+	default:
+		// return a generic success message for debugging
+		res = resMessage{
+			Success: true,
+			Message: fmt.Sprintf("Message Received:\ncomponent: %s\nmethod: %s\narguments: %v\n", req.Component, req.Method, req.Arguments),
+		}
+		if a.debug.Load() {
+			log.Println(res.Message)
+		}
 	}
+
+	res.ID = req.ID
+	return res
 }
@@ -4,18 +4,39 @@ class Control {
     this.btns = document.querySelectorAll('#divControlsPlayer button');
     // this.btnsPlaylist = document.querySelectorAll('#divControlPlaylist');
     this.btnStart = document.querySelector('#btnStart');
+    this.btnPair = document.querySelector('#btnPair');
     this.spCurrent = document.querySelector('#spCurrent');
+    this.pNotes = document.querySelector('#pNotes');
+    this.divPresentation = document.querySelector('#divPresentation');
+    this.spPresentation = document.querySelector('#spPresentation');
+    this.ulPresentation = document.querySelector('#ulPresentation');
+    this.h1Location = document.querySelector('#divStatus h1');
     this.tblPlaylist = document.querySelector('#tblPlaylist');
+    this.selFolder = document.querySelector('#selFolder');
+    this.selSort = document.querySelector('#selSort');
+    this.selMode = document.querySelector('#selMode');
+    this.cbxShuffle = document.querySelector('#cbxShuffle');
+    this.tmpItem = document.querySelector('#tmpItemRow');
     this.divOverlay = document.querySelector('#divOverlay');
     this.divReconnect = document.querySelector('#divReconnect');
     this.divDisconnect = document.querySelector('#divDisconnect');
+    this.divUSB = document.querySelector('#divUSB');
+    this.pUSB = document.querySelector('#pUSB');
+    this.btnUSBPlay = document.querySelector('#btnUSBPlay');
+    this.btnUSBBack = document.querySelector('#btnUSBBack');
     this.wsPath = "/ws/control";
 
     this.conn = null;
+    // Version of the message schema, see /api/schema.
+    this.protocol = 'pi-player.v1';
+    this.pending = new Map();
+    this.requestCount = 0;
+    this.requestTimeout = 3000;
     this.playlist = {
       current: null,
       selected: null,
-      items: []
+      items: [],
+      dragged: null
     };
 
     if (!window["WebSocket"]) {
@@ -23,16 +44,42 @@ class Control {
       return;
     }
 
-    this.getItems().then(res => {
+    this.itemsLoaded = this.getItems().then(res => {
       console.log("loaded playlist from server");
-    })
+    });
+    this.getOrder();
+    this.getMode();
+    this.itemsLoaded.then(() => this.getPresentation());
 
     this.wsConnect();
 
+    this.request({ component: 'playlist', method: 'getFolders' }).then(res => {
+      if (res && res.success) {
+        this.folders(res.message);
+      }
+    });
+
+    this.request({ component: 'usb', method: 'list' }).then(res => {
+      if (res && res.success) {
+        this.usb(res.message);
+      }
+    });
+
     this.tblPlaylist.addEventListener('click', this.plSelect.bind(this));
     this.btns.forEach(btn => btn.addEventListener('click', this.callMethod.bind(this)));
     // this.btnsPlaylist.forEach(btn => btn.addEventListener('click', this.callMethod.bind(this)));
     this.btnStart.addEventListener('click', this.startItem.bind(this));
+    this.btnPair.addEventListener('click', this.callMethod.bind(this));
+    this.selFolder.addEventListener('change', this.setFolder.bind(this));
+    this.selSort.addEventListener('change', this.setSort.bind(this));
+    this.selMode.addEventListener('change', this.setMode.bind(this));
+    this.cbxShuffle.addEventListener('change', this.setShuffle.bind(this));
+    this.tblPlaylist.addEventListener('dragstart', this.dragStart.bind(this));
+    this.tblPlaylist.addEventListener('dragover', this.dragOver.bind(this));
+    this.tblPlaylist.addEventListener('drop', this.drop.bind(this));
+    this.tblPlaylist.addEventListener('dragend', this.dragEnd.bind(this));
+    this.btnUSBPlay.addEventListener('click', this.usbPlay.bind(this));
+    this.btnUSBBack.addEventListener('click', this.usbBack.bind(this));
   }
 
   getItems() {
@@ -41,7 +88,7 @@ class Control {
       method: 'getItems'
     }
 
-    return this.callApi(reqBody)
+    return this.request(reqBody)
     .then(res => {
       if (!res || !res.success) {
         console.error(res);
@@ -54,7 +101,7 @@ class Control {
 
   wsConnect() {
     let u = 'ws://' + document.location.host + this.wsPath;
-    this.conn = new WebSocket(u);
+    this.conn = new WebSocket(u, [this.protocol]);
 
     this.conn.addEventListener('open', e => {
       console.log("Connection Opened.");
@@ -99,10 +146,37 @@ class Control {
     let msg = JSON.parse(e.data);
     console.log(msg);
 
+    if (this.resolveRequest(msg)) {
+      return;
+    }
+
     switch (msg.event) {
       case "setCurrent":
         this.setCurrent(parseInt(msg.message))
         break;
+      case "snapshot":
+        this.itemsLoaded.then(() => this.snapshot(msg.message));
+        break;
+      case "newItems":
+        this.getItems().then(() => {
+          this.genItems();
+          this.getPresentation();
+        });
+        this.getOrder();
+        this.getMode();
+        break;
+      case "mode":
+        this.mode(msg.message);
+        break;
+      case "switched":
+        this.profile(msg.message);
+        break;
+      case "volumes":
+        this.usb(msg.message);
+        break;
+      case "folders":
+        this.folders(msg.message);
+        break;
       case "disconnect":
       this.disconnect = true;
       console.warn(`server requested websocket disconnection. Connection should be closed any second now.`)
@@ -112,6 +186,213 @@ class Control {
     }
   }
 
+  // genItems re-generates the html for the playlist items.
+  genItems() {
+    this.tblPlaylist.innerHTML = '';
+    this.playlist.selected = null;
+
+    this.playlist.items.forEach((item, i) => {
+      let cloneItem = document.importNode(this.tmpItem.content, true);
+      let icons = cloneItem.querySelectorAll('i');
+      let trItem = cloneItem.querySelector('tr');
+      trItem.dataset.index = i;
+      icons[0].classList.add("fa-" + item.Type);
+      if (item.Cues.ClearAudio) {
+        icons[1].classList.add("fa-bell-slash");
+      } else if (item.Audio != "") {
+        icons[1].classList.add("fa-music");
+      } else {
+        icons[1].remove();
+      }
+      let name = item.Title || item.Visual.substring(0, item.Visual.lastIndexOf('.'));
+      cloneItem.querySelector('td.item-name').textContent = name;
+      this.tblPlaylist.appendChild(cloneItem);
+    });
+
+    if (this.playlist.current != null && this.playlist.items[this.playlist.current]) {
+      this.setCurrent(this.playlist.current);
+    }
+  }
+
+  // profile shows the location of the profile that was switched to.
+  profile(info) {
+    this.h1Location.textContent = `${info.location} Controls`;
+    document.title = `${info.location} Controller`;
+    this.getItems().then(() => this.genItems());
+  }
+
+  // folders lists the folders that can be played, indented by depth.
+  folders(info) {
+    this.selFolder.innerHTML = '';
+    info.folders.forEach(f => {
+      let opt = document.createElement('option');
+      opt.value = f.path;
+      opt.textContent = `${'\u00a0'.repeat(f.depth * 4)}${f.name} (${f.items})`;
+      opt.selected = f.path === info.current;
+      this.selFolder.appendChild(opt);
+    });
+    this.selFolder.hidden = info.folders.length < 2;
+    this.selFolder.labels.forEach(l => l.hidden = this.selFolder.hidden);
+  }
+
+  setFolder() {
+    this.request({
+      component: 'playlist',
+      method: 'setFolder',
+      arguments: { path: this.selFolder.value }
+    }).then(this.videoCallback.bind(this));
+  }
+
+  // getOrder shows how the items in the folder playing are sorted.
+  getOrder() {
+    return this.request({ component: 'playlist', method: 'getOrder' }).then(res => {
+      if (res && res.success) {
+        // A playlist file sets the order itself.
+        this.playlist.fixed = res.message.file;
+        this.selSort.value = res.message.sort;
+        this.selSort.disabled = res.message.file;
+      }
+    });
+  }
+
+  // getPresentation shows the problems in the presentation.json the items
+  // were read with.
+  getPresentation() {
+    return this.request({ component: 'playlist', method: 'getPresentation' }).then(res => {
+      if (!res || !res.success) {
+        return;
+      }
+      let info = res.message;
+      this.spPresentation.textContent = info.file;
+      this.ulPresentation.innerHTML = '';
+      info.problems.forEach(p => {
+        let li = document.createElement('li');
+        li.textContent = `${p.field}: ${p.message}`;
+        this.ulPresentation.appendChild(li);
+      });
+      this.divPresentation.hidden = info.problems.length === 0;
+    });
+  }
+
+  // getMode shows how the playlist plays.
+  getMode() {
+    return this.request({ component: 'player', method: 'getMode' }).then(res => {
+      if (res && res.success) {
+        this.mode(res.message);
+      }
+    });
+  }
+
+  mode(info) {
+    this.selMode.value = info.mode;
+    this.cbxShuffle.checked = info.shuffle;
+  }
+
+  setMode() {
+    this.request({
+      component: 'player',
+      method: 'setMode',
+      arguments: { mode: this.selMode.value }
+    }).then(this.videoCallback.bind(this));
+  }
+
+  setShuffle() {
+    this.request({
+      component: 'player',
+      method: 'setShuffle',
+      arguments: { shuffle: this.cbxShuffle.checked.toString() }
+    }).then(this.videoCallback.bind(this));
+  }
+
+  setSort() {
+    this.request({
+      component: 'playlist',
+      method: 'setSort',
+      arguments: { sort: this.selSort.value }
+    }).then(this.videoCallback.bind(this));
+  }
+
+  dragStart(e) {
+    if (this.playlist.fixed) {
+      e.preventDefault();
+      return;
+    }
+    this.playlist.dragged = e.target.closest('tr');
+    e.dataTransfer.effectAllowed = 'move';
+    e.dataTransfer.setData('text/plain', this.playlist.dragged.dataset.index);
+  }
+
+  // dragOver moves the dragged row above or below the row under the pointer.
+  dragOver(e) {
+    let row = e.target.closest('tr');
+    let dragged = this.playlist.dragged;
+    if (!dragged || !row || row === dragged) {
+      return;
+    }
+    e.preventDefault();
+    let rect = row.getBoundingClientRect();
+    let after = e.clientY > rect.top + rect.height / 2;
+    row.parentNode.insertBefore(dragged, after ? row.nextSibling : row);
+  }
+
+  // drop saves the order of the rows, which the server sends back as new
+  // items.
+  drop(e) {
+    if (!this.playlist.dragged) {
+      return;
+    }
+    e.preventDefault();
+    this.playlist.dragged = null;
+
+    let rows = Array.from(this.tblPlaylist.querySelectorAll('tr'));
+    let order = rows.map(tr => this.playlist.items[tr.dataset.index].Visual);
+    this.request({
+      component: 'playlist',
+      method: 'setOrder',
+      arguments: { order: JSON.stringify(order) }
+    }).then(this.videoCallback.bind(this));
+  }
+
+  // dragEnd puts the rows back if they were dropped outside the table.
+  dragEnd() {
+    if (this.playlist.dragged) {
+      this.playlist.dragged = null;
+      this.genItems();
+    }
+  }
+
+  // usb shows the USB drive that can be played, or the one that's playing.
+  usb(info) {
+    let volumes = info.volumes || [];
+    let active = volumes.find(v => v.path === info.active);
+    this.usbVolume = volumes[volumes.length - 1];
+
+    if (active) {
+      this.pUSB.textContent = `Playing from the USB drive ${active.name}.`;
+    } else if (this.usbVolume) {
+      this.pUSB.textContent = `USB drive ${this.usbVolume.name} has ${this.usbVolume.items} items.`;
+    }
+    this.btnUSBPlay.hidden = !!active;
+    this.btnUSBBack.hidden = !active;
+    this.divUSB.hidden = !active && !this.usbVolume;
+  }
+
+  usbPlay() {
+    if (!this.usbVolume) {
+      return;
+    }
+    this.request({
+      component: 'usb',
+      method: 'play',
+      arguments: { path: this.usbVolume.path }
+    }).then(this.videoCallback.bind(this));
+  }
+
+  usbBack() {
+    this.request({ component: 'usb', method: 'back' })
+      .then(this.videoCallback.bind(this));
+  }
+
   plSelect(e) {
     if (this.playlist.selected != null) {
       this.playlist.selected.classList.remove('selected');
@@ -120,9 +401,26 @@ class Control {
     this.playlist.selected.classList.add('selected');
   }
 
+  // snapshot shows the state the server sends when the socket connects,
+  // and whenever the viewer reports a change.
+  snapshot(state) {
+    if (state.current < 0 || !this.playlist.items[state.current]) {
+      return;
+    }
+
+    if (state.current !== this.playlist.current) {
+      this.setCurrent(state.current);
+    }
+
+    let status = state.blackout ? ' (blackout)' : state.playing ? '' : ' (paused)';
+    this.spCurrent.textContent = this.playlist.items[state.current].Visual + status;
+  }
+
   setCurrent(index) {
     this.playlist.current = index;
     this.spCurrent.textContent = this.playlist.items[index].Visual;
+    this.pNotes.textContent = this.playlist.items[index].Cues.Notes || '';
+    this.pNotes.hidden = !this.pNotes.textContent;
     let el = this.tblPlaylist.querySelector(`tr[data-index="${index}"]`);
     this.plSelect({target: el});
   }
@@ -141,7 +439,7 @@ class Control {
       arguments: args,
     };
   
-    this.callApi(reqBody)
+    this.request(reqBody)
       .then(this.videoCallback.bind(this));
   }
   
@@ -157,7 +455,7 @@ class Control {
       }
     };
   
-    this.callApi(reqBody).then(this.videoCallback.bind(this));
+    this.request(reqBody).then(this.videoCallback.bind(this));
   }
   
   videoCallback(json) {
@@ -166,6 +464,45 @@ class Control {
     }
   }
   
+  // request sends a command over the websocket and resolves with the reply
+  // that has the same id. Falls back to the API if the socket isn't open.
+  request(reqBody) {
+    if (!this.conn || this.conn.readyState !== WebSocket.OPEN) {
+      return this.callApi(reqBody);
+    }
+
+    let id = `${Date.now()}-${++this.requestCount}`;
+    let msg = Object.assign({}, reqBody, { id: id });
+
+    return new Promise(resolve => {
+      let timeoutID = setTimeout(() => {
+        this.pending.delete(id);
+        console.warn(`no reply to request ${id} over the socket, retrying through the API.`);
+        resolve(this.callApi(reqBody));
+      }, this.requestTimeout);
+
+      this.pending.set(id, res => {
+        clearTimeout(timeoutID);
+        resolve(res);
+      });
+
+      this.conn.send(JSON.stringify(msg));
+    });
+  }
+
+  // resolveRequest hands a reply to the request waiting for it.
+  // Returns false if the message isn't a reply to one of our requests.
+  resolveRequest(msg) {
+    if (!msg.id || !this.pending.has(msg.id)) {
+      return false;
+    }
+
+    let resolve = this.pending.get(msg.id);
+    this.pending.delete(msg.id);
+    resolve(msg);
+    return true;
+  }
+
   callApi(reqBody) {
     let myHeaders = new Headers();
     myHeaders.append('Content-Type', 'application/json');
@@ -5,8 +5,12 @@ class Viewer {
     this.menuItemSelector = '.item';
     this.wsPath = '/ws/viewer';
     this.conn = null;
+    // Version of the message schema, see /api/schema.
+    this.protocol = 'pi-player.v1';
+    this.pending = new Map();
+    this.requestCount = 0;
+    this.requestTimeout = 3000;
     this.arrItems = null;
-    this.timeoutID = null;
     this.playlist = {
       current: null,
       items: []
@@ -18,12 +22,27 @@ class Viewer {
     this.divContainerPlaylist = document.querySelector('#containerPlaylist');
     this.vidMedia = document.querySelector('#vidMedia');
     this.audMusic = document.querySelector('#audMusic');
+    this.divPairing = document.querySelector('#divPairing');
+    this.imgPairing = document.querySelector('#imgPairing');
+    this.h1PairingPIN = document.querySelector('#h1PairingPIN');
+    this.pPairingURL = document.querySelector('#pPairingURL');
+    this.divToast = document.querySelector('#divToast');
+    this.modeNames = {
+      repeat: 'Repeat all',
+      repeatOne: 'Repeat one',
+      hold: 'Play once',
+      blackout: 'Play once then black out'
+    };
 
     // divContainer.requestFullscreen();
 
-    // Listen for when the video ends and start the next item.
+    // Tell the server when the video ends, it decides what plays next.
     this.vidMedia.addEventListener('ended', e => {
-      this.next();
+      this.request({
+        component: 'player',
+        method: 'ended',
+        arguments: { index: this.playlist.current.toString() }
+      });
     });
 
     if (!window["WebSocket"]) {
@@ -62,15 +81,29 @@ class Viewer {
     //   console.log('pause', e);
     // });
 
-    this.getItems().then(res => {
-      this.startItem(0);
-    });
+    // The server sends a snapshot of its state as soon as the socket
+    // connects, and the viewer resumes from there.
+    this.resumed = false;
+    this.itemsLoaded = this.getItems();
     this.wsConnect();
+
+    // Start from the beginning if the snapshot never arrives.
+    setTimeout(() => this.resume({ current: -1 }), this.requestTimeout * 2);
+
+    // Keep the server up to date with what's playing.
+    ['play', 'pause', 'seeked'].forEach(ev => {
+      this.vidMedia.addEventListener(ev, () => this.reportState());
+    });
+    setInterval(() => {
+      if (!this.vidMedia.paused) {
+        this.reportState();
+      }
+    }, 5000);
   }
 
   wsConnect() {
     let u = `ws://${document.location.host + this.wsPath}`;
-    this.conn = new WebSocket(u);
+    this.conn = new WebSocket(u, [this.protocol]);
 
     this.conn.addEventListener('open', e => {
       console.log("Connection Opened.");
@@ -89,6 +122,45 @@ class Viewer {
     this.conn.addEventListener('message', this.socketMessage.bind(this));
   }
 
+  // request sends a command over the websocket and resolves with the reply
+  // that has the same id. Falls back to the API if the socket isn't open.
+  request(reqBody) {
+    if (!this.conn || this.conn.readyState !== WebSocket.OPEN) {
+      return this.callApi(reqBody);
+    }
+
+    let id = `${Date.now()}-${++this.requestCount}`;
+    let msg = Object.assign({}, reqBody, { id: id });
+
+    return new Promise(resolve => {
+      let timeoutID = setTimeout(() => {
+        this.pending.delete(id);
+        console.warn(`no reply to request ${id} over the socket, retrying through the API.`);
+        resolve(this.callApi(reqBody));
+      }, this.requestTimeout);
+
+      this.pending.set(id, res => {
+        clearTimeout(timeoutID);
+        resolve(res);
+      });
+
+      this.conn.send(JSON.stringify(msg));
+    });
+  }
+
+  // resolveRequest hands a reply to the request waiting for it.
+  // Returns false if the message isn't a reply to one of our requests.
+  resolveRequest(msg) {
+    if (!msg.id || !this.pending.has(msg.id)) {
+      return false;
+    }
+
+    let resolve = this.pending.get(msg.id);
+    this.pending.delete(msg.id);
+    resolve(msg);
+    return true;
+  }
+
   callApi(reqBody) {
     let myHeaders = new Headers();
     myHeaders.append('Content-Type', 'application/json');
@@ -112,6 +184,10 @@ class Viewer {
     let msg = JSON.parse(e.data);
     console.log(msg);
 
+    if (this.resolveRequest(msg)) {
+      return;
+    }
+
     switch (msg.component) {
       case 'remote':
         this.remoteMessage(e, msg);
@@ -125,6 +201,15 @@ class Viewer {
       case 'connection':
         this.connectionMessage(e, msg);
         break;
+      case 'pairing':
+        this.pairingMessage(e, msg);
+        break;
+      case 'profile':
+        this.profileMessage(e, msg);
+        break;
+      case 'usb':
+        this.usbMessage(e, msg);
+        break;
       default:
         console.error(`unsupported component: ${msg.component};\nmessage: ${msg}`);
         console.dir(msg);
@@ -151,6 +236,57 @@ class Viewer {
     }
   }
 
+  profileMessage(e, msg) {
+    switch (msg.event) {
+      case "switched":
+        this.getItems();
+        break;
+      default:
+        console.error(`unsupported profile event: ${msg.event};\nmessage: ${msg}`);
+    }
+  }
+
+  usbMessage(e, msg) {
+    switch (msg.event) {
+      case "volumes":
+        if (msg.message.inserted) {
+          this.toast(`USB drive ${msg.message.inserted} detected`);
+        } else if (msg.message.removed) {
+          this.toast(`USB drive ${msg.message.removed} removed`);
+        }
+        break;
+      default:
+        console.error(`unsupported usb event: ${msg.event};\nmessage: ${msg}`);
+    }
+  }
+
+  // toast shows a short message at the bottom of the screen for a few seconds.
+  toast(text) {
+    this.divToast.textContent = text;
+    this.divToast.classList.add('show');
+    clearTimeout(this.toastTimeoutID);
+    this.toastTimeoutID = setTimeout(() => this.divToast.classList.remove('show'), 5000);
+  }
+
+  pairingMessage(e, msg) {
+    switch (msg.event) {
+      case "show":
+        // Bust the cache so a new QR code is fetched every time.
+        this.imgPairing.src = `/pair/qr.png?t=${msg.message.expires}`;
+        this.h1PairingPIN.textContent = msg.message.pin;
+        this.pPairingURL.textContent = msg.message.url;
+        this.divPairing.style.display = 'flex';
+        break;
+      case "hide":
+        this.divPairing.style.display = '';
+        this.imgPairing.removeAttribute('src');
+        this.h1PairingPIN.textContent = '';
+        break;
+      default:
+        console.error(`unsupported pairing event: ${msg.event};\nmessage: ${msg}`);
+    }
+  }
+
   remoteMessage(e, msg) {
     switch (msg.arguments.keyString) {
       case 'KEY_UP':
@@ -188,6 +324,18 @@ class Viewer {
       case 'KEY_BACK':
         this.getItems();
         break;
+      case 'KEY_CHANNELUP':
+        this.request({ component: 'playlist', method: 'previousFolder' });
+        break;
+      case 'KEY_CHANNELDOWN':
+        this.request({ component: 'playlist', method: 'nextFolder' });
+        break;
+      case 'KEY_MEDIA_REPEAT':
+        this.request({ component: 'player', method: 'nextMode' });
+        break;
+      case 'KEY_SHUFFLE':
+        this.request({ component: 'player', method: 'toggleShuffle' });
+        break;
       default:
         console.log("Unsupported message received: ", e.data);
         break;
@@ -195,9 +343,20 @@ class Viewer {
   }
 
   playerMessage(e, msg) {
+    if (msg.event == 'snapshot') {
+      this.resume(msg.message);
+      return;
+    }
+    if (msg.event == 'mode') {
+      this.toast(`${this.modeNames[msg.message.mode]}, shuffle ${msg.message.shuffle ? 'on' : 'off'}`);
+      return;
+    }
+
+    let success = true;
+
     switch (msg.method) {
       case 'start':
-        this.startItem(msg.message);
+        this.showItem(msg.message);
         break;
       case 'stop':
         this.stop();
@@ -207,17 +366,38 @@ class Viewer {
         this.playPause(e);
         break;
       case 'seek':
-        this.seek(e, msg.arguments.value);
+        this.seek(e, msg.arguments.value ?? msg.arguments.seconds);
         break;
-      case 'previous':
-        this.previous(e);
+      case 'volume':
+        this.vidMedia.volume = Math.min(parseInt(msg.arguments.volume, 10), 100) / 100;
+        this.audMusic.volume = this.vidMedia.volume;
         break;
-      case 'next':
-        this.next(e);
+      case 'playbackRate':
+        this.vidMedia.playbackRate = parseInt(msg.arguments.rate, 10);
         break;
       default:
+        success = false;
         console.error(`unsupported method: ${msg.method}\nmessage: ${msg}`);
     }
+
+    this.reply(msg, success, success ? '' : `unsupported method: ${msg.method}`);
+  }
+
+  // reply answers a command the server sent with an id, so the server
+  // knows it was handled.
+  reply(msg, success, message) {
+    if (!msg.id || msg.event || !this.conn || this.conn.readyState !== WebSocket.OPEN) {
+      return;
+    }
+
+    this.conn.send(JSON.stringify({
+      id: msg.id,
+      component: msg.component,
+      method: msg.method,
+      event: msg.method,
+      success: success,
+      message: message
+    }));
   }
 
   // getItems retrieves an array of items from the API.
@@ -227,7 +407,7 @@ class Viewer {
       method: 'getItems'
     }
 
-    return this.callApi(reqBody)
+    return this.request(reqBody)
       .then(res => {
         if (!res || !res.success) {
           console.error(res);
@@ -251,7 +431,7 @@ class Viewer {
       let trItem = cloneItem.querySelector('tr');
       trItem.dataset.index = i;
       icons[0].classList.add("fa-" + item.Type);
-      if (item.Cues.clear && item.Cues.clear == "audio") {
+      if (item.Cues.ClearAudio) {
         icons[1].classList.add("fa-bell-slash")
       } else if (item.Audio != "") {
         icons[1].classList.add("fa-music");
@@ -260,7 +440,7 @@ class Viewer {
       }
 
 
-      tdName.textContent = this.trimExtension(item.Visual);
+      tdName.textContent = item.Title || this.trimExtension(item.Visual);
       this.tblPlaylist.appendChild(cloneItem);
     });
 
@@ -300,21 +480,11 @@ class Viewer {
   }
 
   previous(e) {
-    if (this.playlist.current == 0) {
-      this.startItem(this.playlist.items.length - 1);
-      return
-    }
-
-    this.startItem(parseInt(this.playlist.current) - 1);
+    return this.request({ component: 'player', method: 'previous' });
   }
 
   next(e) {
-    if (this.playlist.current >= this.playlist.items.length - 1) {
-      this.startItem(0);
-      return;
-    }
-
-    this.startItem(parseInt(this.playlist.current, 10) + 1);
+    return this.request({ component: 'player', method: 'next' });
   }
 
   remoteEnterPress(e) {
@@ -364,8 +534,56 @@ class Viewer {
     }
   }
 
+  // resume picks up from the state the server had when the page loaded.
+  // Only the first snapshot is used, reconnecting sockets carry on as they are.
+  resume(state) {
+    if (this.resumed) {
+      return;
+    }
+    this.resumed = true;
+
+    this.itemsLoaded.then(() => {
+      if (state.current < 0 || state.current >= this.playlist.items.length) {
+        this.startItem(0);
+        return;
+      }
+
+      if (state.blackout) {
+        this.playlist.current = state.current;
+        this.stop();
+        return;
+      }
+
+      this.showItem(state.current, state.position, state.playing);
+    });
+  }
+
+  // reportState tells the server what the viewer is doing.
+  reportState(blackout = false) {
+    if (this.playlist.current == null) {
+      return;
+    }
+
+    let item = this.playlist.items[this.playlist.current];
+    let video = item && item.Type == "video";
+    let reqBody = {
+      component: 'player',
+      method: 'reportState',
+      arguments: {
+        playing: (!blackout && (!video || !this.vidMedia.paused)).toString(),
+        position: (video ? this.vidMedia.currentTime : 0).toString(),
+        blackout: blackout.toString()
+      }
+    };
+
+    return this.request(reqBody);
+  }
+
   stop(e) {
     let item = this.playlist.items[this.playlist.current];
+    if (!item) {
+      return;
+    }
 
     if (item.Type == "video") {
       this.vidMedia.pause();
@@ -380,6 +598,7 @@ class Viewer {
     // Blackout.
     this.vidMedia.style.visibility = 'hidden';
     this.divContainer.style.backgroundImage = null;
+    this.reportState(true);
   }
 
   seek(e, value) {
@@ -387,45 +606,61 @@ class Viewer {
     this.vidMedia.currentTime += value;
   }
 
+  // startItem asks the server to start the item at index.
   startItem(index) {
-    if (index <= -1) {
-      console.error("Cannot play item at negative index.");
-      return;
-    }
+    let reqBody = {
+      component: 'player',
+      method: 'start',
+      arguments: { index: index.toString() }
+    };
+
+    return this.request(reqBody).then(res => {
+      if (!res || !res.success) {
+        console.error("Cound't start the item through the API.");
+      }
+    });
+  }
 
-    // Cancel previous timeout if there was one.
-    if (this.timeoutID) {
-      clearTimeout(this.timeoutID);
+  // showItem renders the item at index. The server decides which item that
+  // is and runs its timeout, the viewer only shows it.
+  showItem(index, position = 0, playing = true) {
+    let item = this.playlist.items[index];
+    if (!item) {
+      console.error(`no item at index ${index}, getting the items again.`);
+      this.getItems().then(() => {
+        if (this.playlist.items[index]) {
+          this.showItem(index, position, playing);
+        }
+      });
+      return;
     }
 
     this.divContainerPlaylist.style.visibility = 'hidden';
-    let item = this.playlist.items[index];
+    this.playlist.current = index;
 
+    this.applyCues(item.Cues);
     this.checkAudio(item);
-    let started = this.startVisual(item.Visual);
-    if (started) {
-      this.playlist.current = index;
-      if (item.Cues.timeout) {
-        const to = parseInt(item.Cues.timeout, 10);
-        this.timeoutID = setTimeout(this.next.bind(this), to * 1000);
-      }
-    }
+    this.startVisual(item.Visual, position, playing);
+  }
 
-    // Notify the server that a new item has started.
-    let reqBody = {
-      component: "playlist",
-      method: "setCurrent",
-      arguments: { index: index.toString() }
-    };
+  // applyCues sets up the volume, looping and transition of an item before
+  // it starts.
+  applyCues(cues) {
+    if (cues.Volume != null) {
+      this.vidMedia.volume = cues.Volume / 100;
+      this.audMusic.volume = this.vidMedia.volume;
+    }
+    this.vidMedia.loop = !!cues.Loop;
 
-    this.callApi(reqBody).then(res => {
-      if (!res || !res.success) {
-        console.error("Cound't set the current item through the API.");
-      }
-    });
+    // Restart the fade animation for every item that fades in.
+    this.divContainer.classList.remove('fade');
+    if (cues.Transition === 'fade') {
+      void this.divContainer.offsetWidth;
+      this.divContainer.classList.add('fade');
+    }
   }
 
-  async startVisual(fileName) {
+  async startVisual(fileName, position = 0, playing = true) {
     let success = true;
     let ext = fileName.slice(fileName.lastIndexOf('.')).toLowerCase();
 
@@ -433,14 +668,18 @@ class Viewer {
       case '.mp4':
       case '.webm':
         this.vidMedia.src = `/content/${fileName}`;
+        this.vidMedia.currentTime = position;
         this.vidMedia.style.visibility = 'visible';
+        // Blackout the background.
+        this.divContainer.style.backgroundImage = null;
+        if (!playing) {
+          break;
+        }
         try {
           let res = await this.vidMedia.play();
         } catch (err) {
           console.error(`can't start video: ${err}`);
         }
-        // Blackout the background.
-        this.divContainer.style.backgroundImage = null;
         break;
       case '.jpg':
       case '.jpeg':
@@ -464,7 +703,7 @@ class Viewer {
   checkAudio(item) {
     let success = true;
 
-    if (item.Type == "video" || item.Cues.clear && item.Cues.clear == "audio") {
+    if (item.Type == "video" || item.Cues.ClearAudio) {
       this.audMusic.pause();
       this.audMusic.src = "";
       return success;
@@ -0,0 +1,579 @@
+package piplayer
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// backupVersion is the layout of the backup archive.
+	backupVersion = 1
+	// maxBackupSize is the largest backup archive that can be restored.
+	// Backups don't contain media, so they're small.
+	maxBackupSize = 10 << 20
+	// maxBackupEntrySize is the largest file in a backup archive that's read.
+	maxBackupEntrySize = 5 << 20
+	presentationFile   = "presentation.json"
+)
+
+// backupManifest describes what's in a backup archive, and the media files
+// that were in each folder when it was made, so missing content can be found
+// after restoring.
+type backupManifest struct {
+	Version  int            `json:"version"`
+	Created  time.Time      `json:"created"`
+	Location string         `json:"location"`
+	Secrets  bool           `json:"secrets"`
+	Folders  []backupFolder `json:"folders"`
+}
+
+// backupFolder is a media folder used by the config or one of its profiles.
+type backupFolder struct {
+	Path string `json:"path"`
+	// Presentation is the name of the folder's presentation.json in the
+	// archive, or "" if it doesn't have one.
+	Presentation string `json:"presentation,omitempty"`
+	// Documents are the presentation.json files of its sub folders, and its
+	// playlist files.
+	Documents []backupDocument `json:"documents,omitempty"`
+	// Files are the media files in it and its sub folders.
+	Files []backupFile `json:"files"`
+}
+
+// backupDocument is a file in a media folder that's kept in the archive.
+type backupDocument struct {
+	// Path is relative to the media folder, with forward slashes.
+	Path string `json:"path"`
+	// Archive is the name of the file in the archive.
+	Archive string `json:"archive"`
+}
+
+// backupFile is a media file in a folder. Media isn't kept in the archive.
+type backupFile struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// restoreResult reports what was restored, and which media files from the
+// manifest still need to be copied to the player.
+type restoreResult struct {
+	Location     string   `json:"location"`
+	Folders      []string `json:"folders"`
+	MissingFiles []string `json:"missingFiles"`
+}
+
+// mediaFolders returns the media folder of the config and its profiles.
+func (conf *Config) mediaFolders() []string {
+	folders := []string{conf.Mount.localDir()}
+	for _, prof := range conf.Profiles {
+		if prof.Mount == nil || prof.Mount.URL.URL == nil {
+			continue
+		}
+		if dir := prof.Mount.localDir(); !slices.Contains(folders, dir) {
+			folders = append(folders, dir)
+		}
+	}
+	return folders
+}
+
+// writeBackup writes a zip archive with the config, the presentation.json
+// files and playlist files from every media folder, and a manifest of the
+// media files. If secrets is false the login password is left out.
+func writeBackup(w io.Writer, conf *Config, secrets bool) error {
+	zw := zip.NewWriter(w)
+
+	c := *conf
+	if !secrets {
+		c = conf.redacted()
+	}
+	data, err := json.MarshalIndent(&c, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeZipFile(zw, "config.json", data); err != nil {
+		return err
+	}
+
+	manifest := backupManifest{
+		Version:  backupVersion,
+		Created:  time.Now().UTC(),
+		Location: conf.Location,
+		Secrets:  secrets,
+	}
+
+	for i, dir := range conf.mediaFolders() {
+		folder, err := backupMediaFolder(zw, dir, fmt.Sprintf("presentations/%d", i))
+		if err != nil {
+			return err
+		}
+		manifest.Folders = append(manifest.Folders, folder)
+	}
+
+	if data, err = json.MarshalIndent(manifest, "", "  "); err != nil {
+		return err
+	}
+	if err := writeZipFile(zw, "manifest.json", data); err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+// backupMediaFolder writes the presentation.json files and the playlist files
+// in the media folder dir to the archive, under prefix, and lists its media
+// files. Sub folders are read as deep as they're played.
+func backupMediaFolder(zw *zip.Writer, dir, prefix string) (backupFolder, error) {
+	folder := backupFolder{Path: dir, Files: []backupFile{}}
+
+	if _, err := os.Stat(dir); err != nil {
+		log.Printf("Backup: can't read media folder %s: %v\n", dir, err)
+		return folder, nil
+	}
+
+	err := filepath.WalkDir(dir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			log.Printf("Backup: can't read %s: %v\n", file, err)
+			return nil
+		}
+		rel, err := filepath.Rel(dir, file)
+		if err != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			return nil
+		}
+		if hiddenName(d.Name()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			if strings.Count(rel, "/")+1 > maxFolderDepth {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		if !backupDocumentPath(rel) {
+			folder.Files = append(folder.Files, backupFile{Name: rel, Size: info.Size(), Modified: info.ModTime().UTC()})
+			return nil
+		}
+
+		data, err := os.ReadFile(file)
+		if err != nil {
+			log.Printf("Backup: can't read %s: %v\n", file, err)
+			return nil
+		}
+		name := prefix + "/" + rel
+		if err := writeZipFile(zw, name, data); err != nil {
+			return err
+		}
+		if rel == presentationFile {
+			folder.Presentation = name
+		} else {
+			folder.Documents = append(folder.Documents, backupDocument{Path: rel, Archive: name})
+		}
+		return nil
+	})
+	return folder, err
+}
+
+// backupDocumentPath reports whether the file at rel, relative to a media
+// folder, is kept in a backup: a presentation.json in it or a sub folder it
+// plays, or a playlist file in it.
+func backupDocumentPath(rel string) bool {
+	if !filepath.IsLocal(filepath.FromSlash(rel)) || strings.Count(rel, "/") > maxFolderDepth {
+		return false
+	}
+	name := path.Base(rel)
+	if name == presentationFile {
+		return true
+	}
+	return !strings.Contains(rel, "/") && playlistFormat(name) != "" && !hiddenName(name)
+}
+
+func writeZipFile(zw *zip.Writer, name string, data []byte) error {
+	f, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	return err
+}
+
+// backup is the contents of a backup archive that's been read and checked.
+type backup struct {
+	manifest backupManifest
+	conf     *Config
+	// documents are the files from the archive, by the path they're
+	// restored to.
+	documents map[string][]byte
+}
+
+// readBackup reads a backup archive, checking that everything it needs is
+// there and can be parsed.
+func readBackup(data []byte) (*backup, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("not a backup archive: %w", err)
+	}
+
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+
+	b := &backup{documents: make(map[string][]byte)}
+
+	mdata, err := readZipFile(files, "manifest.json")
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(mdata, &b.manifest); err != nil {
+		return nil, fmt.Errorf("manifest.json: %w", err)
+	}
+	if b.manifest.Version != backupVersion {
+		return nil, fmt.Errorf("unsupported backup version %d, this pi-player reads version %d", b.manifest.Version, backupVersion)
+	}
+
+	cdata, err := readZipFile(files, "config.json")
+	if err != nil {
+		return nil, err
+	}
+	// Backups made by older versions of pi-player are upgraded like config files.
+	if cdata, _, err = migrateConfig(cdata); err != nil {
+		return nil, fmt.Errorf("config.json: %w", err)
+	}
+	b.conf = &Config{}
+	if err := json.Unmarshal(cdata, b.conf); err != nil {
+		return nil, fmt.Errorf("config.json: %w", err)
+	}
+
+	for _, folder := range b.manifest.Folders {
+		if !filepath.IsAbs(folder.Path) {
+			return nil, fmt.Errorf("manifest.json: media folder %q is not an absolute path", folder.Path)
+		}
+		for _, doc := range folder.documents() {
+			if !backupDocumentPath(doc.Path) {
+				return nil, fmt.Errorf("manifest.json: %q in media folder %s can't be restored", doc.Path, folder.Path)
+			}
+			data, err := readZipFile(files, doc.Archive)
+			if err != nil {
+				return nil, err
+			}
+			if path.Base(doc.Path) == presentationFile && !json.Valid(data) {
+				return nil, fmt.Errorf("%s: not valid JSON", doc.Archive)
+			}
+			b.documents[folder.file(doc)] = data
+		}
+	}
+
+	return b, nil
+}
+
+// documents returns the files from the archive that are restored to the
+// folder, including its presentation.json.
+func (f backupFolder) documents() []backupDocument {
+	docs := f.Documents
+	if f.Presentation != "" {
+		docs = append([]backupDocument{{Path: presentationFile, Archive: f.Presentation}}, docs...)
+	}
+	return docs
+}
+
+// file returns the path doc is restored to.
+func (f backupFolder) file(doc backupDocument) string {
+	return filepath.Join(f.Path, filepath.FromSlash(doc.Path))
+}
+
+func readZipFile(files map[string]*zip.File, name string) ([]byte, error) {
+	f, ok := files[name]
+	if !ok {
+		return nil, fmt.Errorf("backup archive has no %s", name)
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(io.LimitReader(rc, maxBackupEntrySize+1))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if len(data) > maxBackupEntrySize {
+		return nil, fmt.Errorf("%s is too big", name)
+	}
+	return data, nil
+}
+
+// folders returns the media folders in the manifest that the config in the
+// backup uses. Any others are left alone when it's restored.
+func (b *backup) folders() []backupFolder {
+	used := b.conf.mediaFolders()
+	var folders []backupFolder
+	for _, folder := range b.manifest.Folders {
+		if slices.Contains(used, folder.Path) {
+			folders = append(folders, folder)
+		}
+	}
+	return folders
+}
+
+// createFolders creates the media folders in the backup that don't exist,
+// so the config that uses them can be saved. It returns the ones it created.
+func (b *backup) createFolders() ([]string, error) {
+	var created []string
+	for _, folder := range b.folders() {
+		if exists(folder.Path) {
+			continue
+		}
+		if err := os.MkdirAll(folder.Path, 0755); err != nil {
+			removeFolders(created)
+			return nil, fmt.Errorf("error creating media folder %s: %w", folder.Path, err)
+		}
+		created = append(created, folder.Path)
+	}
+	return created, nil
+}
+
+// removeFolders removes the media folders createFolders made, when the
+// config that uses them couldn't be restored.
+func removeFolders(folders []string) {
+	for _, dir := range folders {
+		if err := os.Remove(dir); err != nil {
+			log.Printf("error trying to remove media folder %s:\n%v\n", dir, err)
+		}
+	}
+}
+
+// restoreFiles writes the presentation.json files and playlist files in the
+// backup to the media folders, creating the sub folders they're in. It
+// returns the media files from the manifest that aren't on the player.
+func (b *backup) restoreFiles() ([]string, error) {
+	var missing []string
+
+	for _, folder := range b.folders() {
+		for _, doc := range folder.documents() {
+			file := folder.file(doc)
+			data, ok := b.documents[file]
+			if !ok {
+				continue
+			}
+			if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+				return nil, fmt.Errorf("error creating folder for %s: %w", file, err)
+			}
+			if err := writeFileAtomic(file, data, 0644); err != nil {
+				return nil, fmt.Errorf("error restoring %s: %w", file, err)
+			}
+		}
+
+		for _, f := range folder.Files {
+			file := filepath.Join(folder.Path, filepath.FromSlash(f.Name))
+			if _, err := os.Stat(file); err != nil {
+				missing = append(missing, file)
+			}
+		}
+	}
+
+	return missing, nil
+}
+
+// restoreBackup restores the media folders and config in a backup archive,
+// and applies the config to the running player. A backup without secrets
+// keeps the current login.
+func (p *Player) restoreBackup(data []byte) (restoreResult, error) {
+	b, err := readBackup(data)
+	if err != nil {
+		return restoreResult{}, err
+	}
+
+	p.configMu.Lock()
+	defer p.configMu.Unlock()
+
+	file := p.config().fileConfig()
+	newConf := *b.conf
+	if newConf.Login.Username == "" || newConf.Login.Password == redacted {
+		newConf.Login = file.Login
+	}
+	newConf.unredact(file)
+
+	// Check the config before anything is written. The media folders in the
+	// backup don't need to exist yet, restoring it creates them.
+	var created []string
+	for _, folder := range b.folders() {
+		created = append(created, folder.Path)
+	}
+	if err := newConf.validate(created); err != nil {
+		return restoreResult{}, err
+	}
+	running, err := p.runningConfig(&newConf)
+	if err != nil {
+		return restoreResult{}, err
+	}
+	if err := running.validate(created); err != nil {
+		return restoreResult{}, err
+	}
+
+	// The files in the media folders are only written once the config is
+	// saved, so a restore that fails doesn't leave them half restored.
+	made, err := b.createFolders()
+	if err != nil {
+		return restoreResult{}, err
+	}
+	if err := p.saveSettings(newConf, nil); err != nil {
+		removeFolders(made)
+		return restoreResult{}, err
+	}
+	missing, err := b.restoreFiles()
+	if err != nil {
+		return restoreResult{}, fmt.Errorf("the config was restored, but not the files in its media folders: %w", err)
+	}
+
+	res := restoreResult{Location: newConf.Location, Folders: created, MissingFiles: missing}
+	log.Printf("Restored backup of %s from %s, %d media files are missing\n", b.manifest.Location, b.manifest.Created.Format(time.RFC3339), len(missing))
+
+	return res, nil
+}
+
+// BackupHandler downloads a backup archive of the config. Add ?secrets=false
+// to leave the login password out of it.
+func BackupHandler(p *Player) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireAdmin(w, r) {
+			return
+		}
+
+		secrets := r.URL.Query().Get("secrets") != "false"
+
+		// Back up the config as it's saved, without the active profile and
+		// overrides, so restoring it doesn't save them.
+		conf := p.config().fileConfig()
+		var buf bytes.Buffer
+		if err := writeBackup(&buf, conf, secrets); err != nil {
+			log.Println("error trying to create backup:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		name := strings.ToLower(strings.Join(strings.Fields(conf.Location), "-"))
+		filename := fmt.Sprintf("pi-player-%s-%s.zip", name, time.Now().Format("2006-01-02"))
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(filename)))
+		w.Write(buf.Bytes())
+	}
+}
+
+// RestoreHandler restores a backup archive. The settings page uploads it in
+// the "archive" field of a form, and gets the settings page back. Other
+// clients can POST the archive as application/zip and get a JSON reply.
+func RestoreHandler(p *Player) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireAdmin(w, r) {
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, maxBackupSize)
+		fromPage := strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data")
+
+		data, err := readRestoreBody(r, fromPage)
+		var res restoreResult
+		if err == nil {
+			res, err = p.restoreBackup(data)
+		}
+
+		if err != nil {
+			log.Println("Refusing to restore backup:", err)
+		}
+
+		if fromPage {
+			if err != nil {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				p.config().fileConfig().renderSettings(p, w, r, err)
+				return
+			}
+			p.config().fileConfig().renderSettingsNotice(p, w, r, restoreNotice(res))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err != nil {
+			var ce *ConfigError
+			if errors.As(err, &ce) {
+				writeSettingsResponse(w, http.StatusUnprocessableEntity, resMessage{Success: false, Event: "invalidSettings", Message: ce.Problems})
+				return
+			}
+			writeSettingsResponse(w, http.StatusUnprocessableEntity, apiError(err.Error()))
+			return
+		}
+		writeSettingsResponse(w, http.StatusOK, resMessage{Success: true, Event: "restored", Message: res})
+	}
+}
+
+func readRestoreBody(r *http.Request, fromPage bool) ([]byte, error) {
+	if !fromPage {
+		return io.ReadAll(r.Body)
+	}
+
+	f, _, err := r.FormFile("archive")
+	if err != nil {
+		return nil, fmt.Errorf("no backup archive uploaded: %w", err)
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// restoreNotice describes a restore for the settings page.
+func restoreNotice(res restoreResult) []string {
+	notice := []string{fmt.Sprintf("Restored the settings for %s.", res.Location)}
+	if len(res.MissingFiles) > 0 {
+		notice = append(notice, fmt.Sprintf("Copy these %d media files to the player:", len(res.MissingFiles)))
+		notice = append(notice, res.MissingFiles...)
+	}
+	return notice
+}
+
+// requireAdmin checks that the request is from a logged in admin, and writes
+// an error if it isn't. Paired operators can't use admin endpoints.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	session, loggedIn, err := CheckLogin(w, r)
+	if err != nil {
+		log.Println("error trying to retrieve session:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if !loggedIn {
+		http.Error(w, "Not logged in", http.StatusUnauthorized)
+		return false
+	}
+	if isOperator(session) {
+		http.Error(w, "Operators can't change settings", http.StatusForbidden)
+		return false
+	}
+	return true
+}
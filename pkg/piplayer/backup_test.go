@@ -0,0 +1,194 @@
+package piplayer
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBackupRoundTrip(t *testing.T) {
+	conf := validConfig(t)
+	dir := conf.Mount.Dir
+	presentation := `{"Items": [{"Visual": "intro.mp4", "Cues": {"clear": "audio"}}]}`
+	documents := map[string]string{
+		presentationFile:                 presentation,
+		"Sunday/" + presentationFile:     `{"Sort": "newest"}`,
+		"service.m3u":                    "intro.mp4\n",
+		"a/b/c/d/" + presentationFile:    `{"Sort": "modified"}`,
+		"a/b/c/d/e/" + presentationFile:  `{}`,
+		".sync/" + presentationFile:      `{}`,
+		"Sunday/not-a-playlist-file.m3u": "intro.mp4\n",
+	}
+	files := map[string]string{
+		"intro.mp4":       "video",
+		"slide.jpg":       "image",
+		"Sunday/song.mp4": "video",
+	}
+	for name, data := range documents {
+		files[name] = data
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := writeBackup(&buf, &conf, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restore onto a fresh player, where the media folder is gone.
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := readBackup(buf.Bytes())
+	if err != nil {
+		t.Fatalf("got error %v want nil", err)
+	}
+
+	if b.conf.Login.Password != redacted {
+		t.Errorf("got password %q want it redacted", b.conf.Login.Password)
+	}
+	if b.conf.Location != conf.Location || b.conf.Mount.URL.String() != dir {
+		t.Errorf("config not in the backup: %+v", b.conf)
+	}
+
+	missing, err := b.restoreFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The presentation.json files of the sub folders that are played, and
+	// the playlist files in the media folder, are restored too.
+	for name, data := range documents {
+		restored := !strings.HasPrefix(name, "a/b/c/d/e/") && !strings.HasPrefix(name, ".") && !strings.HasSuffix(name, "not-a-playlist-file.m3u")
+		got, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if restored && (err != nil || string(got) != data) {
+			t.Errorf("got %s %q want %q, error: %v", name, got, data, err)
+		}
+		if !restored && !os.IsNotExist(err) {
+			t.Errorf("got %s restored, error: %v", name, err)
+		}
+	}
+
+	want := []string{
+		filepath.Join(dir, "Sunday", "not-a-playlist-file.m3u"),
+		filepath.Join(dir, "Sunday", "song.mp4"),
+		filepath.Join(dir, "intro.mp4"),
+		filepath.Join(dir, "slide.jpg"),
+	}
+	if !reflect.DeepEqual(missing, want) {
+		t.Errorf("got missing files %v want %v", missing, want)
+	}
+}
+
+func TestReadBackupRejectsBadArchives(t *testing.T) {
+	conf := validConfig(t)
+	var buf bytes.Buffer
+	if err := writeBackup(&buf, &conf, true); err != nil {
+		t.Fatal(err)
+	}
+	good := buf.Bytes()
+
+	// A document outside its media folder.
+	var evil bytes.Buffer
+	zw := zip.NewWriter(&evil)
+	manifest := fmt.Sprintf(`{"version": %d, "folders": [{"path": %q, "documents": [{"path": "../evil.m3u", "archive": "evil.m3u"}]}]}`, backupVersion, conf.Mount.Dir)
+	for name, data := range map[string]string{"manifest.json": manifest, "config.json": `{}`, "evil.m3u": ""} {
+		if err := writeZipFile(zw, name, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"not a zip", []byte("hello"), "not a backup archive"},
+		{"truncated", good[:len(good)/2], "not a backup archive"},
+		{"document outside the folder", evil.Bytes(), "can't be restored"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readBackup(tt.data)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v want error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRestoreFoldersOnlyUsedByConfig(t *testing.T) {
+	conf := validConfig(t)
+	stray := filepath.Join(t.TempDir(), "stray")
+	b := &backup{
+		conf: &conf,
+		manifest: backupManifest{Folders: []backupFolder{
+			{Path: conf.Mount.Dir},
+			{Path: stray, Presentation: "presentations/1/" + presentationFile},
+		}},
+		documents: map[string][]byte{filepath.Join(stray, presentationFile): []byte(`{}`)},
+	}
+
+	if created, err := b.createFolders(); err != nil || len(created) != 0 {
+		t.Fatalf("got %v and error %v, want no folders created", created, err)
+	}
+	if _, err := b.restoreFiles(); err != nil {
+		t.Fatalf("got error %v want nil", err)
+	}
+	if _, err := os.Stat(stray); !os.IsNotExist(err) {
+		t.Errorf("folder %s not used by the config was restored, error: %v", stray, err)
+	}
+}
+
+func TestCreateFoldersCanBeRemoved(t *testing.T) {
+	conf := validConfig(t)
+	conf.Mount = newMount(&url.URL{Path: filepath.Join(t.TempDir(), "restored")})
+	b := &backup{conf: &conf, manifest: backupManifest{Folders: []backupFolder{{Path: conf.Mount.Dir}}}}
+
+	created, err := b.createFolders()
+	if err != nil || !reflect.DeepEqual(created, []string{conf.Mount.Dir}) || !exists(conf.Mount.Dir) {
+		t.Fatalf("got %v and error %v, want %s created", created, err, conf.Mount.Dir)
+	}
+	removeFolders(created)
+	if exists(conf.Mount.Dir) {
+		t.Errorf("folder %s is still there", conf.Mount.Dir)
+	}
+}
+
+func TestRestoreBackupChecksConfigFirst(t *testing.T) {
+	conf := validConfig(t)
+	p := reloadPlayer(t, conf)
+
+	restored := conf
+	restored.Mount = newMount(&url.URL{Path: filepath.Join(t.TempDir(), "restored")})
+	restored.Streamer = "vlc"
+	var buf bytes.Buffer
+	if err := writeBackup(&buf, &restored, true); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.restoreBackup(buf.Bytes()); err == nil {
+		t.Fatal("got nil error for a backup with an invalid config")
+	}
+	if _, err := os.Stat(restored.Mount.URL.Path); !os.IsNotExist(err) {
+		t.Errorf("media folder of an invalid backup was created, error: %v", err)
+	}
+}
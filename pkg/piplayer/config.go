@@ -6,16 +6,18 @@ import (
 	"fmt"
 	"io/fs"
 	"log"
-	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/17xande/configdir"
 )
 
 // Config holds the configuration of the pi-player
 type Config struct {
+	// Version is the layout of the config file, see configMigrations.
+	Version     int
 	Location    string
 	Mount       mount
 	AudioOutput string
@@ -23,10 +25,57 @@ type Config struct {
 	Debug       bool
 	Login       Login
 	Remote      remote
+	// SingleOperator only allows one control page to be connected at a time.
+	// A new connection takes over from the previous one.
+	SingleOperator bool
+	// Addr is the address the server listens on.
+	Addr string
+	// SyncMinutes is how often a remote mount is synced, see ContentSource.
+	// 0 uses defaultSyncMinutes.
+	SyncMinutes int
+	Playlist    PlaylistOptions
+	// USB is where guest USB drives are looked for, see usbDrives.
+	USB usbOptions
+	// Cache copies media files to a local folder before they're played.
+	Cache cacheOptions
+	// Profiles are named sets of settings that can be switched to while
+	// running. ActiveProfile is the name of the last one switched to.
+	Profiles      []Profile
+	ActiveProfile string
+	// overrides are the flags and environment variables the config was
+	// loaded with, and are applied again whenever the config changes.
+	overrides *Overrides
+	// file is the config as it is in config.json, that the running config
+	// was made from, see running. Changes to the settings are made to it.
+	file *Config
 }
 
-// Load reads the config file and unmarshalls it to the config struct
-func ConfigLoad(statsAssets embed.FS) (*Config, error) {
+// defaultAddr is the address the server listens on if none is configured.
+const defaultAddr = ":8080"
+
+// ListenAddr returns the address the server should listen on.
+func (conf *Config) ListenAddr() string {
+	if conf.Addr == "" {
+		return defaultAddr
+	}
+	return conf.Addr
+}
+
+// defaultSyncMinutes is how often a remote mount is synced if SyncMinutes isn't set.
+const defaultSyncMinutes = 5
+
+// syncInterval returns how often a remote mount is synced.
+func (conf *Config) syncInterval() time.Duration {
+	if conf.SyncMinutes <= 0 {
+		return defaultSyncMinutes * time.Minute
+	}
+	return time.Duration(conf.SyncMinutes) * time.Minute
+}
+
+// Load reads the config file and unmarshalls it to the config struct.
+// Values from command-line flags and environment variables in overrides take
+// precedence over the file. overrides can be nil.
+func ConfigLoad(statsAssets embed.FS, overrides *Overrides) (*Config, error) {
 	configPath := configdir.LocalConfig("pi-player")
 	userHome, err := os.UserHomeDir()
 	if err != nil {
@@ -59,20 +108,14 @@ func ConfigLoad(statsAssets embed.FS) (*Config, error) {
 
 	conf := &Config{}
 
-	configFile := filepath.Join(configPath, "config.json")
+	configFile := configFilePath()
 	// Does the file not exist?
 	if _, err := os.Stat(configFile); os.IsNotExist(err) {
-		// Create the file
-		f, err := os.Create(configFile)
-		defer f.Close()
-		if err != nil {
-			return nil, fmt.Errorf("error creating config file: %w", err)
-		}
-
 		login, _ := newLogin()
 
 		// Set some default values for config.
 		conf = &Config{
+			Version:  currentConfigVersion,
 			Location: "PiPlayer",
 			Mount: mount{
 				URL: sURL{URL: &url.URL{Path: defaultDir}},
@@ -82,145 +125,154 @@ func ConfigLoad(statsAssets embed.FS) (*Config, error) {
 			Debug:  true,
 			Login:  login,
 			Remote: remote{Names: []string{"keyboard"}},
+			Addr:   defaultAddr,
+		}
+
+		// Save the defaults before applying overrides, so the file doesn't
+		// pick up values that were only meant for this run.
+		if err := conf.Save(); err != nil {
+			return nil, fmt.Errorf("error creating config file: %w", err)
+		}
+
+		running, err := conf.running(overrides.startProfile(conf), overrides)
+		if err != nil {
+			return nil, err
 		}
 
-		conf.Save()
+		if err := running.Validate(); err != nil {
+			return nil, fmt.Errorf("config with overrides: %w", err)
+		}
 
-		return conf, nil
+		return &running, nil
 	}
 
-	data, err := os.ReadFile(configFile)
+	conf, err = readConfigOrBackup(configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// if there's no login entry in the config file, add the default login details
+	if conf.Login.Username == "" {
+		log.Println("no login details found in config file, using the default login details.")
+		if conf.Login, err = newLogin(); err != nil {
+			return nil, fmt.Errorf("error creating default login: %w", err)
+		}
+	}
+
+	running, err := conf.running(overrides.startProfile(conf), overrides)
 	if err != nil {
 		return nil, err
 	}
 
-	err = json.Unmarshal(data, conf)
+	if err := running.Validate(); err != nil {
+		return nil, fmt.Errorf("config file %s: %w", configFile, err)
+	}
+
+	return &running, nil
+}
+
+// configFilePath returns the path of the config file.
+func configFilePath() string {
+	return filepath.Join(configdir.LocalConfig("pi-player"), "config.json")
+}
+
+// readConfig reads and parses the config file, migrating it to the current
+// version if it's older, without applying overrides or validating it.
+func readConfig(configFile string) (*Config, error) {
+	data, err := os.ReadFile(configFile)
 	if err != nil {
 		return nil, err
 	}
 
-	conf.Mount.Dir = conf.Mount.URL.Path
+	if data, err = migrateConfigFile(configFile, data); err != nil {
+		return nil, err
+	}
+
+	conf := &Config{}
+	if err := json.Unmarshal(data, conf); err != nil {
+		return nil, fmt.Errorf("error parsing config file %s: %w", configFile, err)
+	}
+
 	return conf, nil
 }
 
-// Save reads the config struct, marshalls it and writes it to the config file
-func (conf *Config) Save() error {
-	configPath := configdir.LocalConfig("pi-player")
-	configFile := filepath.Join(configPath, "config.json")
-	jconf, err := json.MarshalIndent(conf, "", "  ")
+// clone returns a deep copy of the config, that can be decoded onto without
+// changing the slices and pointers it shares with conf.
+func (conf *Config) clone() (Config, error) {
+	data, err := json.Marshal(conf)
 	if err != nil {
-		return err
+		return Config{}, err
+	}
+
+	var c Config
+	if err := json.Unmarshal(data, &c); err != nil {
+		return Config{}, err
 	}
+	c.Mount.Dir = conf.Mount.Dir
+	c.overrides = conf.overrides
 
-	return os.WriteFile(configFile, jconf, 0600)
+	return c, nil
 }
 
-// SettingsHandler handles requests to the settings page
-func (conf *Config) SettingsHandler(p *Player) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		_, loggedIn, err := CheckLogin(w, r)
-		if err != nil {
-			log.Println("error trying to retrieve session on login page:", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		if !loggedIn {
-			http.Redirect(w, r, "/login", http.StatusFound)
-			return
-		}
+// running returns the config to run with, made from conf as it is in
+// config.json: the named profile is applied to it, if there is one, and the
+// overrides on top. The result isn't validated.
+func (conf *Config) running(profile string, overrides *Overrides) (Config, error) {
+	c, err := conf.clone()
+	if err != nil {
+		return Config{}, err
+	}
 
-		if r.Method == "GET" {
-			mu, err := url.PathUnescape(conf.Mount.URL.String())
-			if err != nil {
-				log.Printf("SettingsHandler: Error unescaping URL '%s'\n", conf.Mount.URL)
-			}
-			tempControl := TemplateHandler{
-				filename:      "settings.html",
-				statTemplates: p.api.statTemplates,
-				data: map[string]interface{}{
-					"location": conf.Location,
-					// "directory":   conf.Directory,
-					"audioOutput": conf.AudioOutput,
-					"debug":       conf.Debug,
-					"username":    conf.Login.Username,
-					"mount":       conf.Mount,
-					"mountURL":    mu,
-				},
-			}
-			tempControl.ServeHTTP(w, r)
-			return
-		} else if r.Method != "POST" {
-			log.Println("Unsuported request type for Settings page:", r.Method)
-			return
+	if profile != "" {
+		if err := c.useProfile(profile); err != nil {
+			return Config{}, err
 		}
+	}
+	c.ActiveProfile = profile
 
-		// process POST request
-		if err := r.ParseForm(); err != nil {
-			log.Println("Error trying to parse form in settings page.\n", err)
-		}
-		location := r.PostFormValue("location")
-		mountURL := r.PostFormValue("mountURL")
-		mountUsername := r.PostFormValue("mountUsername")
-		mountPassword := r.PostFormValue("mountPassword")
-		audioOutput := r.PostFormValue("audioOutput")
-		username := r.PostFormValue("username")
-		password := r.PostFormValue("password")
-		debug := r.PostFormValue("debug")
-
-		conf.Debug = debug == "on"
-
-		if conf.Debug {
-			log.Printf("Received settings post: location: %s\nmountURL: %s\n", location, mountURL)
-		}
+	if err := c.applyOverrides(overrides); err != nil {
+		return Config{}, err
+	}
 
-		if location != "" {
-			conf.Location = location
-		}
+	file := *conf
+	file.file = nil
+	c.file = &file
+	c.overrides = overrides
+	c.Mount.Dir = c.Mount.localDir()
+	return c, nil
+}
 
-		if audioOutput != "" {
-			conf.AudioOutput = audioOutput
-		}
+// fileConfig returns the config as it is in config.json, without the profile
+// and overrides in the running config. It must not be changed, changes are
+// made to a copy.
+func (conf *Config) fileConfig() *Config {
+	if conf.file == nil {
+		return conf
+	}
+	return conf.file
+}
 
-		if username != "" && password != "" {
-			var err error
-			if password, err = hash(password); err != nil {
-				log.Println("error trying to encrypt password for saving", err)
-			} else {
-				conf.Login.Username = username
-				conf.Login.Password = password
-			}
-		}
+// applyOverrides applies the flag and environment variable overrides.
+func (conf *Config) applyOverrides(overrides *Overrides) error {
+	if err := overrides.apply(conf); err != nil {
+		return fmt.Errorf("config overrides: %w", err)
+	}
+	return nil
+}
 
-		if mountURL != "" || mountPassword != "" && mountUsername != "" {
-			var su sURL
-			u, err := url.Parse(mountURL)
-			if err != nil {
-				log.Printf("Error parsing URL (%s)\n%v\n", mountURL, err)
-			} else {
-				su.URL = u
-				newMount := mount{
-					URL: su,
-					Dir: su.URL.String(),
-				}
-
-				if newMount.URL != conf.Mount.URL {
-					if su.Scheme == "smb" {
-						if conf.Debug {
-							log.Printf("SMB mounting no longer supported")
-						}
-					}
-
-					if su.Scheme == "" {
-						conf.Mount = newMount
-						if err := conf.Save(); err != nil {
-							log.Println("error trying to save config:", err)
-						}
-						restart(p)
-					}
-				}
-			}
-		}
+// Save reads the config struct, marshalls it and writes it to the config file.
+// An invalid config is never written.
+func (conf *Config) Save() error {
+	if err := conf.Validate(); err != nil {
+		return err
+	}
 
-		http.Redirect(w, r, "/control", http.StatusSeeOther)
+	// Saving always writes the current layout.
+	conf.Version = currentConfigVersion
+	jconf, err := json.MarshalIndent(conf, "", "  ")
+	if err != nil {
+		return err
 	}
+
+	return saveConfigFile(configFilePath(), jconf)
 }
@@ -0,0 +1,139 @@
+package piplayer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// configBackups is the number of previous good config files that are kept,
+// as config.json.1 (the newest) to config.json.N (the oldest).
+const configBackups = 3
+
+// backupPath returns the path of the nth backup of the config file.
+func backupPath(configFile string, n int) string {
+	return fmt.Sprintf("%s.%d", configFile, n)
+}
+
+// writeFileAtomic writes data to a temp file in the same folder, syncs it to
+// disk and renames it over path. A power cut leaves either the old file or
+// the new one, never a truncated file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	// Clean up the temp file if anything fails. After the rename this does nothing.
+	defer os.Remove(tmp)
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	// Sync the folder so the rename itself survives a power cut.
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// saveConfigFile rotates the backups of the config file, keeping the current
+// file as the newest backup if it's good, and atomically writes data to it.
+func saveConfigFile(configFile string, data []byte) error {
+	if err := rotateConfigBackups(configFile); err != nil {
+		log.Printf("error trying to back up config file, saving anyway: %v\n", err)
+	}
+
+	return writeFileAtomic(configFile, data, 0600)
+}
+
+// rotateConfigBackups moves each backup along by one, dropping the oldest,
+// and copies the current config file to the newest backup. A config file that
+// doesn't parse isn't kept, so the backups are always good copies.
+func rotateConfigBackups(configFile string) error {
+	data, err := os.ReadFile(configFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &Config{}); err != nil {
+		return fmt.Errorf("current config file is damaged, not backing it up: %w", err)
+	}
+
+	for n := configBackups - 1; n >= 1; n-- {
+		err := os.Rename(backupPath(configFile, n), backupPath(configFile, n+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return writeFileAtomic(backupPath(configFile, 1), data, 0600)
+}
+
+// isConfigCorrupt reports whether err means the config file is damaged,
+// eg: truncated by a power cut while it was being written.
+func isConfigCorrupt(err error) bool {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	return errors.As(err, &syntaxErr) || errors.As(err, &typeErr)
+}
+
+// readConfigOrBackup reads the config file. If the file is damaged, the newest
+// backup that can be read is restored in its place, and the damaged file is
+// kept as config.json.damaged.
+func readConfigOrBackup(configFile string) (*Config, error) {
+	conf, err := readConfig(configFile)
+	if err == nil || !isConfigCorrupt(err) {
+		return conf, err
+	}
+	log.Printf("Config file is damaged, looking for a backup:\n%v\n", err)
+
+	for n := 1; n <= configBackups; n++ {
+		backup := backupPath(configFile, n)
+		data, rerr := os.ReadFile(backup)
+		if rerr != nil {
+			continue
+		}
+		if rerr := json.Unmarshal(data, &Config{}); rerr != nil {
+			log.Printf("Backup %s is damaged too: %v\n", backup, rerr)
+			continue
+		}
+
+		if rerr := os.Rename(configFile, configFile+".damaged"); rerr != nil {
+			return nil, fmt.Errorf("error moving damaged config file out of the way: %w", rerr)
+		}
+		if rerr := writeFileAtomic(configFile, data, 0600); rerr != nil {
+			return nil, fmt.Errorf("error restoring config file from %s: %w", backup, rerr)
+		}
+
+		log.Printf("Restored config file from %s. The damaged file was kept as %s.damaged\n", backup, configFile)
+		return readConfig(configFile)
+	}
+
+	return nil, fmt.Errorf("%w\nno good backup found", err)
+}
@@ -0,0 +1,95 @@
+package piplayer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSaveConfigFileRotatesBackups(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+
+	for i := range configBackups + 2 {
+		data := fmt.Sprintf(`{"Location": "save %d"}`, i)
+		if err := saveConfigFile(file, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The newest backup is the file from before the last save.
+	for n := 1; n <= configBackups; n++ {
+		data, err := os.ReadFile(backupPath(file, n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := fmt.Sprintf(`{"Location": "save %d"}`, configBackups+1-n)
+		if string(data) != want {
+			t.Errorf("backup %d: got %s want %s", n, data, want)
+		}
+	}
+
+	if _, err := os.Stat(backupPath(file, configBackups+1)); !os.IsNotExist(err) {
+		t.Errorf("more than %d backups kept", configBackups)
+	}
+
+	// Nothing is left behind from the temp files.
+	matches, _ := filepath.Glob(filepath.Join(filepath.Dir(file), ".config.json.tmp*"))
+	if len(matches) > 0 {
+		t.Errorf("temp files left behind: %v", matches)
+	}
+}
+
+func TestSaveConfigFileSkipsDamagedBackup(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(file, []byte(`{"Locat`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := saveConfigFile(file, []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(backupPath(file, 1)); !os.IsNotExist(err) {
+		t.Error("damaged config file was kept as a backup")
+	}
+}
+
+func TestReadConfigOrBackupRestoresNewestGoodBackup(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	files := map[string]string{
+		file:                `{"Version": 2, "Location": "trunc`,
+		backupPath(file, 1): "",
+		backupPath(file, 2): `{"Version": 2, "Location": "good"}`,
+		backupPath(file, 3): `{"Version": 2, "Location": "older"}`,
+	}
+	for name, data := range files {
+		if err := os.WriteFile(name, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conf, err := readConfigOrBackup(file)
+	if err != nil {
+		t.Fatalf("got error %v want nil", err)
+	}
+	if conf.Location != "good" {
+		t.Errorf("got location %q want %q", conf.Location, "good")
+	}
+
+	damaged, err := os.ReadFile(file + ".damaged")
+	if err != nil || string(damaged) != files[file] {
+		t.Errorf("damaged file not kept, got %q, error: %v", damaged, err)
+	}
+}
+
+func TestReadConfigOrBackupNoBackup(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(file, []byte("\x00\x00\x00"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := readConfigOrBackup(file); err == nil {
+		t.Error("got nil error with no backups")
+	}
+}
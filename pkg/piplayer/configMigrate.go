@@ -0,0 +1,143 @@
+package piplayer
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+)
+
+// configMigration upgrades a config file from one version to the next.
+// It works on the raw JSON object, because older layouts don't fit in Config.
+type configMigration func(raw map[string]interface{}) error
+
+// configMigrations upgrades a config file from version i to version i+1.
+// Add a migration here whenever the layout of Config changes.
+var configMigrations = []configMigration{
+	migrateDirectoryToMount,
+	migrateDropSMB,
+}
+
+// currentConfigVersion is the version of the config file layout written by
+// this version of pi-player.
+var currentConfigVersion = len(configMigrations)
+
+// networkShareDir is where docs/INSTALL.md mounts the SMB network share.
+const networkShareDir = "/mnt/networkshare"
+
+// migrateDirectoryToMount upgrades a version 0 config, where the media folder
+// was set with Directory, to a Mount with a URL.
+func migrateDirectoryToMount(raw map[string]interface{}) error {
+	dir, ok := raw["Directory"]
+	if !ok {
+		return nil
+	}
+	delete(raw, "Directory")
+
+	d, ok := dir.(string)
+	if !ok {
+		return fmt.Errorf("Directory: expected a string, got %T", dir)
+	}
+
+	if _, ok := raw["Mount"]; !ok {
+		raw["Mount"] = map[string]interface{}{"URL": d}
+	}
+
+	return nil
+}
+
+// migrateDropSMB upgrades a version 1 config, where Mount could be an SMB
+// share with its own credentials. pi-player no longer mounts shares itself,
+// so an SMB mount is pointed at the share mounted by systemd instead.
+func migrateDropSMB(raw map[string]interface{}) error {
+	m, ok := raw["Mount"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	for _, key := range []string{"Username", "Password", "Domain"} {
+		delete(m, key)
+	}
+
+	s, _ := m["URL"].(string)
+	u, err := url.Parse(s)
+	if err != nil {
+		return fmt.Errorf("Mount.URL: %w", err)
+	}
+
+	if u.Scheme == "smb" {
+		log.Printf("SMB mounts are no longer supported, using %s for %s instead. See docs/INSTALL.md to mount the share on boot.\n", networkShareDir, s)
+		m["URL"] = networkShareDir
+	}
+
+	return nil
+}
+
+// migrateConfig upgrades config file data to the current version.
+// It returns the upgraded data, and the version the data was in.
+func migrateConfig(data []byte) ([]byte, int, error) {
+	raw := map[string]interface{}{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, 0, err
+	}
+
+	// Files from before the Version field are version 0 if they still use
+	// Directory, and version 1 otherwise.
+	version := 1
+	if _, ok := raw["Directory"]; ok {
+		version = 0
+	}
+	if v, ok := raw["Version"]; ok {
+		f, ok := v.(float64)
+		if !ok || f != float64(int(f)) || f < 0 {
+			return nil, 0, fmt.Errorf("Version: expected a whole number, got %v", v)
+		}
+		version = int(f)
+	}
+
+	if version > currentConfigVersion {
+		return nil, version, fmt.Errorf("config version %d is newer than this pi-player supports (%d), please update pi-player", version, currentConfigVersion)
+	}
+	if version == currentConfigVersion {
+		return data, version, nil
+	}
+
+	for v := version; v < currentConfigVersion; v++ {
+		if err := configMigrations[v](raw); err != nil {
+			return nil, version, fmt.Errorf("error migrating config from version %d to %d: %w", v, v+1, err)
+		}
+	}
+	raw["Version"] = currentConfigVersion
+
+	migrated, err := json.MarshalIndent(raw, "", "  ")
+	if err != nil {
+		return nil, version, err
+	}
+
+	return migrated, version, nil
+}
+
+// migrateConfigFile upgrades the config file to the current version if it's
+// older, keeping a copy of the old file next to it. It returns the data in the
+// file after migrating.
+func migrateConfigFile(configFile string, data []byte) ([]byte, error) {
+	migrated, version, err := migrateConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("config file %s: %w", configFile, err)
+	}
+	if version == currentConfigVersion {
+		return data, nil
+	}
+
+	backup := fmt.Sprintf("%s.v%d.bak", configFile, version)
+	if err := writeFileAtomic(backup, data, 0600); err != nil {
+		return nil, fmt.Errorf("error backing up config file before migrating: %w", err)
+	}
+
+	if err := writeFileAtomic(configFile, migrated, 0600); err != nil {
+		return nil, fmt.Errorf("error writing migrated config file: %w", err)
+	}
+
+	log.Printf("Migrated config file from version %d to %d. The old file was saved to %s\n", version, currentConfigVersion, backup)
+	return migrated, nil
+}
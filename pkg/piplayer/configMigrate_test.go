@@ -0,0 +1,76 @@
+package piplayer
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadConfigMigratesFixtures(t *testing.T) {
+	tests := []struct {
+		fixture string
+		version int
+		mount   string
+	}{
+		{"v0.json", 0, "/home/pi/Documents/pi-player"},
+		{"v1.json", 1, "/home/pi/Documents/pi-player"},
+		{"v1-smb.json", 1, networkShareDir},
+		{"v2.json", 2, "/home/pi/Documents/pi-player"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			original, err := os.ReadFile(filepath.Join("testdata", "config", tt.fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+			file := filepath.Join(t.TempDir(), "config.json")
+			if err := os.WriteFile(file, original, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			conf, err := readConfig(file)
+			if err != nil {
+				t.Fatalf("got error %v want nil", err)
+			}
+
+			if conf.Version != currentConfigVersion {
+				t.Errorf("got version %d want %d", conf.Version, currentConfigVersion)
+			}
+			if got := conf.Mount.URL.String(); got != tt.mount {
+				t.Errorf("got mount %q want %q", got, tt.mount)
+			}
+			if conf.Location != "Auditorium" || conf.AudioOutput != "hdmi" || conf.Login.Username != "admin" {
+				t.Errorf("fields lost while migrating: %+v", conf)
+			}
+
+			backup := fmt.Sprintf("%s.v%d.bak", file, tt.version)
+			data, err := os.ReadFile(backup)
+			if tt.version == currentConfigVersion {
+				if err == nil {
+					t.Errorf("current config was backed up to %s", backup)
+				}
+				return
+			}
+			if !bytes.Equal(data, original) {
+				t.Errorf("backup %s doesn't match the original file, error: %v", backup, err)
+			}
+
+			// The migrated file is written back, so it's only migrated once.
+			migrated, _ := os.ReadFile(file)
+			if !strings.Contains(string(migrated), `"Version": 2`) || strings.Contains(string(migrated), "secret") {
+				t.Errorf("migrated file not written back:\n%s", migrated)
+			}
+		})
+	}
+}
+
+func TestMigrateConfigRejectsNewerVersion(t *testing.T) {
+	_, _, err := migrateConfig([]byte(`{"Version": 99}`))
+	if err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("got error %v want error about a newer version", err)
+	}
+}
@@ -0,0 +1,194 @@
+package piplayer
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+var (
+	supportedStreamers    = []string{"chrome", "omx"}
+	supportedAudioOutputs = []string{"hdmi", "local", "both"}
+)
+
+// FieldError is a problem with a single field in the config.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// ConfigError holds all the problems found when validating a config.
+type ConfigError struct {
+	Problems []FieldError
+}
+
+func (e *ConfigError) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "invalid config, %d problem(s):", len(e.Problems))
+	for _, p := range e.Problems {
+		sb.WriteString("\n  " + p.Error())
+	}
+	return sb.String()
+}
+
+// add records a problem with a field.
+func (e *ConfigError) add(field, format string, args ...interface{}) {
+	e.Problems = append(e.Problems, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// Validate checks every field in the config and returns a *ConfigError
+// listing all the problems, or nil if the config is valid.
+func (conf *Config) Validate() error {
+	return conf.validate(nil)
+}
+
+// validate is Validate, with the local media folders in created taken to
+// exist, eg: because restoring a backup creates them.
+func (conf *Config) validate(created []string) error {
+	errs := &ConfigError{}
+
+	if strings.TrimSpace(conf.Location) == "" {
+		errs.add("Location", "can't be empty")
+	}
+
+	conf.Mount.validate("Mount", errs, created)
+
+	validateAudioOutput("AudioOutput", conf.AudioOutput, errs)
+	validateStreamer("Streamer", conf.Streamer, errs)
+
+	if conf.Login.Username == "" {
+		errs.add("Login.Username", "can't be empty")
+	}
+	if !strings.HasPrefix(conf.Login.Password, "$2") {
+		errs.add("Login.Password", "must be a bcrypt hash, set the password from the settings page")
+	}
+
+	if conf.Addr != "" {
+		if _, _, err := net.SplitHostPort(conf.Addr); err != nil {
+			errs.add("Addr", "%v, use host:port or :port, eg: \":8080\"", err)
+		}
+	}
+
+	for i, root := range conf.USB.Roots {
+		if !filepath.IsAbs(root) {
+			errs.add(fmt.Sprintf("USB.Roots[%d]", i), "%q must be an absolute path, eg: \"/media/pi\"", root)
+		}
+	}
+	if conf.USB.Key != "" && !strings.HasPrefix(conf.USB.Key, "KEY_") {
+		errs.add("USB.Key", "%q is not a key name, eg: \"KEY_F5\"", conf.USB.Key)
+	}
+
+	if conf.Cache.SizeMB < 0 {
+		errs.add("Cache.SizeMB", "can't be negative, use 0 to turn the cache off")
+	}
+	if conf.Cache.Prefetch < 0 {
+		errs.add("Cache.Prefetch", "can't be negative, use 0 for the default of %d items", defaultPrefetch)
+	}
+	if conf.Cache.Dir != "" && !filepath.IsAbs(conf.Cache.Dir) {
+		errs.add("Cache.Dir", "%q must be an absolute path", conf.Cache.Dir)
+	}
+
+	if conf.SyncMinutes < 0 {
+		errs.add("SyncMinutes", "can't be negative, use 0 for the default of %d minutes", defaultSyncMinutes)
+	}
+
+	if len(conf.Remote.Names) == 0 {
+		errs.add("Remote.Names", "at least one input device name is needed, eg: \"keyboard\"")
+	}
+	for i, name := range conf.Remote.Names {
+		if strings.TrimSpace(name) == "" {
+			errs.add(fmt.Sprintf("Remote.Names[%d]", i), "can't be empty")
+		}
+	}
+
+	names := make(map[string]bool)
+	for i, prof := range conf.Profiles {
+		field := fmt.Sprintf("Profiles[%d]", i)
+		if strings.TrimSpace(prof.Name) == "" {
+			errs.add(field+".Name", "can't be empty")
+		} else if names[prof.Name] {
+			errs.add(field+".Name", "there's already a profile named %q", prof.Name)
+		}
+		names[prof.Name] = true
+
+		if prof.Mount != nil {
+			prof.Mount.validate(field+".Mount", errs, created)
+		}
+		validateAudioOutput(field+".AudioOutput", prof.AudioOutput, errs)
+		validateStreamer(field+".Streamer", prof.Streamer, errs)
+		if prof.Key != "" && !strings.HasPrefix(prof.Key, "KEY_") {
+			errs.add(field+".Key", "%q is not a key name, eg: \"KEY_F1\"", prof.Key)
+		}
+	}
+	if conf.ActiveProfile != "" && !names[conf.ActiveProfile] {
+		errs.add("ActiveProfile", "no profile named %q", conf.ActiveProfile)
+	}
+
+	if len(errs.Problems) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func validateAudioOutput(field, output string, errs *ConfigError) {
+	if output != "" && !slices.Contains(supportedAudioOutputs, output) {
+		errs.add(field, "unsupported audio output %q, use one of %s", output, strings.Join(supportedAudioOutputs, ", "))
+	}
+}
+
+func validateStreamer(field, streamer string, errs *ConfigError) {
+	if streamer != "" && !slices.Contains(supportedStreamers, streamer) {
+		errs.add(field, "unsupported streamer %q, use one of %s", streamer, strings.Join(supportedStreamers, ", "))
+	}
+}
+
+// validate checks that the mount points to a local directory that exists, or
+// is in created, or to a remote content source that can be synced.
+func (m *mount) validate(field string, errs *ConfigError, created []string) {
+	if m.URL.URL == nil || (m.URL.Path == "" && m.URL.Host == "") {
+		errs.add(field+".URL", "can't be empty, set it to the folder with the media files")
+		return
+	}
+
+	switch m.URL.Scheme {
+	case "", "file":
+	case "http", "https":
+		if m.URL.Host == "" {
+			errs.add(field+".URL", "%q has no host, eg: https://example.com/media/manifest.json", m.URL)
+		}
+		return
+	case "s3":
+		if m.URL.Host == "" {
+			errs.add(field+".URL", "%q has no bucket, eg: s3://bucket/prefix", m.URL)
+		}
+		if e := m.URL.Query().Get("endpoint"); e != "" {
+			if u, err := url.Parse(e); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				errs.add(field+".URL", "endpoint %q must be an http or https URL", e)
+			}
+		}
+		return
+	default:
+		errs.add(field+".URL", "unsupported scheme %q, use a local folder, an http(s) manifest URL or s3://bucket/prefix", m.URL.Scheme)
+		return
+	}
+
+	if slices.Contains(created, m.URL.Path) {
+		return
+	}
+	info, err := os.Stat(m.URL.Path)
+	if os.IsNotExist(err) {
+		errs.add(field+".URL", "folder %q does not exist", m.URL.Path)
+	} else if err != nil {
+		errs.add(field+".URL", "can't read folder %q: %v", m.URL.Path, err)
+	} else if !info.IsDir() {
+		errs.add(field+".URL", "%q is not a folder", m.URL.Path)
+	}
+}
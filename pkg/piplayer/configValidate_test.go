@@ -0,0 +1,52 @@
+package piplayer
+
+import (
+	"errors"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func validConfig(t *testing.T) Config {
+	dir := t.TempDir()
+	return Config{
+		Version:  currentConfigVersion,
+		Location: "Test",
+		Mount:    mount{URL: sURL{URL: &url.URL{Path: dir}}, Dir: dir},
+		Login:    Login{Username: "admin", Password: "$2a$14$hash"},
+		Remote:   remote{Names: []string{"keyboard"}},
+	}
+}
+
+func TestValidateValid(t *testing.T) {
+	conf := validConfig(t)
+	if err := conf.Validate(); err != nil {
+		t.Errorf("got error %v want nil", err)
+	}
+}
+
+func TestValidateReportsAllProblems(t *testing.T) {
+	conf := validConfig(t)
+	conf.Location = " "
+	conf.Mount.URL.Path = "/does/not/exist"
+	conf.Streamer = "vlc"
+	conf.AudioOutput = "speaker"
+	conf.Remote.Names = []string{"keyboard", ""}
+
+	err := conf.Validate()
+
+	var ce *ConfigError
+	if !errors.As(err, &ce) {
+		t.Fatalf("got error %v want *ConfigError", err)
+	}
+
+	var got []string
+	for _, p := range ce.Problems {
+		got = append(got, p.Field)
+	}
+	want := []string{"Location", "Mount.URL", "AudioOutput", "Streamer", "Remote.Names[1]"}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got problems with %v want %v", got, want)
+	}
+}
@@ -0,0 +1,186 @@
+package piplayer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// configReloadDelay is how long to wait after the last change to the config
+// file before reloading it. Editors often write a file in several steps.
+const configReloadDelay = 500 * time.Millisecond
+
+// WatchConfig watches the config file and applies changes to it while the
+// player is running. Edits that make the config invalid are logged and ignored.
+// Flags and environment variables are applied on top of every reload, so they
+// keep taking precedence. It stops when ctx is cancelled.
+func (p *Player) WatchConfig(ctx context.Context) error {
+	configFile := configFilePath()
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("error creating config watcher: %w", err)
+	}
+
+	// Watch the folder rather than the file, because editors often replace
+	// the file instead of writing to it, which would stop a file watch.
+	if err := watcher.Add(filepath.Dir(configFile)); err != nil {
+		watcher.Close()
+		return fmt.Errorf("error watching config folder: %w", err)
+	}
+
+	go p.watchConfig(ctx, watcher, configFile)
+
+	return nil
+}
+
+func (p *Player) watchConfig(ctx context.Context, watcher *fsnotify.Watcher, configFile string) {
+	defer watcher.Close()
+
+	timer := time.NewTimer(configReloadDelay)
+	timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				log.Println("issue getting config change event. Stopping config watcher.")
+				return
+			}
+			if filepath.Clean(event.Name) != configFile || !event.Has(fsnotify.Write|fsnotify.Create|fsnotify.Rename) {
+				continue
+			}
+			timer.Reset(configReloadDelay)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				log.Println("issue getting config change error. Stopping config watcher.")
+				return
+			}
+			log.Println("config watcher error:", err)
+		case <-timer.C:
+			if err := p.reloadConfig(configFile); err != nil {
+				log.Printf("Ignoring change to config file, keeping the current config:\n%v\n", err)
+			}
+		}
+	}
+}
+
+// reloadConfig reads the config file and applies it if it's valid.
+func (p *Player) reloadConfig(configFile string) error {
+	p.configMu.Lock()
+	defer p.configMu.Unlock()
+
+	newFile, err := readConfig(configFile)
+	if err != nil {
+		return err
+	}
+
+	// The settings page always saves a login, so a missing one is most
+	// likely a hand edit. Keep the current one instead of locking users out.
+	if newFile.Login.Username == "" {
+		newFile.Login = p.config().fileConfig().Login
+	}
+
+	newConf, err := p.runningConfig(newFile)
+	if err != nil {
+		return err
+	}
+
+	if err := newConf.Validate(); err != nil {
+		return fmt.Errorf("config file %s: %w", configFile, err)
+	}
+
+	p.applyConfig(newConf)
+
+	return nil
+}
+
+// runningConfig returns the config to run with for file, the config as it is
+// in config.json. The profile in use is kept, unless file switches to another
+// one or doesn't have it anymore. p.configMu must be held.
+func (p *Player) runningConfig(file *Config) (Config, error) {
+	old := p.config()
+	profile := file.ActiveProfile
+	if old.fileConfig().ActiveProfile == file.ActiveProfile {
+		if _, ok := file.findProfile(old.ActiveProfile); ok {
+			profile = old.ActiveProfile
+		}
+	}
+
+	return file.running(profile, old.overrides)
+}
+
+// applyConfig replaces the running config with newConf, and updates the parts
+// of the player affected by the fields that changed. newConf must be valid.
+// p.configMu must be held.
+func (p *Player) applyConfig(newConf Config) {
+	old := *p.config()
+	p.conf.Store(&newConf)
+	p.api.debug.Store(newConf.Debug)
+
+	if old.Debug != newConf.Debug {
+		log.Printf("config: debug set to %t\n", newConf.Debug)
+	}
+
+	if old.Mount.URL.String() != newConf.Mount.URL.String() || old.syncInterval() != newConf.syncInterval() {
+		p.startContentSync()
+	}
+
+	if old.Mount.Dir != newConf.Mount.Dir && p.usb.playing() != "" {
+		log.Printf("config: media folder changed to %s, it's played after switching back from the USB drive\n", newConf.Mount.Dir)
+	} else if old.Mount.Dir != newConf.Mount.Dir {
+		log.Printf("config: media folder changed to %s\n", newConf.Mount.Dir)
+		if err := p.playlist.setDir(p, newConf.Mount.Dir); err != nil {
+			log.Printf("error trying to switch the playlist to %s:\n%v\n", newConf.Mount.Dir, err)
+		}
+		p.resetMode()
+	}
+
+	if old.ActiveProfile != newConf.ActiveProfile || old.Location != newConf.Location || old.Playlist != newConf.Playlist {
+		msg := wsMessage{
+			Component: "profile",
+			Event:     "switched",
+			Success:   true,
+			Message:   newConf.profileInfo(),
+		}
+		p.ConnViewer.enqueue(msg)
+		p.ConnControl.enqueue(msg)
+	}
+
+	if old.Cache != newConf.Cache {
+		log.Printf("config: media cache changed to %d MB in %s\n", newConf.Cache.SizeMB, newConf.Cache.dir())
+		p.setupCache()
+	}
+
+	if old.AudioOutput != newConf.AudioOutput {
+		log.Printf("config: audio output changed to %q\n", newConf.AudioOutput)
+		if s, ok := p.currentStreamer().(audioOutputSetter); ok {
+			s.SetAudioOutput(newConf.AudioOutput)
+		}
+	}
+
+	if !slices.Equal(old.Remote.Names, newConf.Remote.Names) {
+		log.Printf("config: remote names changed to %v, re-opening devices\n", newConf.Remote.Names)
+		p.reopenRemote()
+	}
+
+	if old.Streamer != newConf.Streamer {
+		log.Printf("config: streamer changed to %q\n", newConf.Streamer)
+		old := p.setStreamer(p.newStreamer(&newConf))
+		if err := old.Close(); err != nil {
+			log.Printf("error trying to close the previous streamer:\n%v\n", err)
+		}
+	}
+
+	if old.ListenAddr() != newConf.ListenAddr() && p.Server != nil {
+		log.Printf("config: listen address changed to %s\n", newConf.ListenAddr())
+		restart(p)
+	}
+}
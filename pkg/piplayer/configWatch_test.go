@@ -0,0 +1,104 @@
+package piplayer
+
+import (
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// reloadPlayer returns a player running with conf, without a server or remote.
+func reloadPlayer(t *testing.T, conf Config) *Player {
+	p := &Player{
+		api:         &APIHandler{},
+		ConnViewer:  NewConnWS(),
+		ConnControl: NewHub(),
+		streamer:    &OMXPlayer{audioOutput: conf.AudioOutput},
+		state:       newPlayerState(),
+	}
+	p.conf.Store(&conf)
+
+	var err error
+	if p.playlist, err = NewPlaylist(p, conf.Mount.Dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.playlist.watcher.Close() })
+
+	return p
+}
+
+func writeConfig(t *testing.T, file string, conf Config) {
+	data, err := json.Marshal(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadConfigApplies(t *testing.T) {
+	conf := validConfig(t)
+	p := reloadPlayer(t, conf)
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "slide.jpg"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	edited := conf
+	edited.Debug = true
+	edited.AudioOutput = "hdmi"
+	edited.Mount = mount{URL: sURL{URL: &url.URL{Path: dir}}}
+	file := filepath.Join(t.TempDir(), "config.json")
+	writeConfig(t, file, edited)
+
+	if err := p.reloadConfig(file); err != nil {
+		t.Fatalf("got error %v want nil", err)
+	}
+
+	if !p.config().Debug || !p.api.debug.Load() {
+		t.Error("debug not turned on")
+	}
+	if p.config().Mount.Dir != dir || p.playlist.Name != dir || len(p.playlist.Items) != 1 {
+		t.Errorf("playlist not moved to %s, got %s with %d items", dir, p.playlist.Name, len(p.playlist.Items))
+	}
+	if got := p.currentStreamer().(*OMXPlayer).audioOutput; got != "hdmi" {
+		t.Errorf("got audio output %q want %q", got, "hdmi")
+	}
+
+	edited.Streamer = "chrome"
+	writeConfig(t, file, edited)
+	if err := p.reloadConfig(file); err != nil {
+		t.Fatalf("got error %v want nil", err)
+	}
+	if _, ok := p.currentStreamer().(*Chrome); !ok {
+		t.Errorf("got streamer %T want *Chrome", p.currentStreamer())
+	}
+}
+
+func TestReloadConfigRejectsInvalid(t *testing.T) {
+	conf := validConfig(t)
+	p := reloadPlayer(t, conf)
+
+	edited := conf
+	edited.Location = "Edited"
+	edited.Streamer = "vlc"
+	file := filepath.Join(t.TempDir(), "config.json")
+	writeConfig(t, file, edited)
+
+	if err := p.reloadConfig(file); err == nil {
+		t.Fatal("got nil error for an invalid config")
+	}
+	if p.config().Location != conf.Location {
+		t.Errorf("got location %q want %q", p.config().Location, conf.Location)
+	}
+
+	if err := os.WriteFile(file, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.reloadConfig(file); err == nil {
+		t.Fatal("got nil error for a config that doesn't parse")
+	}
+}
@@ -1,8 +1,10 @@
 package piplayer
 
 import (
+	"context"
 	"log"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -12,7 +14,7 @@ const (
 	writeWait       = 10 * time.Second
 	pongWait        = 60 * time.Second
 	pingPeriod      = (pongWait * 9) / 10
-	maxMessageSize  = 512
+	maxMessageSize  = 64 << 10 // Fits a setOrder naming every item in a playlist.
 	readBufferSize  = 1024
 	writeBufferSize = 1024
 )
@@ -20,166 +22,209 @@ const (
 var upgrader = &websocket.Upgrader{
 	ReadBufferSize:  readBufferSize,
 	WriteBufferSize: writeBufferSize,
+	Subprotocols:    []string{protocolName(protocolVersion)},
 }
 
 // ConnectionWS represents a WebSocket connection.
 type ConnectionWS interface {
 	HandlerWebsocket(p *Player) http.HandlerFunc
-	read()
-	write()
-	getChanSend() chan wsMessage
-	getChanReceive() chan wsMessage
+	enqueue(msg wsMessage) bool
+	request(ctx context.Context, msg wsMessage) (wsMessage, error)
 	isActive() bool
+	queueStats() QueueStats
 }
 
 // connWS represents a WebSocket connection.
+// Only one browser can be connected at a time, a new connection takes over
+// from the previous one.
 type connWS struct {
+	mu      sync.Mutex
 	conn    *websocket.Conn
-	send    chan wsMessage
-	receive chan wsMessage
-	active  bool
+	queue   *sendQueue
+	pending pendingRequests
+	stats   queueStats
 }
 
-// NewConnection returns a connection with open send and receive channels
-// func NewConnection() ConnectionWS {
-// 	conn := ConnectionWS{
-// 		send:    make(chan resMessage),
-// 		receive: make(chan reqMessage),
-// 	}
-
-// 	return conn
-// }
-
 // NewConnWS returns a new websocket connection struct.
 func NewConnWS() ConnectionWS {
 	// NOTE: interfaces are always pointers...
 	// So I have to return a pointer here.
-	return &connWS{
-		send:    make(chan wsMessage),
-		receive: make(chan wsMessage),
-	}
+	return &connWS{}
 }
 
-func (c *connWS) getChanSend() chan wsMessage {
-	return c.send
+// enqueue queues a message to be sent to the browser. It never blocks.
+// The message is dropped if no browser is connected.
+func (c *connWS) enqueue(msg wsMessage) bool {
+	c.mu.Lock()
+	q := c.queue
+	c.mu.Unlock()
+
+	if q == nil {
+		c.stats.dropped.Add(1)
+		return false
+	}
+
+	return q.push(msg)
 }
 
-func (c *connWS) getChanReceive() chan wsMessage {
-	return c.receive
+// request sends a message to the browser and waits for the reply with the
+// same ID. Use the context to set a timeout or to cancel the request.
+func (c *connWS) request(ctx context.Context, msg wsMessage) (wsMessage, error) {
+	id, ch := c.pending.add()
+	msg.ID = id
+
+	if !c.enqueue(msg) {
+		c.pending.remove(id)
+		return wsMessage{}, &RequestError{ID: id, Method: msg.Method, Err: ErrNotConnected}
+	}
+
+	return c.pending.wait(ctx, id, msg.Method, ch)
 }
 
 func (c *connWS) isActive() bool {
-	return c.active
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.queue != nil
 }
 
-// HandlerWebsocket handles websocket connections for the browser viewer and controller.
-func (c *connWS) HandlerWebsocket(p *Player) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// If connection is already active, then close it gracefully, and create a new one.
-		if c.active {
-			if p.conf.Debug {
-				log.Printf("new websocket connection request while previous request was active. Closing current connection.")
-			}
-
-			msg := wsMessage{
-				Component: "connection",
-				Event:     "disconnect",
-				Success:   true,
-				Message:   "Another device has taken over the connection. Login again to take it back.",
-			}
-
-			c.active = false
+func (c *connWS) queueStats() QueueStats {
+	return c.stats.snapshot()
+}
 
-			if err := c.conn.WriteJSON(msg); err != nil {
-				log.Printf("error writting disconnect message: ConnectionWS.HandlerWebsocket: %v\n", err)
-			}
+// detach forgets about the connection that uses q, if it's still the current one.
+func (c *connWS) detach(q *sendQueue) {
+	c.mu.Lock()
+	current := c.queue == q
+	if current {
+		c.conn = nil
+		c.queue = nil
+	}
+	c.mu.Unlock()
 
-			if err := c.conn.WriteMessage(websocket.CloseMessage, []byte{}); err != nil {
-				log.Printf("error writting close message: ConnectionWS.HandlerWebsocket(): %v\n", err)
-			}
+	q.close()
+	if current {
+		c.pending.failAll()
+	}
+}
 
-			c.conn.Close()
-			// close(c.send)
-			// close(c.receive)
+// HandlerWebsocket handles websocket connections for the browser viewer.
+func (c *connWS) HandlerWebsocket(p *Player) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := negotiateProtocol(r); err != nil {
+			log.Println("Refusing websocket connection:", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
 
-		var err error
-		c.conn, err = upgrader.Upgrade(w, r, nil)
+		conn, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
 			log.Println("Error trying to upgrade to websocket connection:", err)
-			c.active = false
 			return
 		}
 
 		log.Println("Websocket connection being handled for ", r.URL.Path)
 
-		// c.send = make(chan wsMessage)
-		// c.receive = make(chan wsMessage)
+		q := newSendQueue(sendQueueSize, &c.stats)
+		// The first frame is always the current state, so the browser can
+		// pick up where the previous connection left off.
+		q.push(p.snapshotMessage())
+
+		c.mu.Lock()
+		old := c.queue
+		c.conn = conn
+		c.queue = q
+		c.mu.Unlock()
+
+		// If a connection was already active, close it gracefully.
+		if old != nil {
+			if p.config().Debug {
+				log.Printf("new websocket connection request while previous request was active. Closing previous connection.")
+			}
+
+			old.push(wsMessage{
+				Component: "connection",
+				Event:     "disconnect",
+				Success:   true,
+				Message:   "Another device has taken over the connection. Login again to take it back.",
+			})
+			old.close()
+			// Requests sent to the old browser will never be answered.
+			c.pending.failAll()
+		}
 
-		c.active = true
-		go c.write()
-		// go c.read()
-		// go p.HandleWebSocketMessage()
+		go c.write(conn, q)
+		go c.read(p, conn, q)
 	}
 }
 
-// write sends data to the websocket.
-func (c *connWS) write() {
-	log.Printf("Starting write() goroutine\n")
-
+// write sends queued messages to the websocket until the queue is closed
+// or the connection breaks.
+func (c *connWS) write(conn *websocket.Conn, q *sendQueue) {
 	ticker := time.NewTicker(pingPeriod)
 	defer func() {
-		log.Printf("Something is wrong in the write() function. Closing websocket.")
 		ticker.Stop()
-		c.conn.Close()
-		c.active = false
+		conn.Close()
+		c.detach(q)
 	}()
 
-	// This loop keeps running as long as the channel is open.
 	for {
 		select {
-		// Send a message from the send channel to the websocket.
-		case msg, ok := <-c.send:
-			if !ok {
-				log.Printf("Something is wrong reading from the send channel. Closing websocket.")
-				if err := c.conn.WriteMessage(websocket.CloseMessage, []byte{}); err != nil {
-					log.Printf("error writting close message: ConnectionWS.write(): %v\n", err)
-				}
+		case <-q.ready:
+			if err := writeQueue(conn, q); err != nil {
+				log.Printf("error trying to write JSON to the socket: %v\n", err)
 				return
 			}
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			err := c.conn.WriteJSON(msg)
-			if err != nil {
-				log.Printf("error trying to write JSON to the socket: %v\n", err)
-				// this probably means that the connection is broken,
+			if q.isClosed() {
+				conn.SetWriteDeadline(time.Now().Add(writeWait))
+				if err := conn.WriteMessage(websocket.CloseMessage, []byte{}); err != nil {
+					log.Printf("error writting close message: ConnectionWS.write(): %v\n", err)
+				}
 				return
 			}
 		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				log.Printf("error trying to send ping message. Exiting goroutine: %v\n", err)
-				// There are more elegant ways to handle a closed connection.
-				// We could have a cancel channel here that ends this goroutine cleanly.
 				return
 			}
 		}
 	}
 }
 
-// read reads the messages from the socket.
-func (c *connWS) read() {
-	defer c.conn.Close()
+// writeQueue writes every message that's waiting in the queue.
+func writeQueue(conn *websocket.Conn, q *sendQueue) error {
+	for {
+		msg, ok := q.pop()
+		if !ok {
+			return nil
+		}
+		conn.SetWriteDeadline(time.Now().Add(writeWait))
+		if err := conn.WriteJSON(msg); err != nil {
+			return err
+		}
+		q.stats.sent.Add(1)
+	}
+}
+
+// read reads the messages from the socket. Requests are dispatched to the
+// same component handlers as the /api endpoint, and the response is sent back
+// on this connection. Replies are handed to the request waiting for them.
+func (c *connWS) read(p *Player, conn *websocket.Conn, q *sendQueue) {
+	defer func() {
+		c.detach(q)
+		conn.Close()
+	}()
 
-	c.conn.SetReadLimit(maxMessageSize)
-	c.conn.SetReadDeadline(time.Now().Add(pongWait))
-	c.conn.SetPongHandler(func(string) error {
-		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetReadLimit(maxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(pongWait))
 		return nil
 	})
 
 	for {
 		var msg wsMessage
-		err := c.conn.ReadJSON(&msg)
+		err := conn.ReadJSON(&msg)
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("websocket unexpectadly closed, returning out of read() function: %v\n", err)
@@ -188,13 +233,47 @@ func (c *connWS) read() {
 			} else {
 				log.Printf("error trying to read the JSON from the socket, returning out of read() function: %v\n", err)
 			}
+			return
+		}
 
-			c.active = false
-			break
+		if p.config().Debug {
+			log.Println("socket message received: ", msg)
 		}
 
-		// Handle socket messages.
-		log.Println("socket message received: ", msg)
-		c.receive <- msg
+		if msg.isRequest() {
+			req := msg.request()
+			// The viewer isn't logged in, it can only send the requests
+			// anyone can.
+			q.push(req.reply(p.api.dispatch(p, req, accessNone)))
+			continue
+		}
+
+		if !c.pending.resolve(msg) {
+			log.Println("nothing waiting for socket message, ignoring it: ", msg)
+		}
 	}
 }
+
+// handleConnectionAPI handles requests to the connection api.
+func handleConnectionAPI(p *Player, req reqMessage) resMessage {
+	switch req.Method {
+	case "stats":
+		return resMessage{
+			Success: true,
+			Event:   "stats",
+			Message: map[string]interface{}{
+				"viewer": map[string]interface{}{
+					"connected": p.ConnViewer.isActive(),
+					"queue":     p.ConnViewer.queueStats(),
+				},
+				"control": map[string]interface{}{
+					"clients": p.ConnControl.count(),
+					"queue":   p.ConnControl.queueStats(),
+				},
+			},
+		}
+	}
+
+	log.Printf("API call unsupported. Ignoring:\n%v\n", req)
+	return resMessage{Success: false, Event: "methodNotSupported", Message: "Method not supported: " + req.Method}
+}
@@ -0,0 +1,338 @@
+package piplayer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ContentSource is where the media files of a mount come from. Every source
+// keeps a local folder up to date, and the playlist reads from that folder.
+type ContentSource interface {
+	// Dir returns the local folder the media files are in.
+	Dir() string
+	// Sync brings Dir up to date with the source.
+	Sync(ctx context.Context) error
+}
+
+// newContentSource returns the content source for the mount URL.
+func newContentSource(m mount) (ContentSource, error) {
+	if m.URL.URL == nil {
+		return nil, errors.New("mount has no URL")
+	}
+
+	switch m.URL.Scheme {
+	case "", "file":
+		return localSource{dir: m.Dir}, nil
+	case "http", "https":
+		return newHTTPSource(m.URL.URL, m.Dir), nil
+	case "s3":
+		return newS3Source(m.URL.URL, m.Dir)
+	}
+	return nil, fmt.Errorf("unsupported mount scheme %q", m.URL.Scheme)
+}
+
+// localSource is a folder on the player itself, eg: a USB drive or a network
+// share mounted by the OS. There's nothing to sync.
+type localSource struct {
+	dir string
+}
+
+func (s localSource) Dir() string {
+	return s.dir
+}
+
+func (s localSource) Sync(ctx context.Context) error {
+	return nil
+}
+
+// remoteFile is a media file listed by a remote content source.
+type remoteFile struct {
+	Name string
+	Size int64
+	// SHA256 is the hex encoded SHA-256 of the file, if the source has it.
+	SHA256 string
+}
+
+// openFunc returns the body of f from offset onwards. partial reports whether
+// the body starts at offset, otherwise it starts at the beginning of the file.
+type openFunc func(ctx context.Context, f remoteFile, offset int64) (body io.ReadCloser, partial bool, err error)
+
+// syncStateFile is where syncFiles remembers the checksums of the files it
+// has checked, so that unchanged files aren't hashed on every sync.
+const syncStateFile = ".pi-player-sync.json"
+
+// syncedFile is a file that was checked against its SHA-256.
+type syncedFile struct {
+	Size    int64
+	ModTime time.Time
+	SHA256  string
+}
+
+// syncFiles makes dir hold exactly files. Files that are missing, have a
+// different size, or have a different SHA-256 are downloaded with open, and
+// local files that aren't listed are removed.
+// Downloads go to a hidden .part file that's resumed on the next sync if the
+// download is interrupted. A file is only renamed into place once it's
+// complete and its SHA-256 matches, so the playlist never sees half a file.
+func syncFiles(ctx context.Context, dir string, files []remoteFile, open openFunc) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	state := readSyncState(dir)
+	newState := map[string]syncedFile{}
+	keep := map[string]bool{syncStateFile: true}
+	var errs []error
+
+	for _, f := range files {
+		if !validFileName(f.Name) {
+			errs = append(errs, fmt.Errorf("skipping %q: not a plain file name", f.Name))
+			continue
+		}
+		keep[f.Name] = true
+		keep[partName(f)] = true
+
+		path := filepath.Join(dir, f.Name)
+		if synced, ok := upToDate(path, f, state[f.Name]); ok {
+			if f.SHA256 != "" {
+				newState[f.Name] = synced
+			}
+			continue
+		}
+
+		if err := downloadFile(ctx, dir, f, open); err != nil {
+			errs = append(errs, fmt.Errorf("downloading %s: %w", f.Name, err))
+		} else if info, err := os.Stat(path); err == nil && f.SHA256 != "" {
+			newState[f.Name] = syncedFile{Size: info.Size(), ModTime: info.ModTime(), SHA256: f.SHA256}
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return errors.Join(append(errs, err)...)
+	}
+	for _, e := range entries {
+		if e.IsDir() || keep[e.Name()] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if err := writeSyncState(dir, newState); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// upToDate reports whether the file at path matches f. The file is only
+// hashed if it changed since it was last checked.
+func upToDate(path string, f remoteFile, last syncedFile) (syncedFile, bool) {
+	info, err := os.Stat(path)
+	if err != nil || info.Size() != f.Size {
+		return syncedFile{}, false
+	}
+	if f.SHA256 == "" {
+		return syncedFile{}, true
+	}
+
+	synced := syncedFile{Size: info.Size(), ModTime: info.ModTime(), SHA256: last.SHA256}
+	if last.Size != synced.Size || !last.ModTime.Equal(synced.ModTime) {
+		if synced.SHA256, err = fileSHA256(path); err != nil {
+			return syncedFile{}, false
+		}
+	}
+	return synced, strings.EqualFold(synced.SHA256, f.SHA256)
+}
+
+// partName returns the name f is downloaded to before it's complete. It
+// changes with the file, so that a download is only resumed for the same file.
+func partName(f remoteFile) string {
+	version := strconv.FormatInt(f.Size, 10)
+	if f.SHA256 != "" {
+		version = strings.ToLower(f.SHA256)
+		version = version[:min(len(version), 16)]
+	}
+	return "." + f.Name + "." + version + ".part"
+}
+
+// downloadFile downloads f into dir, resuming a previous download if there's
+// one, and renames it into place once it's verified.
+func downloadFile(ctx context.Context, dir string, f remoteFile, open openFunc) error {
+	part := filepath.Join(dir, partName(f))
+	h := sha256.New()
+
+	var offset int64
+	if info, err := os.Stat(part); err == nil && info.Size() <= f.Size {
+		if err := hashFile(part, h); err == nil {
+			offset = info.Size()
+		} else {
+			h.Reset()
+		}
+	}
+
+	if offset < f.Size || f.Size == 0 {
+		body, partial, err := open(ctx, f, offset)
+		if errors.Is(err, errRangeNotSatisfiable) {
+			// The file changed since the part was downloaded, start again
+			// on the next sync.
+			os.Remove(part)
+		}
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+
+		flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		if !partial {
+			flags |= os.O_TRUNC
+			offset = 0
+			h.Reset()
+		}
+		out, err := os.OpenFile(part, flags, 0644)
+		if err != nil {
+			return err
+		}
+		// Copy at most one byte more than expected, to notice a file that's too big.
+		n, err := io.Copy(io.MultiWriter(out, h), io.LimitReader(body, f.Size-offset+1))
+		if err == nil {
+			err = out.Sync()
+		}
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		offset += n
+	}
+
+	if offset != f.Size {
+		if offset > f.Size {
+			os.Remove(part)
+		}
+		return fmt.Errorf("got %d bytes want %d", offset, f.Size)
+	}
+	if f.SHA256 != "" {
+		if sum := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(sum, f.SHA256) {
+			os.Remove(part)
+			return fmt.Errorf("got SHA-256 %s want %s", sum, f.SHA256)
+		}
+	}
+
+	return os.Rename(part, filepath.Join(dir, f.Name))
+}
+
+// fileSHA256 returns the hex encoded SHA-256 of the file at path.
+func fileSHA256(path string) (string, error) {
+	h := sha256.New()
+	if err := hashFile(path, h); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashFile writes the file at path to h.
+func hashFile(path string, h io.Writer) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = io.Copy(h, file)
+	return err
+}
+
+// readSyncState returns the files syncFiles checked in dir. A missing or
+// damaged state file means every file is checked again.
+func readSyncState(dir string) map[string]syncedFile {
+	state := map[string]syncedFile{}
+	data, err := os.ReadFile(filepath.Join(dir, syncStateFile))
+	if err == nil {
+		json.Unmarshal(data, &state)
+	}
+	return state
+}
+
+func writeSyncState(dir string, state map[string]syncedFile) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, syncStateFile), data, 0644)
+}
+
+// validFileName reports whether name is a plain file name that stays inside
+// the folder it's joined to.
+func validFileName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.HasPrefix(name, ".") &&
+		!strings.ContainsAny(name, `/\`) && filepath.Base(name) == name
+}
+
+// startContentSync stops syncing the previous content source, and starts
+// syncing the one for the current mount, once now and then every
+// SyncMinutes. The local folder is created before it returns, so the
+// playlist can watch it straight away. p.configMu must be held, except while
+// the player is being created.
+func (p *Player) startContentSync() {
+	if p.contentCancel != nil {
+		p.contentCancel()
+		p.contentCancel = nil
+	}
+
+	src, err := newContentSource(p.config().Mount)
+	if err != nil {
+		log.Printf("error trying to set up the content source:\n%v\n", err)
+		return
+	}
+	if _, ok := src.(localSource); ok {
+		return
+	}
+
+	if err := os.MkdirAll(src.Dir(), 0755); err != nil {
+		log.Printf("error trying to create the content cache %s:\n%v\n", src.Dir(), err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p.contentCancel = cancel
+	go syncContent(ctx, src, p.config().syncInterval(), p.api.debug.Load())
+}
+
+// syncContent syncs src every interval until ctx is cancelled.
+func syncContent(ctx context.Context, src ContentSource, interval time.Duration, debug bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if debug {
+			log.Printf("syncing content into %s\n", src.Dir())
+		}
+		if err := src.Sync(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("error trying to sync content into %s:\n%v\n", src.Dir(), err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package piplayer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// httpSource mirrors the files listed in a JSON manifest served over HTTP(S).
+type httpSource struct {
+	manifest *url.URL
+	dir      string
+	client   *http.Client
+}
+
+// httpManifest is the file an httpSource reads, eg:
+//
+//	{
+//	  "files": [
+//	    {"name": "intro.mp4", "size": 1048576, "sha256": "9f86d08..."},
+//	    {"name": "slide.jpg", "size": 2048, "url": "https://cdn.example.com/slide.jpg"}
+//	  ],
+//	  "presentation": {"Items": [{"Visual": "intro.mp4"}]}
+//	}
+//
+// A file without a URL is downloaded from next to the manifest. A file with a
+// sha256 is checked against it.
+type httpManifest struct {
+	Files []manifestFile `json:"files"`
+	// Presentation is written to presentation.json in the media folder.
+	Presentation json.RawMessage `json:"presentation,omitempty"`
+}
+
+type manifestFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+	URL    string `json:"url,omitempty"`
+}
+
+func newHTTPSource(manifest *url.URL, dir string) *httpSource {
+	return &httpSource{manifest: manifest, dir: dir, client: http.DefaultClient}
+}
+
+func (s *httpSource) Dir() string {
+	return s.dir
+}
+
+func (s *httpSource) Sync(ctx context.Context) error {
+	m, err := s.readManifest(ctx)
+	if err != nil {
+		return err
+	}
+
+	urls := make(map[string]*url.URL, len(m.Files))
+	files := make([]remoteFile, 0, len(m.Files))
+	for _, f := range m.Files {
+		ref := &url.URL{Path: f.Name}
+		if f.URL != "" {
+			if ref, err = url.Parse(f.URL); err != nil {
+				return fmt.Errorf("manifest %s: file %q: %w", s.manifest, f.Name, err)
+			}
+		}
+		urls[f.Name] = s.manifest.ResolveReference(ref)
+		files = append(files, remoteFile{Name: f.Name, Size: f.Size, SHA256: f.SHA256})
+	}
+
+	// The presentation is synced like any other file, from the manifest
+	// instead of a URL.
+	if len(m.Presentation) > 0 {
+		if _, ok := urls[presentationFile]; ok {
+			return fmt.Errorf("manifest %s: %s is both listed and inline", s.manifest, presentationFile)
+		}
+		sum := sha256.Sum256(m.Presentation)
+		files = append(files, remoteFile{Name: presentationFile, Size: int64(len(m.Presentation)), SHA256: hex.EncodeToString(sum[:])})
+	}
+
+	return syncFiles(ctx, s.dir, files, func(ctx context.Context, f remoteFile, offset int64) (io.ReadCloser, bool, error) {
+		if u, ok := urls[f.Name]; ok {
+			return s.get(ctx, u, offset)
+		}
+		return io.NopCloser(bytes.NewReader(m.Presentation[offset:])), true, nil
+	})
+}
+
+// readManifest downloads and decodes the manifest.
+func (s *httpSource) readManifest(ctx context.Context) (*httpManifest, error) {
+	body, _, err := s.get(ctx, s.manifest, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	var m httpManifest
+	if err := json.NewDecoder(body).Decode(&m); err != nil {
+		return nil, fmt.Errorf("manifest %s: %w", s.manifest, err)
+	}
+	return &m, nil
+}
+
+// get returns the body of a successful GET request for u, from offset
+// onwards. partial reports whether the body starts at offset.
+func (s *httpSource) get(ctx context.Context, u *url.URL, offset int64) (body io.ReadCloser, partial bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, false, err
+	}
+	setRange(req, offset)
+
+	return doGet(s.client, req, offset)
+}
+
+// errRangeNotSatisfiable means the file is shorter than the part that was
+// already downloaded.
+var errRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// setRange asks for the body from offset onwards, if offset isn't 0.
+func setRange(req *http.Request, offset int64) {
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+}
+
+// doGet sends req, and returns the body if it succeeded. partial reports
+// whether the server sent the range from offset, otherwise the body is the
+// whole file. Servers that don't support ranges send the whole file.
+func doGet(client *http.Client, req *http.Request, offset int64) (body io.ReadCloser, partial bool, err error) {
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+
+	switch {
+	case res.StatusCode == http.StatusOK:
+		return res.Body, offset == 0, nil
+	case res.StatusCode == http.StatusPartialContent && strings.HasPrefix(res.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)):
+		return res.Body, true, nil
+	}
+
+	res.Body.Close()
+	if res.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		return nil, false, fmt.Errorf("GET %s: %w", req.URL, errRangeNotSatisfiable)
+	}
+	return nil, false, fmt.Errorf("GET %s: %s", req.URL, res.Status)
+}
@@ -0,0 +1,262 @@
+package piplayer
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// emptySHA256 is the SHA-256 of an empty request body.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3Source mirrors the objects directly under a prefix of an S3 compatible
+// bucket. The mount URL looks like:
+//
+//	s3://bucket/prefix?endpoint=http://minio.local:9000&region=us-east-1
+//
+// The endpoint defaults to AWS in the region, and the region to us-east-1.
+// Credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, and
+// requests are sent unsigned when they aren't set.
+type s3Source struct {
+	endpoint  *url.URL
+	bucket    string
+	prefix    string
+	region    string
+	accessKey string
+	secretKey string
+	dir       string
+	client    *http.Client
+	// now returns the time requests are signed with.
+	now func() time.Time
+}
+
+func newS3Source(u *url.URL, dir string) (*s3Source, error) {
+	q := u.Query()
+	s := s3Source{
+		bucket:    u.Host,
+		prefix:    strings.TrimPrefix(u.Path, "/"),
+		region:    q.Get("region"),
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		dir:       dir,
+		client:    http.DefaultClient,
+		now:       time.Now,
+	}
+	if s.bucket == "" {
+		return nil, fmt.Errorf("%s has no bucket", u)
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	if s.prefix != "" && !strings.HasSuffix(s.prefix, "/") {
+		s.prefix += "/"
+	}
+
+	endpoint := q.Get("endpoint")
+	if endpoint == "" {
+		endpoint = "https://s3." + s.region + ".amazonaws.com"
+	}
+	var err error
+	if s.endpoint, err = url.Parse(endpoint); err != nil {
+		return nil, fmt.Errorf("endpoint %q: %w", endpoint, err)
+	}
+
+	return &s, nil
+}
+
+func (s *s3Source) Dir() string {
+	return s.dir
+}
+
+func (s *s3Source) Sync(ctx context.Context) error {
+	files, err := s.list(ctx)
+	if err != nil {
+		return err
+	}
+
+	return syncFiles(ctx, s.dir, files, func(ctx context.Context, f remoteFile, offset int64) (io.ReadCloser, bool, error) {
+		return s.get(ctx, "/"+s.bucket+"/"+s.prefix+f.Name, nil, offset)
+	})
+}
+
+// listBucketResult is the part of a ListObjectsV2 response that's used.
+type listBucketResult struct {
+	Contents []struct {
+		Key  string
+		Size int64
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// list returns the objects directly under the prefix.
+func (s *s3Source) list(ctx context.Context) ([]remoteFile, error) {
+	var files []remoteFile
+	query := url.Values{
+		"list-type": {"2"},
+		"prefix":    {s.prefix},
+		"delimiter": {"/"},
+	}
+
+	for {
+		body, _, err := s.get(ctx, "/"+s.bucket, query, 0)
+		if err != nil {
+			return nil, err
+		}
+		var res listBucketResult
+		err = xml.NewDecoder(body).Decode(&res)
+		body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("listing s3://%s/%s: %w", s.bucket, s.prefix, err)
+		}
+
+		for _, obj := range res.Contents {
+			name := strings.TrimPrefix(obj.Key, s.prefix)
+			if name == "" {
+				continue
+			}
+			files = append(files, remoteFile{Name: name, Size: obj.Size})
+		}
+
+		if !res.IsTruncated || res.NextContinuationToken == "" {
+			return files, nil
+		}
+		query.Set("continuation-token", res.NextContinuationToken)
+	}
+}
+
+// get returns the body of a successful, signed GET request for path, from
+// offset onwards. partial reports whether the body starts at offset.
+func (s *s3Source) get(ctx context.Context, path string, query url.Values, offset int64) (body io.ReadCloser, partial bool, err error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawPath = ""
+	u.RawQuery = ""
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, false, err
+	}
+	req.URL.RawQuery = canonicalQuery(query)
+	setRange(req, offset)
+	if s.accessKey != "" {
+		signV4(req, s.accessKey, s.secretKey, s.region, "s3", s.now())
+	}
+
+	return doGet(s.client, req, offset)
+}
+
+// signV4 adds AWS Signature Version 4 headers to req, which must not have a
+// body. See https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func signV4(req *http.Request, accessKey, secretKey, region, service string, t time.Time) {
+	t = t.UTC()
+	amzDate := t.Format("20060102T150405Z")
+	day := t.Format("20060102")
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptySHA256)
+
+	// The path is sent exactly as it's signed.
+	path := awsEscape(req.URL.Path, false)
+	if path == "" {
+		path = "/"
+	}
+	req.URL.RawPath = path
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		name = strings.ToLower(name)
+		if name == "range" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptySHA256,
+	}, "\n")
+	sum := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{day, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes query the way AWS signs it: sorted by key, with
+// everything but unreserved characters escaped.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			pairs = append(pairs, awsEscape(k, true)+"="+awsEscape(v, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// awsEscape percent-encodes every byte of s except the unreserved characters
+// A-Z, a-z, 0-9, '-', '.', '_' and '~', and '/' unless encodeSlash is set.
+func awsEscape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,249 @@
+package piplayer
+
+import (
+	"errors"
+	"log"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// engine is the server's side of playback. It decides which item plays
+// next, runs the Timeout cues and moves on when the streamer reports that
+// the media ended. The viewer renders the items it's told to start.
+// The current item is kept in the playerState, so it's in every snapshot.
+type engine struct {
+	mu sync.Mutex
+	// timer runs the Timeout cue of the current item.
+	timer *time.Timer
+	// gen counts the items started. Timers carry the generation of the item
+	// they were started for, so one that fires after the item was replaced
+	// does nothing.
+	gen uint64
+	// override is the playback mode set through the API or the remote, or
+	// nil to use the one in the presentation.json, see modeInfo.
+	override *modeInfo
+	// shuffle is the order of the items when shuffling, the first played of
+	// which have been played.
+	shuffle []int
+	played  int
+}
+
+var errNoItems = errors.New("there are no items in the playlist")
+
+// begin makes the item at index the current one and starts its Timeout cue.
+// The viewer is told to render the item when render is set, otherwise it
+// has already started it. p.engine.mu must be held.
+func (p *Player) begin(index int, render bool) error {
+	item, err := p.playlist.start(p, index)
+	if err != nil {
+		return err
+	}
+	if p.mode().Shuffle {
+		p.markPlayed(index)
+	}
+
+	p.engine.gen++
+	p.stopTimer()
+	if item.Cues.Timeout > 0 {
+		gen := p.engine.gen
+		p.engine.timer = time.AfterFunc(time.Duration(item.Cues.Timeout)*time.Second, func() {
+			p.advance(gen)
+		})
+	}
+
+	p.cacheItems(index)
+
+	if render {
+		p.ConnViewer.enqueue(wsMessage{
+			Component: "player",
+			Method:    "start",
+			Arguments: map[string]string{"index": strconv.Itoa(index)},
+			Event:     "start",
+			Success:   true,
+			Message:   index,
+		})
+	}
+
+	// send update to the control page, if open.
+	if p.ConnControl.isActive() {
+		p.ConnControl.enqueue(wsMessage{
+			Success: true,
+			Event:   "setCurrent",
+			Message: index,
+		})
+	}
+
+	if p.api.debug.Load() {
+		log.Println("set current item index to:", index)
+	}
+	return nil
+}
+
+// stopTimer cancels the Timeout cue of the current item.
+// p.engine.mu must be held.
+func (p *Player) stopTimer() {
+	if p.engine.timer != nil {
+		p.engine.timer.Stop()
+		p.engine.timer = nil
+	}
+}
+
+// step starts the item step places from the current one, wrapping around at
+// the ends. When the current item finished by itself, what plays next
+// depends on the playback mode, see playModes. p.engine.mu must be held.
+func (p *Player) step(step int, finished bool) error {
+	current, n := p.playlist.position(p)
+	if n == 0 {
+		return errNoItems
+	}
+
+	mode := p.mode()
+
+	if finished && mode.Mode == modeRepeatOne && current >= 0 {
+		return p.begin(current, true)
+	}
+	if mode.Shuffle {
+		return p.stepShuffled(step, finished, mode.Mode, current)
+	}
+
+	if current < 0 {
+		// Nothing has played yet.
+		if step < 0 {
+			return p.begin(n-1, true)
+		}
+		return p.begin(0, true)
+	}
+
+	if finished && current == n-1 && p.end(mode.Mode) {
+		return nil
+	}
+
+	return p.begin(((current+step)%n+n)%n, true)
+}
+
+// end stops at the end of the playlist if the mode only plays it once,
+// reporting whether it did. p.engine.mu must be held.
+func (p *Player) end(mode string) bool {
+	switch mode {
+	case modeHold:
+		p.stopTimer()
+		if p.api.debug.Load() {
+			log.Println("holding on the last item of the playlist")
+		}
+		return true
+	case modeBlackout:
+		p.blackout()
+		return true
+	}
+	return false
+}
+
+// advance moves on from the item started as generation gen, when its
+// Timeout cue runs out.
+func (p *Player) advance(gen uint64) {
+	p.engine.mu.Lock()
+	defer p.engine.mu.Unlock()
+
+	if gen != p.engine.gen {
+		return
+	}
+	if err := p.step(1, true); err != nil {
+		log.Printf("error trying to advance the playlist:\n%v\n", err)
+	}
+}
+
+// ended moves on from the item at index when its media has played to the
+// end. Reports for an item that isn't current any more are ignored.
+func (p *Player) ended(index int) error {
+	p.engine.mu.Lock()
+	defer p.engine.mu.Unlock()
+
+	if index != p.state.snapshot().Current {
+		return nil
+	}
+	return p.step(1, true)
+}
+
+// play starts the item at index.
+func (p *Player) play(index int) error {
+	p.engine.mu.Lock()
+	defer p.engine.mu.Unlock()
+
+	return p.begin(index, true)
+}
+
+// Start plays the item, which must be in the playlist.
+func (p *Player) Start(i Item) {
+	visual := i.String().Visual
+	index := slices.IndexFunc(p.playlist.items(), func(item Item) bool {
+		return item.String().Visual == visual
+	})
+	if index < 0 {
+		log.Printf("error trying to start %s:\nit isn't in the playlist\n", visual)
+		return
+	}
+	if err := p.play(index); err != nil {
+		log.Printf("error trying to start %s:\n%v\n", visual, err)
+	}
+}
+
+// Stop blacks out the screen and cancels the Timeout cue of the current
+// item. Next and Previous carry on from the item that was showing.
+func (p *Player) Stop() error {
+	p.engine.mu.Lock()
+	defer p.engine.mu.Unlock()
+
+	p.blackout()
+	return nil
+}
+
+// blackout blacks out the screen. p.engine.mu must be held.
+func (p *Player) blackout() {
+	p.engine.gen++
+	p.stopTimer()
+	p.state.setBlackout()
+	p.ConnViewer.enqueue(wsMessage{
+		Component: "player",
+		Method:    "stop",
+		Event:     "stop",
+		Success:   true,
+	})
+	p.ConnControl.enqueue(p.snapshotMessage())
+}
+
+// Next goes to the next item in the playlist, or the first after the last.
+func (p *Player) Next() error {
+	p.engine.mu.Lock()
+	defer p.engine.mu.Unlock()
+
+	return p.step(1, false)
+}
+
+// Previous goes to the previous item in the playlist, or the last before
+// the first.
+func (p *Player) Previous() error {
+	p.engine.mu.Lock()
+	defer p.engine.mu.Unlock()
+
+	return p.step(-1, false)
+}
+
+// Listen handles the status events a streamer sends on s, until s is closed.
+// "next" and "ended" mean the current media played to the end.
+func (p *Player) Listen(s chan string) {
+	for status := range s {
+		switch status {
+		case "next", "ended":
+			p.engine.mu.Lock()
+			gen := p.engine.gen
+			p.engine.mu.Unlock()
+			p.advance(gen)
+		default:
+			if p.api.debug.Load() {
+				log.Println("streamer status:", status)
+			}
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package piplayer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// enginePlayer returns a player with a.jpg, b.jpg and c.jpg in its playlist,
+// and the queue of messages sent to the viewer.
+func enginePlayer(t *testing.T, conf Config, presentation string) (*Player, *sendQueue) {
+	for _, name := range []string{"a.jpg", "b.jpg", "c.jpg"} {
+		writeMedia(t, conf.Mount.Dir, name, 1)
+	}
+	if presentation != "" {
+		if err := os.WriteFile(filepath.Join(conf.Mount.Dir, presentationFile), []byte(presentation), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := reloadPlayer(t, conf)
+	if err := p.playlist.fromFolder(p, p.playlist.Name); err != nil {
+		t.Fatal(err)
+	}
+
+	c := p.ConnViewer.(*connWS)
+	c.queue = newSendQueue(100, &c.stats)
+	t.Cleanup(func() {
+		p.engine.mu.Lock()
+		p.stopTimer()
+		p.engine.mu.Unlock()
+	})
+	return p, c.queue
+}
+
+// lastStart returns the index of the last item the viewer was told to start,
+// or -1 if there wasn't one.
+func lastStart(q *sendQueue) int {
+	index := -1
+	for {
+		m, ok := q.pop()
+		if !ok {
+			return index
+		}
+		if m.Method == "start" {
+			index = m.Message.(int)
+		}
+	}
+}
+
+func TestEngineNextPreviousWrap(t *testing.T) {
+	p, q := enginePlayer(t, validConfig(t), "")
+
+	steps := []struct {
+		name string
+		step func() error
+		want int
+	}{
+		{"next from nothing", p.Next, 0},
+		{"previous from the first", p.Previous, 2},
+		{"next from the last", p.Next, 0},
+		{"next", p.Next, 1},
+	}
+	for _, s := range steps {
+		if err := s.step(); err != nil {
+			t.Fatalf("%s: %v", s.name, err)
+		}
+		if got := p.state.snapshot().Current; got != s.want {
+			t.Errorf("%s: got current %d want %d", s.name, got, s.want)
+		}
+		if got := lastStart(q); got != s.want {
+			t.Errorf("%s: viewer was told to start %d want %d", s.name, got, s.want)
+		}
+	}
+	if p.playlist.Current == nil || p.playlist.Current.Name() != "b" {
+		t.Errorf("got playlist current %v want b", p.playlist.Current)
+	}
+
+	if err := p.play(3); err == nil {
+		t.Error("got nil error starting an item out of range")
+	}
+}
+
+func TestEngineKeepsCurrentAcrossReload(t *testing.T) {
+	p, q := enginePlayer(t, validConfig(t), "")
+
+	if err := p.play(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.playlist.setOrder(p, []string{"c.jpg", "a.jpg", "b.jpg"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := p.state.snapshot(); got.Current != 2 || got.Item != "b" {
+		t.Errorf("got current %d %q after reordering, want 2 b", got.Current, got.Item)
+	}
+	if p.playlist.Current == nil || p.playlist.Current.Name() != "b" {
+		t.Errorf("got playlist current %v want b", p.playlist.Current)
+	}
+	lastStart(q)
+	if err := p.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if got := lastStart(q); got != 0 {
+		t.Errorf("viewer was told to start %d after b, want 0", got)
+	}
+
+	if err := os.Remove(filepath.Join(p.playlist.root(), "c.jpg")); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.playlist.fromFolder(p, p.playlist.root()); err != nil {
+		t.Fatal(err)
+	}
+	if got := p.state.snapshot(); got.Current != -1 || p.playlist.Current != nil {
+		t.Errorf("got current %d and %v after removing it, want -1 and nil", got.Current, p.playlist.Current)
+	}
+}
+
+func TestEngineTimeoutCue(t *testing.T) {
+	p, q := enginePlayer(t, validConfig(t), `{"Version": 2, "Items": [{"Visual": "a.jpg", "Cues": {"Timeout": 30}}]}`)
+
+	if err := p.play(0); err != nil {
+		t.Fatal(err)
+	}
+	p.engine.mu.Lock()
+	gen, timer := p.engine.gen, p.engine.timer
+	p.engine.mu.Unlock()
+	if timer == nil {
+		t.Fatal("no timer for the Timeout cue")
+	}
+
+	// A timer from an item that was replaced does nothing.
+	p.advance(gen - 1)
+	if got := p.state.snapshot().Current; got != 0 {
+		t.Errorf("got current %d after a stale timeout want 0", got)
+	}
+
+	p.advance(gen)
+	if got := lastStart(q); got != 1 {
+		t.Errorf("got %d started after the timeout want 1", got)
+	}
+	p.engine.mu.Lock()
+	defer p.engine.mu.Unlock()
+	if p.engine.timer != nil {
+		t.Error("b.jpg has no Timeout cue but a timer is running")
+	}
+}
+
+func TestEngineEnded(t *testing.T) {
+	for _, stopAtEnd := range []bool{false, true} {
+		conf := validConfig(t)
+		conf.Playlist.StopAtEnd = stopAtEnd
+		p, q := enginePlayer(t, conf, "")
+
+		if err := p.play(2); err != nil {
+			t.Fatal(err)
+		}
+		lastStart(q)
+
+		// A report for an item that isn't playing any more is ignored.
+		if err := p.ended(1); err != nil || lastStart(q) != -1 {
+			t.Errorf("stopAtEnd %t: a stale ended report started an item", stopAtEnd)
+		}
+
+		want, next := 0, 1
+		if stopAtEnd {
+			want, next = -1, 0
+		}
+		if err := p.ended(2); err != nil {
+			t.Fatal(err)
+		}
+		if got := lastStart(q); got != want {
+			t.Errorf("stopAtEnd %t: got %d started at the end want %d", stopAtEnd, got, want)
+		}
+
+		// Going to the next item by hand still wraps around.
+		if err := p.Next(); err != nil || p.state.snapshot().Current != next {
+			t.Errorf("stopAtEnd %t: got error %v and current %d want %d", stopAtEnd, err, p.state.snapshot().Current, next)
+		}
+	}
+}
+
+func TestEngineListen(t *testing.T) {
+	p, q := enginePlayer(t, validConfig(t), "")
+	if err := p.play(0); err != nil {
+		t.Fatal(err)
+	}
+
+	status := make(chan string)
+	done := make(chan struct{})
+	go func() {
+		p.Listen(status)
+		close(done)
+	}()
+	status <- "playing"
+	status <- "next"
+	close(status)
+	<-done
+
+	if got := lastStart(q); got != 1 {
+		t.Errorf("got %d started when the streamer finished want 1", got)
+	}
+}
+
+func TestEngineStop(t *testing.T) {
+	p, q := enginePlayer(t, validConfig(t), `{"Version": 2, "Items": [{"Visual": "b.jpg", "Cues": {"Timeout": 30}}]}`)
+	if err := p.play(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := p.state.snapshot(); !s.Blackout || s.Current != 1 {
+		t.Errorf("got %+v want a blackout on item 1", s)
+	}
+	p.engine.mu.Lock()
+	timer := p.engine.timer
+	p.engine.mu.Unlock()
+	if timer != nil {
+		t.Error("the Timeout cue is still running after stopping")
+	}
+
+	var stopped bool
+	for m, ok := q.pop(); ok; m, ok = q.pop() {
+		stopped = m.Method == "stop"
+	}
+	if !stopped {
+		t.Error("the viewer wasn't told to stop")
+	}
+
+	if err := p.Next(); err != nil || p.state.snapshot().Current != 2 {
+		t.Errorf("got error %v and current %d want 2 after the blackout", err, p.state.snapshot().Current)
+	}
+}
@@ -0,0 +1,212 @@
+package piplayer
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/sessions"
+	"github.com/gorilla/websocket"
+)
+
+// Hub manages any number of control page websocket connections,
+// and broadcasts every message sent to it to all of them.
+type Hub struct {
+	mu      sync.Mutex
+	clients map[*hubClient]bool
+	stats   queueStats
+}
+
+// hubClient is a single websocket connection managed by the Hub.
+type hubClient struct {
+	hub   *Hub
+	conn  *websocket.Conn
+	queue *sendQueue
+	// session is the login the connection was opened with, or nil.
+	session *sessions.Session
+}
+
+// NewHub returns a new Hub that's ready to accept connections.
+func NewHub() *Hub {
+	return &Hub{
+		clients: make(map[*hubClient]bool),
+	}
+}
+
+// enqueue queues a message to be sent to every client. It never blocks.
+func (h *Hub) enqueue(msg wsMessage) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.clients) == 0 {
+		h.stats.dropped.Add(1)
+		return false
+	}
+
+	for c := range h.clients {
+		c.queue.push(msg)
+	}
+
+	return true
+}
+
+func (h *Hub) isActive() bool {
+	return h.count() > 0
+}
+
+func (h *Hub) queueStats() QueueStats {
+	return h.stats.snapshot()
+}
+
+// count returns the number of connected clients.
+func (h *Hub) count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.clients)
+}
+
+func (h *Hub) add(c *hubClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.clients[c] = true
+}
+
+// remove removes the client and closes its queue, which tells the write
+// goroutine to close the connection.
+func (h *Hub) remove(c *hubClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.clients, c)
+	c.queue.close()
+}
+
+// takeover disconnects all current clients. Used in single operator mode.
+func (h *Hub) takeover() {
+	msg := wsMessage{
+		Component: "connection",
+		Event:     "disconnect",
+		Success:   true,
+		Message:   "Another device has taken over the connection. Login again to take it back.",
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		c.queue.push(msg)
+		c.queue.close()
+		delete(h.clients, c)
+	}
+}
+
+// HandlerWebsocket handles websocket connections for the control pages.
+func (h *Hub) HandlerWebsocket(p *Player) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := negotiateProtocol(r); err != nil {
+			log.Println("Refusing websocket connection:", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		session, _, err := CheckLogin(w, r)
+		if err != nil {
+			log.Println("error trying to retrieve session for a control websocket:", err)
+		}
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Println("Error trying to upgrade to websocket connection:", err)
+			return
+		}
+
+		// In single operator mode a new connection takes over from the
+		// previous ones, once it's been accepted.
+		if p.config().SingleOperator && h.isActive() {
+			if p.config().Debug {
+				log.Printf("new websocket connection in single operator mode. Closing current connections.")
+			}
+			h.takeover()
+		}
+
+		c := &hubClient{
+			hub:     h,
+			conn:    conn,
+			queue:   newSendQueue(sendQueueSize, &h.stats),
+			session: session,
+		}
+		// The first frame is always the current state, so the control page
+		// knows what's playing.
+		c.queue.push(p.snapshotMessage())
+		h.add(c)
+
+		log.Printf("Websocket connection being handled for %s. %d control clients connected.\n", r.URL.Path, h.count())
+
+		go c.write()
+		go c.read(p)
+	}
+}
+
+// write sends queued messages to the websocket.
+func (c *hubClient) write() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+		c.hub.remove(c)
+	}()
+
+	for {
+		select {
+		case <-c.queue.ready:
+			if err := writeQueue(c.conn, c.queue); err != nil {
+				log.Printf("error trying to write JSON to the control socket: %v\n", err)
+				return
+			}
+			if c.queue.isClosed() {
+				c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// read reads commands from the websocket and dispatches them to the same
+// component handlers as the /api endpoint. The response is only sent back
+// to this client.
+func (c *hubClient) read(p *Player) {
+	defer func() {
+		c.hub.remove(c)
+		c.conn.Close()
+	}()
+
+	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
+	for {
+		var msg wsMessage
+		if err := c.conn.ReadJSON(&msg); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				log.Printf("control websocket unexpectadly closed: %v\n", err)
+			}
+			return
+		}
+
+		if !msg.isRequest() {
+			log.Println("control socket message is not a request, ignoring it: ", msg)
+			continue
+		}
+
+		req := msg.request()
+		c.queue.push(req.reply(p.api.dispatch(p, req, sessionAccess(c.session))))
+	}
+}
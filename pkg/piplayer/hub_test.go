@@ -0,0 +1,84 @@
+package piplayer
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestHubRejectedConnectionKeepsOperator(t *testing.T) {
+	conf := validConfig(t)
+	conf.SingleOperator = true
+	p := &Player{api: &APIHandler{}, state: newPlayerState()}
+	p.conf.Store(&conf)
+
+	h := NewHub()
+	operator := &hubClient{hub: h, queue: newSendQueue(sendQueueSize, &h.stats)}
+	h.add(operator)
+
+	r := httptest.NewRequest(http.MethodGet, "/ws/control", nil)
+	r.Header.Set("Sec-WebSocket-Protocol", "pi-player.v99")
+	w := httptest.NewRecorder()
+	h.HandlerWebsocket(p)(w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got status %d want %d", w.Code, http.StatusBadRequest)
+	}
+	if h.count() != 1 || operator.queue.isClosed() {
+		t.Error("a rejected connection disconnected the operator")
+	}
+}
+
+func TestHubReadsLargeRequests(t *testing.T) {
+	p := orderPlayer(t)
+	h := p.ConnControl
+	srv := httptest.NewServer(h.HandlerWebsocket(p))
+	defer srv.Close()
+
+	// setOrder needs an admin login.
+	header := http.Header{"Cookie": {loggedIn(t, http.MethodGet, "/ws/control", "").Header.Get("Cookie")}}
+	d := websocket.Dialer{Subprotocols: []string{protocolName(protocolVersion)}}
+	conn, _, err := d.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The order of a long playlist is well over a few hundred bytes.
+	order := []string{"2 Welcome.jpg"}
+	for i := 0; i < 500; i++ {
+		order = append(order, fmt.Sprintf("%03d Sunday service slide.jpg", i))
+	}
+	data, err := json.Marshal(order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := wsMessage{ID: "1", Component: "playlist", Method: "setOrder", Arguments: map[string]string{"order": string(data)}}
+	if err := conn.WriteJSON(req); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		var msg wsMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("got error %v waiting for the reply", err)
+		}
+		if msg.ID != req.ID {
+			continue
+		}
+		if !msg.Success {
+			t.Errorf("got %+v want success", msg)
+		}
+		break
+	}
+	if got := itemNames(p); got[0] != "2 Welcome.jpg" {
+		t.Errorf("got %v want 2 Welcome.jpg first", got)
+	}
+}
@@ -2,6 +2,7 @@ package piplayer
 
 import (
 	"io/fs"
+	"path"
 	"path/filepath"
 )
 
@@ -11,8 +12,13 @@ import (
 type Item struct {
 	Audio  fs.DirEntry
 	Visual fs.DirEntry
-	Type   string
-	Cues   map[string]string
+	// Dir is the folder the files are in, relative to the folder the
+	// playlist is read from, for items from a playlist file.
+	Dir  string
+	Type string
+	// Title is the title from a playlist file.
+	Title string
+	Cues  Cues
 }
 
 // ItemString is a simpler representation of an Item,
@@ -21,7 +27,8 @@ type ItemString struct {
 	Audio  string
 	Visual string
 	Type   string
-	Cues   map[string]string
+	Title  string
+	Cues   Cues
 }
 
 // Name returns the filename of the visual element.
@@ -33,13 +40,14 @@ func (i *Item) Name() string {
 func (i *Item) String() ItemString {
 	is := ItemString{}
 	if i.Audio != nil {
-		is.Audio = i.Audio.Name()
+		is.Audio = path.Join(i.Dir, i.Audio.Name())
 	}
 	if i.Visual != nil {
-		is.Visual = i.Visual.Name()
+		is.Visual = path.Join(i.Dir, i.Visual.Name())
 	}
 
 	is.Type = i.Type
+	is.Title = i.Title
 	is.Cues = i.Cues
 	return is
 }
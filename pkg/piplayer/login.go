@@ -3,6 +3,7 @@ package piplayer
 import (
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/sessions"
 	"golang.org/x/crypto/bcrypt"
@@ -14,6 +15,10 @@ type Login struct {
 	Password string
 }
 
+// roleOperator marks sessions granted through pairing. Operators can control
+// playback but can't change settings.
+const roleOperator = "operator"
+
 // TODO: use an random env variable instead of hard coding the secret here.
 var store = sessions.NewCookieStore([]byte("ip-player-session-secret"))
 
@@ -43,9 +48,62 @@ func CheckLogin(w http.ResponseWriter, r *http.Request) (*sessions.Session, bool
 		return nil, false, err
 	}
 
-	_, authenticated := session.Values["authenticated"]
+	return session, authenticated(session), nil
+}
 
-	return session, authenticated, nil
+// authenticated checks if the session is logged in and hasn't expired.
+func authenticated(session *sessions.Session) bool {
+	if session == nil {
+		return false
+	}
+	_, ok := session.Values["authenticated"]
+
+	// Operator sessions are only valid for a limited time.
+	if exp, isSet := session.Values["expires"].(int64); isSet && time.Now().Unix() > exp {
+		ok = false
+	}
+
+	return ok
+}
+
+// isOperator checks if the session was granted through pairing rather than
+// by logging in with the admin credentials.
+func isOperator(session *sessions.Session) bool {
+	return session != nil && session.Values["role"] == roleOperator
+}
+
+// access is what the sender of a request is allowed to do.
+type access int
+
+const (
+	// accessNone is anyone that can reach the player, eg: the viewer.
+	accessNone access = iota
+	// accessOperator is a logged in admin, or an operator that paired.
+	accessOperator
+	// accessAdmin is a logged in admin.
+	accessAdmin
+)
+
+func (a access) String() string {
+	switch a {
+	case accessOperator:
+		return "a login or a paired device"
+	case accessAdmin:
+		return "an admin login"
+	}
+	return "nothing"
+}
+
+// sessionAccess returns what the holder of session is allowed to do. It's
+// checked for each request, as operator sessions expire.
+func sessionAccess(session *sessions.Session) access {
+	switch {
+	case !authenticated(session):
+		return accessNone
+	case isOperator(session):
+		return accessOperator
+	}
+	return accessAdmin
 }
 
 // LoginHandler handles login requests
@@ -71,7 +129,7 @@ func LoginHandler(p *Player) http.HandlerFunc {
 				filename:      "login.html",
 				statTemplates: p.api.statTemplates,
 				data: map[string]interface{}{
-					"location": p.conf.Location,
+					"location": p.config().Location,
 				},
 			}
 			tempControl.ServeHTTP(w, r)
@@ -84,7 +142,7 @@ func LoginHandler(p *Player) http.HandlerFunc {
 
 		// process POST request
 		xForward := r.Header.Get("x-forwarded-for")
-		if p.conf.Debug {
+		if p.config().Debug {
 			log.Println("attempted login request from:", xForward, r.RemoteAddr)
 		}
 		if err := r.ParseForm(); err != nil {
@@ -94,24 +152,28 @@ func LoginHandler(p *Player) http.HandlerFunc {
 		password := r.PostFormValue("password")
 
 		// if there's no login entry in the config file, add the default login details
-		if p.conf.Login.Username == "" {
-			if p.conf.Debug {
+		if p.config().Login.Username == "" {
+			if p.config().Debug {
 				log.Println("no login details found in config file, creating default login details now.")
 			}
-			var err error
-			if p.conf.Login, err = newLogin(); err != nil {
+			login, err := newLogin()
+			if err != nil {
 				log.Println("error trying to save default username and password")
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
-			if err := p.conf.Save(); err != nil {
+			p.configMu.Lock()
+			newFile := *p.config().fileConfig()
+			newFile.Login = login
+			if err := p.saveSettings(newFile, nil); err != nil {
 				log.Println("error trying to save config file:", err)
 			}
+			p.configMu.Unlock()
 		}
 
-		if username == p.conf.Login.Username && checkHash(password, p.conf.Login.Password) {
+		if username == p.config().Login.Username && checkHash(password, p.config().Login.Password) {
 			// user successfully logged in
-			if p.conf.Debug {
+			if p.config().Debug {
 				log.Printf("login successful from %s\n", r.RemoteAddr)
 			}
 
@@ -120,6 +182,9 @@ func LoginHandler(p *Player) http.HandlerFunc {
 			}
 
 			session.Values["authenticated"] = r.RemoteAddr
+			// Clear anything left over from an expired operator session.
+			delete(session.Values, "role")
+			delete(session.Values, "expires")
 			session.Save(r, w)
 			http.Redirect(w, r, "/control", http.StatusFound)
 			return
@@ -129,7 +194,7 @@ func LoginHandler(p *Player) http.HandlerFunc {
 			statTemplates: p.api.statTemplates,
 			filename:      "login.html",
 			data: map[string]interface{}{
-				"location":     p.conf.Location,
+				"location":     p.config().Location,
 				"flashMessage": "Incorrect username or password",
 			},
 		}
@@ -0,0 +1,367 @@
+package piplayer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/17xande/configdir"
+)
+
+// defaultPrefetch is how many items after the current one are copied into
+// the media cache if Cache.Prefetch isn't set.
+const defaultPrefetch = 2
+
+// cacheIndexFile is where the media cache remembers what it holds.
+const cacheIndexFile = "index.json"
+
+// cacheOptions configures the local media cache, for mounts on network
+// shares that are too slow to play from.
+type cacheOptions struct {
+	// SizeMB is the most the cache holds, in megabytes. 0 turns it off.
+	SizeMB int `json:",omitempty"`
+	// Dir is where the cached files are kept. Empty uses ~/.cache/pi-player/media.
+	Dir string `json:",omitempty"`
+	// Prefetch is how many items after the current one are copied into the
+	// cache. 0 uses defaultPrefetch.
+	Prefetch int `json:",omitempty"`
+}
+
+func (o cacheOptions) dir() string {
+	if o.Dir != "" {
+		return o.Dir
+	}
+	return filepath.Join(configdir.LocalCache("pi-player"), "media")
+}
+
+func (o cacheOptions) prefetch() int {
+	if o.Prefetch <= 0 {
+		return defaultPrefetch
+	}
+	return o.Prefetch
+}
+
+// mediaCache keeps copies of media files in a local folder, up to a size
+// budget. The least recently played files are removed to make space.
+type mediaCache struct {
+	dir    string
+	budget int64
+
+	mu sync.Mutex
+	// entries are the cached files by the path of the file they're a copy of.
+	entries map[string]*cacheEntry
+	size    int64
+	copying map[string]bool
+	// copies lets one file be copied at a time, so that prefetching doesn't
+	// compete with playback for the share more than it has to.
+	copies chan struct{}
+}
+
+// cacheEntry is a cached copy of a media file.
+type cacheEntry struct {
+	File string
+	Size int64
+	// ModTime is the modification time of the original when it was copied.
+	ModTime  time.Time
+	LastUsed time.Time
+}
+
+// cacheFileName matches the names of cached copies and unfinished copies, so
+// that only files the cache made are ever removed from its folder.
+var cacheFileName = regexp.MustCompile(`^[0-9a-f]{16}(\.[^.]+)?(\.[0-9]+\.part)?$`)
+
+// cacheName returns the name of the cached copy of src.
+func cacheName(src string) string {
+	sum := sha256.Sum256([]byte(src))
+	return hex.EncodeToString(sum[:8]) + strings.ToLower(filepath.Ext(src))
+}
+
+// newMediaCache opens the cache in dir, dropping files it doesn't know
+// about or that don't fit in budget bytes anymore.
+func newMediaCache(dir string, budget int64) (*mediaCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	c := &mediaCache{
+		dir:     dir,
+		budget:  budget,
+		entries: map[string]*cacheEntry{},
+		copying: map[string]bool{},
+		copies:  make(chan struct{}, 1),
+	}
+
+	if data, err := os.ReadFile(filepath.Join(dir, cacheIndexFile)); err == nil {
+		if err := json.Unmarshal(data, &c.entries); err != nil {
+			log.Printf("media cache index in %s is damaged, starting empty: %v\n", dir, err)
+			c.entries = map[string]*cacheEntry{}
+		}
+	}
+
+	known := map[string]bool{cacheIndexFile: true}
+	for src, e := range c.entries {
+		info, err := os.Stat(filepath.Join(dir, e.File))
+		if err != nil || info.Size() != e.Size {
+			delete(c.entries, src)
+			continue
+		}
+		known[e.File] = true
+		c.size += e.Size
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if !known[f.Name()] && cacheFileName.MatchString(f.Name()) {
+			os.Remove(filepath.Join(dir, f.Name()))
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.evict("")
+	return c, c.save()
+}
+
+// lookup returns the cached copy of src. A copy of a file that changed since
+// it was copied is dropped. If src can't be read, eg: the share is down, the
+// copy is still used. Looking a file up doesn't mark it as used, see touch.
+func (c *mediaCache) lookup(src string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[src]
+	if !ok {
+		return "", false
+	}
+	if info, err := os.Stat(src); err == nil && (info.Size() != e.Size || !info.ModTime().Equal(e.ModTime)) {
+		c.remove(src)
+		c.save()
+		return "", false
+	}
+
+	return filepath.Join(c.dir, e.File), true
+}
+
+// touch marks the cached copy of src as used, when it's played, so it's among
+// the last to be removed to make space.
+func (c *mediaCache) touch(src string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[src]; ok {
+		e.LastUsed = time.Now()
+	}
+}
+
+// fetch copies src into the cache in the background, unless it's already
+// cached or being copied.
+func (c *mediaCache) fetch(src string) {
+	if _, ok := c.lookup(src); ok {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.copying[src] {
+		return
+	}
+	c.copying[src] = true
+
+	go func() {
+		if err := c.copy(src); err != nil {
+			log.Printf("error trying to cache %s:\n%v\n", src, err)
+		}
+		c.mu.Lock()
+		delete(c.copying, src)
+		c.mu.Unlock()
+	}()
+}
+
+// copy copies src into the cache, and removes the least recently used files
+// if the cache is over budget. Files bigger than the budget aren't cached.
+func (c *mediaCache) copy(src string) error {
+	c.copies <- struct{}{}
+	defer func() { <-c.copies }()
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() > c.budget {
+		return nil
+	}
+
+	name := cacheName(src)
+	tmp, err := os.CreateTemp(c.dir, name+".*.part")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, in)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := os.Rename(tmp.Name(), filepath.Join(c.dir, name)); err != nil {
+		return err
+	}
+	if old, ok := c.entries[src]; ok {
+		c.size -= old.Size
+	}
+	c.entries[src] = &cacheEntry{File: name, Size: info.Size(), ModTime: info.ModTime(), LastUsed: time.Now()}
+	c.size += info.Size()
+	c.evict(src)
+
+	return c.save()
+}
+
+// evict removes the least recently used files, except keep, until the cache
+// is within its budget. c.mu must be held.
+func (c *mediaCache) evict(keep string) {
+	for c.size > c.budget {
+		oldest := ""
+		for src, e := range c.entries {
+			if src != keep && (oldest == "" || e.LastUsed.Before(c.entries[oldest].LastUsed)) {
+				oldest = src
+			}
+		}
+		if oldest == "" {
+			return
+		}
+		c.remove(oldest)
+	}
+}
+
+// remove deletes the cached copy of src. c.mu must be held.
+func (c *mediaCache) remove(src string) {
+	e := c.entries[src]
+	if err := os.Remove(filepath.Join(c.dir, e.File)); err != nil && !os.IsNotExist(err) {
+		log.Printf("error trying to remove %s from the media cache: %v\n", e.File, err)
+	}
+	c.size -= e.Size
+	delete(c.entries, src)
+}
+
+// save writes the index of the cache. c.mu must be held.
+func (c *mediaCache) save() error {
+	data, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(c.dir, cacheIndexFile), data, 0644)
+}
+
+// setupCache opens the media cache set in the config, or turns it off.
+func (p *Player) setupCache() {
+	opts := p.config().Cache
+	if opts.SizeMB <= 0 {
+		p.cache.Store(nil)
+		return
+	}
+
+	c, err := newMediaCache(opts.dir(), int64(opts.SizeMB)<<20)
+	if err != nil {
+		log.Printf("error trying to open the media cache, playing from the media folder:\n%v\n", err)
+		p.cache.Store(nil)
+		return
+	}
+	p.cache.Store(c)
+}
+
+// cacheItems marks the item at index as played, and copies it and the items
+// after it into the media cache. Prefetching the items after it doesn't mark
+// them as played.
+func (p *Player) cacheItems(index int) {
+	c := p.cache.Load()
+	if c == nil {
+		return
+	}
+	items := p.playlist.items()
+	if len(items) == 0 {
+		return
+	}
+
+	dir := p.contentDir()
+	n := min(p.config().Cache.prefetch(), len(items)-1)
+	for i := 0; i <= n; i++ {
+		item := items[(index+i)%len(items)]
+		for _, f := range []fs.DirEntry{item.Visual, item.Audio} {
+			if f == nil {
+				continue
+			}
+			src := filepath.Join(dir, filepath.FromSlash(item.Dir), f.Name())
+			if i == 0 {
+				c.touch(src)
+			}
+			c.fetch(src)
+		}
+	}
+}
+
+// contentHandler serves the media files, from the media cache if it has a
+// copy. A file that isn't cached yet is served from the media folder and
+// copied into the cache.
+func contentHandler(p *Player) http.HandlerFunc {
+	serveFolder := etagWrapper(p.contentDir)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := p.cache.Load()
+		if c == nil {
+			serveFolder(w, r)
+			return
+		}
+
+		name := path.Clean("/" + strings.TrimPrefix(r.URL.Path, "/content/"))
+		src := filepath.Join(p.contentDir(), filepath.FromSlash(name))
+		if cached, ok := c.lookup(src); ok {
+			if playsFromStart(r) {
+				c.touch(src)
+			}
+			w.Header().Set("X-Cache", "hit")
+			http.ServeFile(w, r, cached)
+			return
+		}
+
+		w.Header().Set("X-Cache", "miss")
+		if itemType(src) != "" || strings.EqualFold(filepath.Ext(src), ".mp3") {
+			c.fetch(src)
+		}
+		serveFolder(w, r)
+	}
+}
+
+// playsFromStart reports whether r gets a file from its start, rather than
+// probing or seeking to part of it with a Range header.
+func playsFromStart(r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		return false
+	}
+	rng := r.Header.Get("Range")
+	return rng == "" || strings.HasPrefix(rng, "bytes=0-")
+}
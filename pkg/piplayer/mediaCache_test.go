@@ -0,0 +1,157 @@
+package piplayer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeMedia(t *testing.T, dir, name string, size int) string {
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(strings.Repeat("x", size)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestMediaCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	media := t.TempDir()
+	c, err := newMediaCache(t.TempDir(), 25)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := writeMedia(t, media, "a.mp4", 10)
+	b := writeMedia(t, media, "b.mp4", 10)
+	big := writeMedia(t, media, "big.mp4", 30)
+	for _, src := range []string{a, b, big} {
+		if err := c.copy(src); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := c.lookup(big); ok {
+		t.Error("cached a file bigger than the budget")
+	}
+
+	// Playing a makes b the least recently used. Prefetching b again or
+	// looking it up doesn't count as playing it.
+	time.Sleep(time.Millisecond)
+	c.touch(a)
+	c.fetch(b)
+	if _, ok := c.lookup(b); !ok {
+		t.Fatal("b isn't cached")
+	}
+	d := writeMedia(t, media, "d.mp4", 10)
+	if err := c.copy(d); err != nil {
+		t.Fatal(err)
+	}
+
+	for src, want := range map[string]bool{a: true, b: false, d: true} {
+		if _, ok := c.lookup(src); ok != want {
+			t.Errorf("got %s cached %t want %t", filepath.Base(src), ok, want)
+		}
+	}
+	if c.size != 20 {
+		t.Errorf("got size %d want 20", c.size)
+	}
+}
+
+func TestMediaCacheDropsChangedFiles(t *testing.T) {
+	media := t.TempDir()
+	c, err := newMediaCache(t.TempDir(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := writeMedia(t, media, "a.mp4", 10)
+	if err := c.copy(src); err != nil {
+		t.Fatal(err)
+	}
+	writeMedia(t, media, "a.mp4", 12)
+
+	if _, ok := c.lookup(src); ok {
+		t.Error("got the old copy of a changed file")
+	}
+}
+
+func TestMediaCacheReopens(t *testing.T) {
+	media := t.TempDir()
+	dir := t.TempDir()
+	c, err := newMediaCache(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := writeMedia(t, media, "a.mp4", 10)
+	if err := c.copy(src); err != nil {
+		t.Fatal(err)
+	}
+
+	// A copy that was interrupted, and a file the cache didn't make.
+	writeMedia(t, dir, cacheName(src)+".123.part", 3)
+	writeMedia(t, dir, "notes.txt", 3)
+
+	c, err = newMediaCache(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.lookup(src); !ok {
+		t.Error("lost a.mp4 after reopening")
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	want := []string{cacheName(src), cacheIndexFile, "notes.txt"}
+	if strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Errorf("got files %v want %v", names, want)
+	}
+}
+
+func TestContentHandlerReadsThrough(t *testing.T) {
+	conf := validConfig(t)
+	conf.Cache = cacheOptions{SizeMB: 1, Dir: t.TempDir()}
+	p := reloadPlayer(t, conf)
+	p.setupCache()
+	writeMedia(t, conf.Mount.Dir, "intro.mp4", 10)
+	h := contentHandler(p)
+
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, "/content/intro.mp4", nil))
+	if w.Code != http.StatusOK || w.Header().Get("X-Cache") != "miss" {
+		t.Fatalf("got status %d, X-Cache %q, want a miss", w.Code, w.Header().Get("X-Cache"))
+	}
+
+	// The miss is copied into the cache in the background.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, ok := p.cache.Load().lookup(filepath.Join(conf.Mount.Dir, "intro.mp4")); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("intro.mp4 wasn't cached")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, "/content/intro.mp4", nil))
+	if w.Header().Get("X-Cache") != "hit" || w.Body.Len() != 10 {
+		t.Errorf("got X-Cache %q with %d bytes, want a hit with 10", w.Header().Get("X-Cache"), w.Body.Len())
+	}
+
+	// Paths can't escape the media folder.
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, "/content/../../etc/passwd", nil))
+	if w.Code == http.StatusOK {
+		t.Errorf("got status %d for a path outside the media folder", w.Code)
+	}
+}
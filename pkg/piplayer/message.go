@@ -2,6 +2,7 @@ package piplayer
 
 // reqMessage defines structure of request messages for json api
 type reqMessage struct {
+	ID        string            `json:"id,omitempty"`
 	Component string            `json:"component"`
 	Method    string            `json:"method"`
 	Arguments map[string]string `json:"arguments"`
@@ -9,6 +10,7 @@ type reqMessage struct {
 
 // resMessage defines structure for reponse messages for json api
 type resMessage struct {
+	ID      string      `json:"id,omitempty"`
 	Success bool        `json:"success"`
 	Event   string      `json:"event"`
 	Message interface{} `json:"message"`
@@ -16,6 +18,7 @@ type resMessage struct {
 
 // message defines the structure for a request and response messages for the websocket
 type wsMessage struct {
+	ID        string            `json:"id,omitempty"`
 	Component string            `json:"component"`
 	Method    string            `json:"method"`
 	Arguments map[string]string `json:"arguments"`
@@ -23,3 +26,46 @@ type wsMessage struct {
 	Event     string            `json:"event"`
 	Message   interface{}       `json:"message"`
 }
+
+// isRequest reports whether a message received on a websocket is a command
+// to be dispatched, rather than a reply or an event.
+func (m wsMessage) isRequest() bool {
+	return m.Method != "" && m.Event == ""
+}
+
+// request converts a websocket message to an api request.
+func (m wsMessage) request() reqMessage {
+	return reqMessage{
+		ID:        m.ID,
+		Component: m.Component,
+		Method:    m.Method,
+		Arguments: m.Arguments,
+	}
+}
+
+// reply builds the websocket message that answers the request.
+func (r reqMessage) reply(res resMessage) wsMessage {
+	return wsMessage{
+		ID:        r.ID,
+		Component: r.Component,
+		Method:    r.Method,
+		Success:   res.Success,
+		Event:     res.Event,
+		Message:   res.Message,
+	}
+}
+
+// coalesceKey returns a key for messages where only the latest one matters.
+// A queued message is replaced by a newer one with the same key.
+func (m wsMessage) coalesceKey() string {
+	if m.ID != "" {
+		return ""
+	}
+
+	switch m.Event {
+	case "newItems", "setCurrent", "snapshot", "folders", "mode":
+		return m.Component + "/" + m.Event
+	}
+
+	return ""
+}
@@ -1,9 +1,14 @@
 package piplayer
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"net/url"
 	"os"
+	"path/filepath"
+
+	"github.com/17xande/configdir"
 )
 
 // sURL is copy of url.URL but with its own JSON marshalling and unmarshalling methods.
@@ -19,7 +24,7 @@ type mount struct {
 
 func (u sURL) MarshalJSON() ([]byte, error) {
 	if u.URL == nil {
-		return make([]byte, 0), nil
+		return []byte("null"), nil
 	}
 	un, err := url.PathUnescape(u.URL.String())
 	if err != nil {
@@ -43,10 +48,40 @@ func (u *sURL) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
-// func (m *mount) loadDir() {
-//
-// 	m.Dir = m.URL.Path
-// }
+// newMount returns a mount for u, with Dir set to the folder the playlist
+// reads from.
+func newMount(u *url.URL) mount {
+	m := mount{URL: sURL{URL: u}}
+	m.Dir = m.localDir()
+	return m
+}
+
+// localDir returns the folder the playlist reads the media files from. That's
+// the folder itself for a local mount, and a cache folder that the content
+// source syncs into for a remote one.
+func (m *mount) localDir() string {
+	if m.URL.URL == nil {
+		return ""
+	}
+	if !m.remote() {
+		return m.URL.Path
+	}
+
+	sum := sha256.Sum256([]byte(m.URL.String()))
+	return filepath.Join(contentCacheDir(), hex.EncodeToString(sum[:8]))
+}
+
+// remote reports whether the media files come from somewhere other than a
+// local folder.
+func (m *mount) remote() bool {
+	return m.URL.URL != nil && m.URL.Scheme != "" && m.URL.Scheme != "file"
+}
+
+// contentCacheDir is where remote content sources are synced to.
+// It's a variable so that tests can change it.
+var contentCacheDir = func() string {
+	return filepath.Join(configdir.LocalCache("pi-player"), "content")
+}
 
 // exists checks if a directory exists.
 func exists(path string) bool {
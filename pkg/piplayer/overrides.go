@@ -0,0 +1,320 @@
+package piplayer
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// envPrefix is the prefix of the environment variables that override config fields.
+const envPrefix = "PIPLAYER_"
+
+// overrideSpec describes a config field that can be overridden by a
+// command-line flag or an environment variable.
+type overrideSpec struct {
+	name   string
+	field  string
+	usage  string
+	isBool bool
+	// apply sets the field, or is nil for an override that isn't applied by
+	// Overrides.apply.
+	apply func(conf *Config, value string) error
+}
+
+// env returns the name of the environment variable for the override,
+// eg: audio-output becomes PIPLAYER_AUDIO_OUTPUT.
+func (s overrideSpec) env() string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(s.name, "-", "_"))
+}
+
+// configOverrides lists every config field that can be overridden.
+// Precedence is flag > environment variable > config file > default.
+var configOverrides = []overrideSpec{
+	// The profile is only picked on start, see startProfile, so that switching
+	// profiles while running isn't undone. It's applied before the other
+	// overrides, so they take precedence over it.
+	{
+		name:  "profile",
+		field: "ActiveProfile",
+		usage: "name of the profile to switch to on start.",
+	},
+	{
+		name:  "location",
+		field: "Location",
+		usage: "name of this player, shown on the control page.",
+		apply: func(conf *Config, v string) error {
+			conf.Location = v
+			return nil
+		},
+	},
+	{
+		name:  "mount",
+		field: "Mount.URL",
+		usage: "folder, http(s) manifest URL or s3://bucket/prefix with the media files.",
+		apply: func(conf *Config, v string) error {
+			u, err := url.Parse(v)
+			if err != nil {
+				return err
+			}
+			conf.Mount = newMount(u)
+			return nil
+		},
+	},
+	{
+		name:  "audio-output",
+		field: "AudioOutput",
+		usage: "audio output: hdmi, local or both.",
+		apply: func(conf *Config, v string) error {
+			conf.AudioOutput = v
+			return nil
+		},
+	},
+	{
+		name:  "streamer",
+		field: "Streamer",
+		usage: "program used to play media: chrome or omx.",
+		apply: func(conf *Config, v string) error {
+			conf.Streamer = v
+			return nil
+		},
+	},
+	{
+		name:   "debug",
+		field:  "Debug",
+		usage:  "print extra information for debugging.",
+		isBool: true,
+		apply: func(conf *Config, v string) (err error) {
+			conf.Debug, err = strconv.ParseBool(v)
+			return err
+		},
+	},
+	{
+		name:  "remote-names",
+		field: "Remote.Names",
+		usage: "comma separated names of the input devices to listen to.",
+		apply: func(conf *Config, v string) error {
+			conf.Remote.Names = strings.Split(v, ",")
+			for i, n := range conf.Remote.Names {
+				conf.Remote.Names[i] = strings.TrimSpace(n)
+			}
+			return nil
+		},
+	},
+	{
+		name:  "addr",
+		field: "Addr",
+		usage: "the addr the server listens on.",
+		apply: func(conf *Config, v string) error {
+			conf.Addr = v
+			return nil
+		},
+	},
+	{
+		name:  "sync-minutes",
+		field: "SyncMinutes",
+		usage: "how often a remote mount is synced, in minutes.",
+		apply: func(conf *Config, v string) (err error) {
+			conf.SyncMinutes, err = strconv.Atoi(v)
+			return err
+		},
+	},
+	{
+		name:   "single-operator",
+		field:  "SingleOperator",
+		usage:  "only allow one control page to be connected at a time.",
+		isBool: true,
+		apply: func(conf *Config, v string) (err error) {
+			conf.SingleOperator, err = strconv.ParseBool(v)
+			return err
+		},
+	},
+}
+
+// overrideValue is a flag.Value that remembers if it was set.
+type overrideValue struct {
+	value  string
+	set    bool
+	isBool bool
+}
+
+func (v *overrideValue) String() string {
+	if v == nil {
+		return ""
+	}
+	return v.value
+}
+
+func (v *overrideValue) Set(s string) error {
+	v.value = s
+	v.set = true
+	return nil
+}
+
+func (v *overrideValue) IsBoolFlag() bool {
+	return v.isBool
+}
+
+// Overrides holds the config values set by command-line flags and
+// environment variables.
+type Overrides struct {
+	flags  map[string]*overrideValue
+	getenv func(string) (string, bool)
+}
+
+// NewOverrides registers a flag for every config override on fs.
+// Call it before fs.Parse.
+func NewOverrides(fs *flag.FlagSet) *Overrides {
+	o := &Overrides{
+		flags:  make(map[string]*overrideValue),
+		getenv: os.LookupEnv,
+	}
+
+	for _, spec := range configOverrides {
+		v := &overrideValue{isBool: spec.isBool}
+		fs.Var(v, spec.name, fmt.Sprintf("%s Overrides %s in config.json. Env: %s", spec.usage, spec.field, spec.env()))
+		o.flags[spec.name] = v
+	}
+
+	return o
+}
+
+// lookup returns the value of an override and where it came from.
+func (o *Overrides) lookup(spec overrideSpec) (value, source string, ok bool) {
+	if o == nil {
+		return "", "", false
+	}
+
+	if v, found := o.flags[spec.name]; found && v.set {
+		return v.value, "flag -" + spec.name, true
+	}
+
+	if o.getenv != nil {
+		if v, found := o.getenv(spec.env()); found {
+			return v, "env " + spec.env(), true
+		}
+	}
+
+	return "", "", false
+}
+
+// apply sets every overridden field on the config.
+func (o *Overrides) apply(conf *Config) error {
+	errs := &ConfigError{}
+
+	for _, spec := range configOverrides {
+		value, source, ok := o.lookup(spec)
+		if !ok || spec.apply == nil {
+			continue
+		}
+		if err := spec.apply(conf, value); err != nil {
+			errs.add(spec.field, "invalid value %q from %s: %v", value, source, err)
+		}
+	}
+
+	if len(errs.Problems) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// startProfile returns the profile to start with: the one from the profile
+// override, or else the active profile in conf.
+func (o *Overrides) startProfile(conf *Config) string {
+	for _, spec := range configOverrides {
+		if spec.name != "profile" {
+			continue
+		}
+		if value, _, ok := o.lookup(spec); ok {
+			return value
+		}
+	}
+	return conf.ActiveProfile
+}
+
+// redacted is used in place of secrets when printing the config.
+const redacted = "REDACTED"
+
+// redacted returns a copy of the config with secrets redacted: the login
+// password and the credentials in the mount URLs.
+func (conf *Config) redacted() Config {
+	c := *conf
+	if c.Login.Password != "" {
+		c.Login.Password = redacted
+	}
+	c.Mount.URL = sURL{URL: redactURL(c.Mount.URL.URL)}
+
+	c.Profiles = slices.Clone(conf.Profiles)
+	for i, prof := range c.Profiles {
+		if prof.Mount != nil {
+			m := *prof.Mount
+			m.URL = sURL{URL: redactURL(m.URL.URL)}
+			c.Profiles[i].Mount = &m
+		}
+	}
+	return c
+}
+
+// unredact puts back the secrets that were redacted in conf, taking them
+// from old. A mount URL only gets its credentials back if it's still for the
+// same host.
+func (conf *Config) unredact(old *Config) {
+	if conf.Login.Password == redacted {
+		conf.Login.Password = old.Login.Password
+	}
+	conf.Mount.URL.URL = unredactURL(conf.Mount.URL.URL, old.Mount.URL.URL)
+
+	for i, prof := range conf.Profiles {
+		oldProf, ok := old.findProfile(prof.Name)
+		if prof.Mount == nil || !ok || oldProf.Mount == nil {
+			continue
+		}
+		m := *prof.Mount
+		m.URL.URL = unredactURL(m.URL.URL, oldProf.Mount.URL.URL)
+		conf.Profiles[i].Mount = &m
+	}
+}
+
+// redactURL returns a copy of u with its password redacted. A user name
+// without a password is redacted too, as it's often a token.
+func redactURL(u *url.URL) *url.URL {
+	if u == nil || u.User == nil {
+		return u
+	}
+
+	c := *u
+	if _, ok := u.User.Password(); ok {
+		c.User = url.UserPassword(u.User.Username(), redacted)
+	} else {
+		c.User = url.User(redacted)
+	}
+	return &c
+}
+
+// unredactURL returns u with the credentials of old, if redactURL redacted
+// them and old is for the same host.
+func unredactURL(u, old *url.URL) *url.URL {
+	if u == nil || u.User == nil || old == nil || u.Scheme != old.Scheme || u.Host != old.Host {
+		return u
+	}
+
+	password, _ := u.User.Password()
+	if password != redacted && u.User.Username() != redacted {
+		return u
+	}
+	c := *u
+	c.User = old.User
+	return &c
+}
+
+// Print writes the config as JSON, with secrets redacted.
+func (conf *Config) Print(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(conf.redacted())
+}
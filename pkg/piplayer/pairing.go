@@ -0,0 +1,289 @@
+package piplayer
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/sessions"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+const (
+	pairingPINLength   = 6
+	pairingPINLifetime = 2 * time.Minute
+	pairingMaxAttempts = 5
+	pairingQRSize      = 512
+	operatorSessionAge = 4 * time.Hour
+)
+
+// pairing holds the state of the on-screen pairing mode.
+// While pairing is active the viewer shows a QR code with the control URL
+// and a short lived, one-time PIN that grants an operator session.
+type pairing struct {
+	mu       sync.Mutex
+	pin      string
+	expires  time.Time
+	attempts int
+	timer    *time.Timer
+}
+
+// pairingInfo is sent to the viewer so it can display the pairing screen.
+type pairingInfo struct {
+	URL     string `json:"url"`
+	PIN     string `json:"pin"`
+	Expires int64  `json:"expires"`
+}
+
+// begin generates a new PIN and tells the viewer to show the pairing screen.
+// Any previous PIN is invalidated.
+func (pr *pairing) begin(plr *Player) (pairingInfo, error) {
+	pin, err := newPIN(pairingPINLength)
+	if err != nil {
+		return pairingInfo{}, err
+	}
+
+	pr.mu.Lock()
+	pr.pin = pin
+	pr.expires = time.Now().Add(pairingPINLifetime)
+	pr.attempts = 0
+	if pr.timer != nil {
+		pr.timer.Stop()
+	}
+	pr.timer = time.AfterFunc(pairingPINLifetime, func() { pr.end(plr) })
+	info := pairingInfo{
+		URL:     pairingURL(plr.Server),
+		PIN:     pin,
+		Expires: pr.expires.Unix(),
+	}
+	pr.mu.Unlock()
+
+	if plr.config().Debug {
+		log.Printf("pairing mode started, PIN valid until %s\n", pr.expires.Format(time.Kitchen))
+	}
+
+	plr.ConnViewer.enqueue(wsMessage{
+		Component: "pairing",
+		Event:     "show",
+		Success:   true,
+		Message:   info,
+	})
+
+	return info, nil
+}
+
+// end invalidates the current PIN and tells the viewer to hide the pairing screen.
+func (pr *pairing) end(plr *Player) {
+	pr.mu.Lock()
+	wasActive := pr.pin != ""
+	pr.pin = ""
+	if pr.timer != nil {
+		pr.timer.Stop()
+		pr.timer = nil
+	}
+	pr.mu.Unlock()
+
+	if !wasActive {
+		return
+	}
+
+	plr.ConnViewer.enqueue(wsMessage{
+		Component: "pairing",
+		Event:     "hide",
+		Success:   true,
+	})
+}
+
+// active reports whether there is a PIN that can still be redeemed.
+func (pr *pairing) active() bool {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	return pr.pin != "" && time.Now().Before(pr.expires)
+}
+
+// redeem checks the supplied PIN. A PIN can only be redeemed once, and is
+// invalidated after too many failed attempts.
+func (pr *pairing) redeem(pin string) bool {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	if pr.pin == "" || time.Now().After(pr.expires) {
+		return false
+	}
+
+	if subtle.ConstantTimeCompare([]byte(pin), []byte(pr.pin)) == 1 {
+		pr.pin = ""
+		return true
+	}
+
+	pr.attempts++
+	if pr.attempts >= pairingMaxAttempts {
+		log.Println("too many failed pairing attempts, invalidating PIN")
+		pr.pin = ""
+	}
+
+	return false
+}
+
+// toggle shows the pairing screen, or hides it if it's showing. It's used by
+// the Home key on the remote.
+func (pr *pairing) toggle(plr *Player) error {
+	if pr.active() {
+		pr.end(plr)
+		return nil
+	}
+	_, err := pr.begin(plr)
+	return err
+}
+
+// handleAPI handles requests to the pairing api.
+func (pr *pairing) handleAPI(plr *Player, req reqMessage) resMessage {
+	switch req.Method {
+	case "start":
+		info, err := pr.begin(plr)
+		if err != nil {
+			log.Printf("error trying to start pairing mode: %v\n", err)
+			return resMessage{Success: false, Event: "pairingFailed", Message: err.Error()}
+		}
+		// Don't leak the PIN over the API, it should only be read off the screen.
+		return resMessage{Success: true, Event: "pairingStarted", Message: info.Expires}
+	case "stop":
+		pr.end(plr)
+		return resMessage{Success: true, Event: "pairingStopped"}
+	}
+
+	log.Printf("API call unsupported. Ignoring:\n%v\n", req)
+	return resMessage{Success: false, Event: "methodNotSupported", Message: "Method not supported: " + req.Method}
+}
+
+// PairHandler handles requests from devices that scanned the pairing QR code.
+// A correct PIN grants a time limited operator session.
+func PairHandler(p *Player) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, loggedIn, err := CheckLogin(w, r)
+		if err != nil {
+			log.Println("error trying to retrieve session on pairing page:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if loggedIn {
+			http.Redirect(w, r, "/control", http.StatusFound)
+			return
+		}
+
+		tempPair := TemplateHandler{
+			filename:      "pair.html",
+			statTemplates: p.api.statTemplates,
+			data: map[string]interface{}{
+				"location": p.config().Location,
+			},
+		}
+
+		if r.Method == "GET" {
+			tempPair.ServeHTTP(w, r)
+			return
+		} else if r.Method != "POST" {
+			log.Println("Unsuported request type for Pairing page:", r.Method)
+			return
+		}
+
+		if err := r.ParseForm(); err != nil {
+			log.Println("Error trying to parse form in pairing page.\n", err)
+		}
+
+		if !p.pairing.redeem(r.PostFormValue("pin")) {
+			if p.config().Debug {
+				log.Printf("failed pairing attempt from %s\n", r.RemoteAddr)
+			}
+			tempPair.data["flashMessage"] = "Incorrect or expired PIN"
+			tempPair.ServeHTTP(w, r)
+			return
+		}
+
+		if p.config().Debug {
+			log.Printf("pairing successful from %s\n", r.RemoteAddr)
+		}
+
+		// The PIN is single use, so take the pairing screen down.
+		p.pairing.end(p)
+
+		store.Options = &sessions.Options{
+			Secure: false,
+		}
+		session.Options.MaxAge = int(operatorSessionAge.Seconds())
+		session.Values["authenticated"] = r.RemoteAddr
+		session.Values["role"] = roleOperator
+		session.Values["expires"] = time.Now().Add(operatorSessionAge).Unix()
+		session.Save(r, w)
+		http.Redirect(w, r, "/control", http.StatusFound)
+	}
+}
+
+// PairQRHandler serves the pairing QR code as a PNG while pairing is active.
+func PairQRHandler(p *Player) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !p.pairing.active() {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+
+		png, err := qrcode.Encode(pairingURL(p.Server), qrcode.Medium, pairingQRSize)
+		if err != nil {
+			log.Printf("error trying to generate pairing QR code: %v\n", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(png)
+	}
+}
+
+// newPIN returns a random numeric PIN of length n.
+func newPIN(n int) (string, error) {
+	max := big.NewInt(1)
+	for range n {
+		max.Mul(max, big.NewInt(10))
+	}
+
+	v, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", fmt.Errorf("error generating pairing PIN: %w", err)
+	}
+
+	return fmt.Sprintf("%0*d", n, v), nil
+}
+
+// pairingURL returns the URL other devices on the network can use to reach
+// the pairing page. The viewer itself runs on localhost, so the first
+// non-loopback IPv4 address is used.
+func pairingURL(srv *http.Server) string {
+	port := "8080"
+	if srv != nil {
+		if _, p, err := net.SplitHostPort(srv.Addr); err == nil && p != "" {
+			port = p
+		}
+	}
+
+	host := "localhost"
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			if !ok || ipnet.IP.IsLoopback() || ipnet.IP.To4() == nil {
+				continue
+			}
+			host = ipnet.IP.String()
+			break
+		}
+	}
+
+	return fmt.Sprintf("http://%s/pair", net.JoinHostPort(host, port))
+}
@@ -0,0 +1,111 @@
+package piplayer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// ErrNotConnected is returned when a request is made to a browser that
+	// doesn't have a websocket connection open.
+	ErrNotConnected = errors.New("browser not connected")
+	// ErrDisconnected is returned when the browser disconnects while a
+	// request is waiting for a reply.
+	ErrDisconnected = errors.New("browser disconnected before replying")
+)
+
+// RequestError is returned when a request sent to a browser fails.
+type RequestError struct {
+	ID     string
+	Method string
+	Err    error
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("request %s (%s) failed: %v", e.ID, e.Method, e.Err)
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// pendingRequests keeps track of requests sent over a websocket that are
+// waiting for a reply, matched up by the message ID.
+type pendingRequests struct {
+	mu      sync.Mutex
+	waiting map[string]chan wsMessage
+	count   atomic.Uint64
+}
+
+// add registers a new request and returns its ID and the channel its reply
+// will be delivered on.
+func (pr *pendingRequests) add() (string, chan wsMessage) {
+	id := "s" + strconv.FormatUint(pr.count.Add(1), 10)
+	ch := make(chan wsMessage, 1)
+
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	if pr.waiting == nil {
+		pr.waiting = make(map[string]chan wsMessage)
+	}
+	pr.waiting[id] = ch
+
+	return id, ch
+}
+
+// remove stops waiting for a reply to the request.
+func (pr *pendingRequests) remove(id string) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+	delete(pr.waiting, id)
+}
+
+// resolve delivers a reply to the request waiting for it.
+// Returns false if nothing is waiting for a message with this ID.
+func (pr *pendingRequests) resolve(msg wsMessage) bool {
+	if msg.ID == "" {
+		return false
+	}
+
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	ch, ok := pr.waiting[msg.ID]
+	if !ok {
+		return false
+	}
+	delete(pr.waiting, msg.ID)
+	ch <- msg
+
+	return true
+}
+
+// failAll closes all the waiting requests, which makes them return ErrDisconnected.
+func (pr *pendingRequests) failAll() {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	for id, ch := range pr.waiting {
+		close(ch)
+		delete(pr.waiting, id)
+	}
+}
+
+// wait blocks until the reply arrives, the connection goes away or the
+// context is done.
+func (pr *pendingRequests) wait(ctx context.Context, id, method string, ch chan wsMessage) (wsMessage, error) {
+	select {
+	case res, ok := <-ch:
+		if !ok {
+			return wsMessage{}, &RequestError{ID: id, Method: method, Err: ErrDisconnected}
+		}
+		return res, nil
+	case <-ctx.Done():
+		pr.remove(id)
+		return wsMessage{}, &RequestError{ID: id, Method: method, Err: ctx.Err()}
+	}
+}
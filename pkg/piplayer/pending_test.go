@@ -0,0 +1,77 @@
+package piplayer
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPendingResolve(t *testing.T) {
+	var pr pendingRequests
+	id, ch := pr.add()
+
+	// A reply for a different request must not be delivered.
+	if pr.resolve(wsMessage{ID: "other"}) {
+		t.Errorf("resolved a message nothing was waiting for")
+	}
+
+	if !pr.resolve(wsMessage{ID: id, Success: true}) {
+		t.Fatalf("reply with id %s was not resolved", id)
+	}
+
+	res, err := pr.wait(context.Background(), id, "play", ch)
+	if err != nil {
+		t.Fatalf("got error %v want nil", err)
+	}
+	if res.ID != id || !res.Success {
+		t.Errorf("got %v want successful reply with id %s", res, id)
+	}
+}
+
+func TestPendingTimeout(t *testing.T) {
+	var pr pendingRequests
+	id, ch := pr.add()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err := pr.wait(ctx, id, "play", ch)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v want %v", err, context.DeadlineExceeded)
+	}
+
+	// A late reply should be ignored.
+	if pr.resolve(wsMessage{ID: id}) {
+		t.Errorf("resolved a reply for a request that timed out")
+	}
+}
+
+func TestPendingDisconnect(t *testing.T) {
+	var pr pendingRequests
+	id, ch := pr.add()
+
+	pr.failAll()
+
+	_, err := pr.wait(context.Background(), id, "play", ch)
+	if !errors.Is(err, ErrDisconnected) {
+		t.Errorf("got error %v want %v", err, ErrDisconnected)
+	}
+}
+
+func TestChromeCommandCancelled(t *testing.T) {
+	conn := &connWS{}
+	conn.queue = newSendQueue(sendQueueSize, &conn.stats)
+	var s contextStreamer = &Chrome{ConnViewer: conn, Timeout: time.Minute}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.SeekContext(ctx, 30); !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v want %v", err, context.Canceled)
+	}
+
+	msg, ok := conn.queue.pop()
+	if !ok || msg.Method != "seek" || msg.Arguments["seconds"] != "30" {
+		t.Errorf("got %+v want the seek command sent to the viewer", msg)
+	}
+}
@@ -0,0 +1,198 @@
+package piplayer
+
+import (
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"slices"
+	"strings"
+)
+
+// Playback modes, for what happens when an item finishes by itself.
+// Going to the next or previous item by hand always wraps around.
+const (
+	// modeRepeat starts the first item again after the last.
+	modeRepeat = "repeat"
+	// modeRepeatOne plays the same item again.
+	modeRepeatOne = "repeatOne"
+	// modeHold plays the playlist once and holds on the last item.
+	modeHold = "hold"
+	// modeBlackout plays the playlist once and then blacks out the screen.
+	modeBlackout = "blackout"
+)
+
+var playModes = []string{modeRepeat, modeRepeatOne, modeHold, modeBlackout}
+
+// modeInfo is how the playlist plays.
+type modeInfo struct {
+	Mode string `json:"mode"`
+	// Shuffle plays the items in a random order, each of them once before
+	// any of them plays again.
+	Shuffle bool `json:"shuffle"`
+}
+
+// mode returns how the playlist plays: the mode set through the API or the
+// remote, or the one in the presentation.json, or else the profile's
+// StopAtEnd. p.engine.mu must be held.
+func (p *Player) mode() modeInfo {
+	if p.engine.override != nil {
+		return *p.engine.override
+	}
+
+	info := p.playlist.presentationInfo()
+	m := modeInfo{Mode: info.Mode, Shuffle: info.Shuffle}
+	if m.Mode == "" {
+		m.Mode = modeRepeat
+		if p.config().Playlist.StopAtEnd {
+			m.Mode = modeHold
+		}
+	}
+	return m
+}
+
+// modeInfo returns how the playlist plays.
+func (p *Player) modeInfo() modeInfo {
+	p.engine.mu.Lock()
+	defer p.engine.mu.Unlock()
+	return p.mode()
+}
+
+// changeMode changes how the playlist plays until another folder is played,
+// and tells the viewer and control pages.
+func (p *Player) changeMode(change func(m *modeInfo) error) (modeInfo, error) {
+	p.engine.mu.Lock()
+	m := p.mode()
+	if err := change(&m); err != nil {
+		p.engine.mu.Unlock()
+		return m, err
+	}
+	if m.Shuffle != p.mode().Shuffle {
+		// Start a new pool, with the item that's playing already played.
+		p.engine.shuffle = nil
+	}
+	p.engine.override = &m
+	p.engine.mu.Unlock()
+
+	if p.api.debug.Load() {
+		log.Printf("playback mode changed to %+v\n", m)
+	}
+	msg := wsMessage{
+		Component: "player",
+		Event:     "mode",
+		Success:   true,
+		Message:   m,
+	}
+	p.ConnViewer.enqueue(msg)
+	p.ConnControl.enqueue(msg)
+	return m, nil
+}
+
+// setMode changes the playback mode, see playModes.
+func (p *Player) setMode(mode string) (modeInfo, error) {
+	return p.changeMode(func(m *modeInfo) error {
+		if !slices.Contains(playModes, mode) {
+			return fmt.Errorf("unknown playback mode %q, must be one of %s", mode, strings.Join(playModes, ", "))
+		}
+		m.Mode = mode
+		return nil
+	})
+}
+
+// nextMode changes to the mode after the current one in playModes.
+func (p *Player) nextMode() (modeInfo, error) {
+	return p.changeMode(func(m *modeInfo) error {
+		i := slices.Index(playModes, m.Mode)
+		m.Mode = playModes[(i+1)%len(playModes)]
+		return nil
+	})
+}
+
+// setShuffle turns shuffling on or off.
+func (p *Player) setShuffle(shuffle bool) (modeInfo, error) {
+	return p.changeMode(func(m *modeInfo) error {
+		m.Shuffle = shuffle
+		return nil
+	})
+}
+
+// toggleShuffle turns shuffling on if it's off, and off if it's on.
+func (p *Player) toggleShuffle() (modeInfo, error) {
+	return p.changeMode(func(m *modeInfo) error {
+		m.Shuffle = !m.Shuffle
+		return nil
+	})
+}
+
+// resetMode drops the mode set through the API or the remote, so the one in
+// the presentation.json of the folder that's played next is used.
+func (p *Player) resetMode() {
+	p.engine.mu.Lock()
+	defer p.engine.mu.Unlock()
+
+	p.engine.override = nil
+	p.engine.shuffle = nil
+}
+
+// reshuffle starts a new pool of the n items in a random order. The current
+// item counts as played if it's kept, otherwise it's moved to the end of the
+// pool so it doesn't play twice in a row. p.engine.mu must be held.
+func (p *Player) reshuffle(n, current int, keep bool) {
+	e := &p.engine
+	e.shuffle = rand.Perm(n)
+	e.played = 0
+
+	i := slices.Index(e.shuffle, current)
+	switch {
+	case i < 0:
+	case keep:
+		e.shuffle[0], e.shuffle[i] = e.shuffle[i], e.shuffle[0]
+		e.played = 1
+	case n > 1:
+		e.shuffle[n-1], e.shuffle[i] = e.shuffle[i], e.shuffle[n-1]
+	}
+}
+
+// markPlayed takes the item at index out of the shuffled pool, when it's
+// started out of turn. p.engine.mu must be held.
+func (p *Player) markPlayed(index int) {
+	e := &p.engine
+	if n := p.playlist.count(); len(e.shuffle) != n {
+		p.reshuffle(n, index, true)
+		return
+	}
+
+	i := slices.Index(e.shuffle, index)
+	if i < e.played {
+		return
+	}
+	e.shuffle[e.played], e.shuffle[i] = e.shuffle[i], e.shuffle[e.played]
+	e.played++
+}
+
+// stepShuffled starts the next item in the shuffled pool, or goes back to the
+// item played before the current one. A new pool is shuffled once every item
+// has played, unless the playlist only plays once. p.engine.mu must be held.
+func (p *Player) stepShuffled(step int, finished bool, mode string, current int) error {
+	e := &p.engine
+	n := p.playlist.count()
+	if len(e.shuffle) != n {
+		p.reshuffle(n, current, true)
+	}
+
+	if step < 0 {
+		if e.played > 1 {
+			e.played--
+			return p.begin(e.shuffle[e.played-1], true)
+		}
+		// Nothing was played before it, start it again.
+		return p.begin(e.shuffle[0], true)
+	}
+
+	if e.played >= n {
+		if finished && p.end(mode) {
+			return nil
+		}
+		p.reshuffle(n, current, false)
+	}
+	return p.begin(e.shuffle[e.played], true)
+}
@@ -0,0 +1,138 @@
+package piplayer
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestPlayModeAtTheEnd(t *testing.T) {
+	tests := []struct {
+		mode     string
+		want     int
+		blackout bool
+		next     int
+	}{
+		{modeRepeat, 0, false, 1},
+		{modeRepeatOne, 2, false, 0},
+		{modeHold, -1, false, 0},
+		{modeBlackout, -1, true, 0},
+	}
+	for _, tt := range tests {
+		p, q := enginePlayer(t, validConfig(t), `{"Version": 2, "Mode": "`+tt.mode+`"}`)
+		if err := p.play(2); err != nil {
+			t.Fatal(err)
+		}
+		lastStart(q)
+
+		if err := p.ended(2); err != nil {
+			t.Fatal(err)
+		}
+		if got := lastStart(q); got != tt.want {
+			t.Errorf("%s: got %d started at the end want %d", tt.mode, got, tt.want)
+		}
+		if s := p.state.snapshot(); s.Blackout != tt.blackout {
+			t.Errorf("%s: got blackout %t want %t", tt.mode, s.Blackout, tt.blackout)
+		}
+
+		// Going to the next item by hand wraps around in every mode.
+		if err := p.Next(); err != nil || p.state.snapshot().Current != tt.next {
+			t.Errorf("%s: got error %v and current %d want %d", tt.mode, err, p.state.snapshot().Current, tt.next)
+		}
+	}
+}
+
+func TestPlayModeSources(t *testing.T) {
+	conf := validConfig(t)
+	conf.Playlist.StopAtEnd = true
+	p, _ := enginePlayer(t, conf, "")
+	if got := p.modeInfo(); got != (modeInfo{Mode: modeHold}) {
+		t.Errorf("got %+v want the profile's StopAtEnd to hold", got)
+	}
+
+	p, _ = enginePlayer(t, validConfig(t), `{"Version": 2, "Mode": "blackout", "Shuffle": true}`)
+	if got := p.modeInfo(); got != (modeInfo{Mode: modeBlackout, Shuffle: true}) {
+		t.Errorf("got %+v want the presentation.json's mode", got)
+	}
+
+	if _, err := p.setMode("random"); err == nil {
+		t.Error("got nil error for an unknown mode")
+	}
+	if m, err := p.nextMode(); err != nil || m.Mode != modeRepeat {
+		t.Errorf("got %+v and %v want to wrap around to repeat", m, err)
+	}
+	if m, err := p.toggleShuffle(); err != nil || m != (modeInfo{Mode: modeRepeat}) {
+		t.Errorf("got %+v and %v want shuffle off", m, err)
+	}
+
+	// Playing another folder goes back to its presentation.json.
+	if err := p.playlist.setFolder(p, ""); err != nil {
+		t.Fatal(err)
+	}
+	if got := p.modeInfo(); got != (modeInfo{Mode: modeBlackout, Shuffle: true}) {
+		t.Errorf("got %+v after switching folders", got)
+	}
+
+	if _, problems := parsePresentation([]byte(`{"Version": 2, "Mode": "once"}`)); !reflect.DeepEqual(problemFields(problems), []string{"Mode"}) {
+		t.Errorf("got problems %v want Mode", problems)
+	}
+}
+
+func TestPlayModeShuffle(t *testing.T) {
+	p, q := enginePlayer(t, validConfig(t), `{"Version": 2, "Shuffle": true}`)
+
+	var played []int
+	for range 3 {
+		if err := p.Next(); err != nil {
+			t.Fatal(err)
+		}
+		played = append(played, lastStart(q))
+	}
+	if got := slices.Sorted(slices.Values(played)); !reflect.DeepEqual(got, []int{0, 1, 2}) {
+		t.Fatalf("got %v want every item once", played)
+	}
+
+	if err := p.Previous(); err != nil || lastStart(q) != played[1] {
+		t.Errorf("got error %v going back, want %d", err, played[1])
+	}
+	if err := p.Next(); err != nil || lastStart(q) != played[2] {
+		t.Errorf("got error %v going forward again, want %d", err, played[2])
+	}
+
+	// A new pool starts once every item has played, without the last one
+	// playing twice in a row.
+	if err := p.ended(played[2]); err != nil {
+		t.Fatal(err)
+	}
+	if got := lastStart(q); got == played[2] || got < 0 {
+		t.Errorf("got %d started after the pool ran out, last played %d", got, played[2])
+	}
+}
+
+func TestPlayModeShuffleOutOfTurn(t *testing.T) {
+	p, q := enginePlayer(t, validConfig(t), `{"Version": 2, "Mode": "hold"}`)
+	if err := p.play(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.setShuffle(true); err != nil {
+		t.Fatal(err)
+	}
+
+	// The item that was playing counts as played, and so does one started
+	// out of turn.
+	if err := p.Next(); err != nil {
+		t.Fatal(err)
+	}
+	other := 3 - 1 - lastStart(q)
+	if err := p.play(other); err != nil {
+		t.Fatal(err)
+	}
+	lastStart(q)
+
+	if err := p.ended(other); err != nil {
+		t.Fatal(err)
+	}
+	if got := lastStart(q); got != -1 {
+		t.Errorf("got %d started after every item played once want to hold", got)
+	}
+}
@@ -2,13 +2,15 @@ package piplayer
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"html/template"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"sync"
+	"sync/atomic"
 
 	"github.com/17xande/keylogger"
 )
@@ -27,21 +29,39 @@ type Player2 interface {
 // Player is the object that renders images to the screen through omxplayer or chromium
 type Player struct {
 	ConnViewer  ConnectionWS
-	ConnControl ConnectionWS
+	ConnControl *Hub
 	Server      *http.Server
 	// serveMux    *http.ServeMux
 	api *APIHandler
 	// command     *exec.Cmd
 	// pipeIn      io.WriteCloser
 	playlist *Playlist
-	conf     *Config
+	// conf is the running config. It's replaced as a whole when the config
+	// changes, so requests can read it without holding configMu.
+	conf atomic.Pointer[Config]
 	// running     bool
 	// quitting    bool
 	// status      int
 	// quit        chan error
 	browser   Browser
 	keylogger *keylogger.KeyLogger
-	streamer  Streamer
+	// streamer is replaced when the config changes, see applyConfig. It's
+	// read through currentStreamer.
+	streamerMu sync.Mutex
+	streamer   Streamer
+	pairing    pairing
+	usb        usbDrives
+	state      *playerState
+	engine     engine
+	// cache is the media cache, or nil when it's turned off.
+	cache atomic.Pointer[mediaCache]
+	// remoteCancel stops listening to the current remote devices.
+	remoteMu     sync.Mutex
+	remoteCancel context.CancelFunc
+	// configMu is held while the config is being changed.
+	configMu sync.Mutex
+	// contentCancel stops syncing the current content source.
+	contentCancel context.CancelFunc
 }
 
 const (
@@ -79,16 +99,16 @@ type Browser struct {
 func NewPlayer(api *APIHandler, conf *Config, keylogger *keylogger.KeyLogger) *Player {
 	p := Player{
 		api:         api,
-		conf:        conf,
 		keylogger:   keylogger,
 		ConnViewer:  NewConnWS(),
-		ConnControl: NewConnWS(),
-		// TODO: Make this a config setting.
-		streamer: &Chrome{
-			ConnViewer:  &connWS{},
-			ConnControl: &connWS{},
-		},
+		ConnControl: NewHub(),
+		state:       newPlayerState(),
 	}
+	p.conf.Store(conf)
+	p.setStreamer(p.newStreamer(conf))
+
+	p.startContentSync()
+	p.setupCache()
 
 	var err error
 	p.playlist, err = NewPlaylist(&p, conf.Mount.Dir)
@@ -97,11 +117,12 @@ func NewPlayer(api *APIHandler, conf *Config, keylogger *keylogger.KeyLogger) *P
 		return nil
 	}
 
-	if api.debug {
+	if api.debug.Load() {
 		log.Println("initializing remote")
 	}
 	// TODO: get context from caller?
 	go remoteRead(context.Background(), &p)
+	go p.watchUSB(context.Background())
 
 	// Listen for websocket messages from the browser.
 	// go p.HandleWebSocketMessage()
@@ -109,13 +130,46 @@ func NewPlayer(api *APIHandler, conf *Config, keylogger *keylogger.KeyLogger) *P
 	return &p
 }
 
+// currentStreamer returns the streamer that plays videos.
+func (p *Player) currentStreamer() Streamer {
+	p.streamerMu.Lock()
+	defer p.streamerMu.Unlock()
+	return p.streamer
+}
+
+// setStreamer replaces the streamer, and returns the previous one.
+func (p *Player) setStreamer(s Streamer) Streamer {
+	p.streamerMu.Lock()
+	defer p.streamerMu.Unlock()
+	old := p.streamer
+	p.streamer = s
+	return old
+}
+
+// newStreamer returns the streamer set in conf, Chrome if none is set.
+func (p *Player) newStreamer(conf *Config) Streamer {
+	if conf.Streamer == "omx" {
+		return &OMXPlayer{audioOutput: conf.AudioOutput}
+	}
+	return &Chrome{
+		ConnViewer:  p.ConnViewer,
+		ConnControl: p.ConnControl,
+	}
+}
+
+// config returns the running config. It must not be changed, changes are
+// made to a copy that's passed to applyConfig.
+func (p *Player) config() *Config {
+	return p.conf.Load()
+}
+
 // FirstRun starts the browser on a black screen and gets things going
 func (p *Player) FirstRun() {
 	if p.api.test == "web" {
 		return
 	}
 
-	if p.api.debug {
+	if p.api.debug.Load() {
 		log.Println("Starting browser on first run...")
 	}
 
@@ -124,49 +178,28 @@ func (p *Player) FirstRun() {
 		p.browser.running = false
 	}
 
-	if len(p.playlist.Items) == 0 {
+	if p.playlist.count() == 0 {
 		log.Println("No items in current directory.")
 		return
 	}
 
 }
 
-// Start the file that will be played in the browser. Sends a message to the
-// ConnViewer channel to be sent over the websocket.
-func (p *Player) Start(w *http.ResponseWriter) {
-	// fileName, ok := p.api.message.Arguments["path"]
-	sIndex, ok := p.api.message.Arguments["index"]
-	if !ok {
-		handleAPIError(w, "No intem index or provided")
-		return
-	}
-
-	res := wsMessage{
-		Event:   "start",
-		Message: sIndex,
-		Success: true,
-	}
-
-	send := p.ConnViewer.getChanSend()
-	send <- res
-
-	m := &resMessage{Success: true, Event: "StartRequestSent", Message: p.playlist.Current.Name()}
-	json.NewEncoder(*w).Encode(m)
-}
-
 // startBrowser starts Chromium browser, or Google Chrome with the relevant flags.
 func (p *Player) startBrowser() error {
 	if p.browser.running {
 		return errors.New("error: Browser already running, cannot start another instance")
 	}
 
+	viewer := p.viewerURL()
+
 	// https://peter.sh/experiments/chromium-command-line-switches/
 	flags := []string{
 		"--kiosk",
 		"--enable-features=UseOzonePlatform",
 		"--ozone-platform=wayland",
 		"--autoplay-policy=no-user-gesture-required",
-		"http://localhost:8080/viewer",
+		viewer,
 	}
 
 	browser := "chromium"
@@ -175,14 +208,14 @@ func (p *Player) startBrowser() error {
 	case "linux":
 		flags = []string{
 			"--incognito",
-			"http://localhost:8080/viewer",
+			viewer,
 		}
 
 		browser = "google-chrome"
 	case "mac":
 		flags = []string{
 			"--incognito",
-			"http://localhost:8080/viewer",
+			viewer,
 		}
 
 		browser = "/Applications/Google Chrome.app/Contents/MacOS/Google Chrome"
@@ -190,7 +223,7 @@ func (p *Player) startBrowser() error {
 
 	p.browser.command = exec.Command(browser, flags...)
 	p.browser.command.Stdin = os.Stdin
-	if p.api.debug {
+	if p.api.debug.Load() {
 
 		p.browser.command.Stdout = os.Stdout
 	}
@@ -210,66 +243,125 @@ func (p *Player) startBrowser() error {
 	return nil
 }
 
-// Next goes to the next item in the playlist.
-func (p *Player) Next() error {
-	// TODO: everything
-	return nil
-}
-
-// Previous goes to the previous item in the playlist.
-func (p *Player) Previous() error {
-	// TODO: everything
-	return nil
+// viewerURL returns the address of the viewer page on this machine.
+func (p *Player) viewerURL() string {
+	port := "8080"
+	if _, pt, err := net.SplitHostPort(p.config().ListenAddr()); err == nil && pt != "" {
+		port = pt
+	}
+	return "http://localhost:" + port + "/viewer"
 }
 
-func handleAPIError(w *http.ResponseWriter, message string) {
-	m := &resMessage{
+// apiError logs the message and returns it as a failed api response.
+func apiError(message string) resMessage {
+	m := resMessage{
 		Success: false,
 		Message: message,
 	}
 
 	log.Println(m)
-	json.NewEncoder(*w).Encode(m)
-}
-
-// Listen should listen to something, I forgot what
-func (p *Player) Listen(s chan string) {
-	// TODO: everything
+	return m
 }
 
 // Handles requets to the player api
-func (p *Player) ServeHTTP(w http.ResponseWriter, h *http.Request) {
+func (p *Player) handleAPI(req reqMessage) resMessage {
+	// These are passed on to the viewer.
 	supportedAPIMethods := map[string]bool{
-		"start":    true,
-		"stop":     true,
-		"play":     true,
-		"pause":    true,
-		"seek":     true,
-		"next":     true,
-		"previous": true,
+		"play":  true,
+		"pause": true,
+		"seek":  true,
 	}
 
-	if _, ok := supportedAPIMethods[p.api.message.Method]; !ok {
-		handleAPIError(&w, "Method not supported: "+p.api.message.Method)
-		return
+	switch req.Method {
+	case "getState":
+		return resMessage{Success: true, Event: "snapshot", Message: p.state.snapshot()}
+	case "reportState":
+		// The viewer reports what it's doing, so that the state can be
+		// replayed to browsers that connect later.
+		var args reportStateArgs
+		if err := decodeArgs(req.Arguments, &args); err != nil {
+			return apiError(err.Error())
+		}
+		p.state.report(args)
+		p.ConnControl.enqueue(p.snapshotMessage())
+		return resMessage{Success: true, Event: "stateReported"}
+	case "start":
+		var args startArgs
+		if err := decodeArgs(req.Arguments, &args); err != nil {
+			return apiError(err.Error())
+		}
+		if err := p.play(args.Index); err != nil {
+			return apiError(err.Error())
+		}
+		return resMessage{Success: true, Event: "started", Message: args.Index}
+	case "stop", "next", "previous":
+		var err error
+		switch req.Method {
+		case "stop":
+			err = p.Stop()
+		case "next":
+			err = p.Next()
+		case "previous":
+			err = p.Previous()
+		}
+		if err != nil {
+			return apiError(err.Error())
+		}
+		return resMessage{Success: true, Event: req.Method}
+	case "ended":
+		// The viewer reports that the media of an item played to the end.
+		var args indexArgs
+		if err := decodeArgs(req.Arguments, &args); err != nil {
+			return apiError(err.Error())
+		}
+		if err := p.ended(args.Index); err != nil {
+			return apiError(err.Error())
+		}
+		return resMessage{Success: true, Event: "ended"}
+	case "getMode":
+		return resMessage{Success: true, Event: "mode", Message: p.modeInfo()}
+	case "setMode", "nextMode", "setShuffle", "toggleShuffle":
+		var m modeInfo
+		var err error
+		switch req.Method {
+		case "setMode":
+			var args modeArgs
+			if err = decodeArgs(req.Arguments, &args); err != nil {
+				return apiError(err.Error())
+			}
+			m, err = p.setMode(args.Mode)
+		case "nextMode":
+			m, err = p.nextMode()
+		case "setShuffle":
+			var args shuffleArgs
+			if err = decodeArgs(req.Arguments, &args); err != nil {
+				return apiError(err.Error())
+			}
+			m, err = p.setShuffle(args.Shuffle)
+		case "toggleShuffle":
+			m, err = p.toggleShuffle()
+		}
+		if err != nil {
+			return apiError(err.Error())
+		}
+		return resMessage{Success: true, Event: "mode", Message: m}
 	}
 
-	index := p.api.message.Arguments["index"]
+	if _, ok := supportedAPIMethods[req.Method]; !ok {
+		return apiError("Method not supported: " + req.Method)
+	}
 
 	res := wsMessage{
-		Component: p.api.message.Component,
-		Method:    p.api.message.Method,
-		Arguments: p.api.message.Arguments,
-		Event:     p.api.message.Method,
-		Message:   index,
+		Component: req.Component,
+		Method:    req.Method,
+		Arguments: req.Arguments,
+		Event:     req.Method,
 		Success:   true,
 	}
 
-	send := p.ConnViewer.getChanSend()
-	send <- res
+	p.ConnViewer.enqueue(res)
 
-	m := &resMessage{Success: true, Event: "StartRequestSent", Message: index}
-	json.NewEncoder(w).Encode(m)
+	return resMessage{Success: true, Event: "StartRequestSent"}
 }
 
 // HandleControl Scan the folder for new files every time the page reloads and display contents
@@ -281,14 +373,14 @@ func (p *Player) HandleControl(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if !loggedIn {
-		if p.conf.Debug {
+		if p.config().Debug {
 			log.Println("User not logged in. Redirecting to login page.")
 		}
 		http.Redirect(w, r, "/login", http.StatusFound)
 		return
 	}
 
-	err = p.playlist.fromFolder(p.conf.Mount.Dir)
+	err = p.playlist.fromFolder(p, p.mediaDir())
 
 	if err != nil {
 		log.Println("HandleControl: Error trying to read files from directory:\n", err)
@@ -304,16 +396,16 @@ func (p *Player) HandleControl(w http.ResponseWriter, r *http.Request) {
 		filename:      "control.html",
 		statTemplates: p.api.statTemplates,
 		data: map[string]interface{}{
-			"location": p.conf.Location,
-			"Mount":    p.conf.Mount.URL,
-			"playlist": p.playlist,
+			"location": p.config().Location,
+			"Mount":    p.config().Mount.URL,
+			"playlist": p.playlist.view(),
 			"error":    err,
 		},
 	}
 
-	if p.api.debug {
+	if p.api.debug.Load() {
 		log.Println("files in playlist:")
-		for _, item := range p.playlist.Items {
+		for _, item := range p.playlist.items() {
 			log.Printf("visual: %s", item.Name())
 			if item.Audio != nil {
 				log.Printf("\taudio: %s", item.Audio.Name())
@@ -329,8 +421,7 @@ func (p *Player) HandleControl(w http.ResponseWriter, r *http.Request) {
 		Message:   "control page was refreshed. Get new items.",
 	}
 
-	send := p.ConnViewer.getChanSend()
-	send <- msg
+	p.ConnViewer.enqueue(msg)
 	tempControl.ServeHTTP(w, r)
 }
 
@@ -340,7 +431,7 @@ func (p *Player) HandleControl(w http.ResponseWriter, r *http.Request) {
 // HandleViewer handles requests to the image viewer page
 // This handler has a dependency on Playlist.
 func (p *Player) HandleViewer(w http.ResponseWriter, r *http.Request) {
-	if err := p.playlist.fromFolder(p.conf.Mount.Dir); err != nil {
+	if err := p.playlist.fromFolder(p, p.mediaDir()); err != nil {
 		log.Println("HandleViewer: Error trying to read files from directory:\n", err)
 		t := template.Must(template.ParseFiles("pkg/piplayer/templates/error.html"))
 		err := t.Execute(w, err)
@@ -354,7 +445,7 @@ func (p *Player) HandleViewer(w http.ResponseWriter, r *http.Request) {
 		filename:      "viewer.html",
 		statTemplates: p.api.statTemplates,
 		data: map[string]interface{}{
-			"playlist": p.playlist,
+			"playlist": p.playlist.view(),
 		},
 	}
 
@@ -1,32 +1,36 @@
 package piplayer
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
-	"maps"
-	"net/http"
 	"os"
 	"path"
-	"regexp"
-	"strconv"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 
 	"github.com/fsnotify/fsnotify"
 )
 
 // Playlist stores the media items that can be played.
 type Playlist struct {
-	Name    string
+	// Name is the media folder.
+	Name string
+	// Folder is the folder in Name the items are from, see playlistFolder.
+	Folder string
+	// folderMu guards Name, Folder and presentation, which the watcher
+	// reads.
+	folderMu sync.Mutex
+	// itemsMu guards Items and Current. The items are replaced as a whole
+	// when they're read again, so the engine never sees a half read folder.
+	itemsMu sync.RWMutex
 	Items   []Item
 	Current *Item
 	watcher *fsnotify.Watcher
-}
-
-// Presentation is used to read the presentation.json file for added cues.
-type Presentation struct {
-	Items []ItemString
+	// presentation is the presentation.json the items were last read with.
+	presentation presentationInfo
 }
 
 // NewPlaylist creates a new playlist with media in the designated folder.
@@ -41,96 +45,150 @@ func NewPlaylist(p *Player, dir string) (*Playlist, error) {
 
 	go pl.watch(p)
 
-	if p.conf.Debug {
+	if p.config().Debug {
 		log.Printf("starting directory watcher for dir: %s\n", dir)
 	}
-	err = pl.watcher.Add(dir)
+	err = pl.watchTree(dir)
 	return pl, err
 }
 
 // Handles requests to the playlist api
-func (p *Playlist) handleAPI(plr *Player, w http.ResponseWriter, h *http.Request) {
-	var m resMessage
-
-	switch plr.api.message.Method {
+func (p *Playlist) handleAPI(plr *Player, req reqMessage) resMessage {
+	switch req.Method {
 	case "getCurrent":
-		if p.Current != nil {
-			m = resMessage{
+		if current := p.view().Current; current != nil {
+			return resMessage{
 				Success: true,
 				Event:   "current",
-				Message: p.Current.Name(),
-			}
-		} else {
-			m = resMessage{
-				Success: true,
-				Event:   "noCurrent",
+				Message: current.Name(),
 			}
 		}
+		return resMessage{
+			Success: true,
+			Event:   "noCurrent",
+		}
 	case "setCurrent":
-		if len(plr.api.message.Arguments) == 0 {
-			m = resMessage{
+		var args indexArgs
+		if err := decodeArgs(req.Arguments, &args); err != nil {
+			log.Printf("Invalid arguments: playlist.HandleAPI.setCurrent\n%v", err)
+			return resMessage{
 				Success: false,
-				Event:   "noArgumentSupplied",
+				Event:   "argumentInvalid",
+				Message: err.Error(),
 			}
-			break
 		}
 
-		index, err := strconv.Atoi(plr.api.message.Arguments["index"])
+		// The item was started by someone else, so only its cues are run.
+		plr.engine.mu.Lock()
+		err := plr.begin(args.Index, false)
+		plr.engine.mu.Unlock()
 		if err != nil {
-			log.Printf("Error converting argument to int: playlist.HandleAPI.setCurrent\n%v", err)
-		}
-
-		if err != nil || index < 0 || index >= len(p.Items) {
-			m = resMessage{
+			return resMessage{
 				Success: false,
 				Event:   "argumentInvalid",
+				Message: err.Error(),
 			}
-			break
 		}
 
-		p.Current = &p.Items[index]
-
-		m = resMessage{
+		return resMessage{
 			Success: true,
 			Event:   "setCurrent",
-			Message: index,
+			Message: args.Index,
 		}
-
-		// send update to the control page, if open.
-		if plr.ConnControl.isActive() {
-			m := wsMessage{
-				Success: true,
-				Event:   "setCurrent",
-				Message: index,
+	case "getFolders":
+		return resMessage{Success: true, Event: "folders", Message: p.folderInfo()}
+	case "setFolder", "nextFolder", "previousFolder":
+		var err error
+		switch req.Method {
+		case "setFolder":
+			var args folderArgs
+			if err = decodeArgs(req.Arguments, &args); err != nil {
+				return apiError(err.Error())
 			}
-			send := plr.ConnControl.getChanSend()
-			send <- m
+			err = p.setFolder(plr, args.Path)
+		case "nextFolder":
+			err = p.stepFolder(plr, 1)
+		case "previousFolder":
+			err = p.stepFolder(plr, -1)
 		}
-
-		if plr.api.debug {
-			log.Println("set current item index to:", index)
+		if err != nil {
+			return apiError(err.Error())
+		}
+		return resMessage{Success: true, Event: "folders", Message: p.folderInfo()}
+	case "getPresentation":
+		return resMessage{Success: true, Event: "presentation", Message: p.presentationInfo()}
+	case "getOrder":
+		return resMessage{Success: true, Event: "order", Message: p.orderInfo()}
+	case "setOrder":
+		var args orderArgs
+		if err := decodeArgs(req.Arguments, &args); err != nil {
+			return apiError(err.Error())
 		}
+		if err := p.setOrder(plr, args.Order); err != nil {
+			return apiError(err.Error())
+		}
+		return resMessage{Success: true, Event: "order", Message: p.orderInfo()}
+	case "setSort":
+		var args sortArgs
+		if err := decodeArgs(req.Arguments, &args); err != nil {
+			return apiError(err.Error())
+		}
+		if err := p.setSort(plr, args.Sort); err != nil {
+			return apiError(err.Error())
+		}
+		return resMessage{Success: true, Event: "order", Message: p.orderInfo()}
 	case "getItems":
-		if err := p.fromFolder(p.Name); err != nil {
-			log.Printf("Api call failed. Can't get items from folder %s\n%v", p.Name, err)
+		if err := p.fromFolder(plr, p.root()); err != nil {
+			log.Printf("Api call failed. Can't get items from folder %s\n%v", p.root(), err)
 		}
 
-		m = resMessage{
+		return resMessage{
 			Success: true,
 			Event:   "items",
 			Message: p.itemsString(),
 		}
-	default:
-		log.Printf("API call unsupported. Ignoring:\n%v\n", plr.api.message)
 	}
 
-	json.NewEncoder(w).Encode(m)
+	log.Printf("API call unsupported. Ignoring:\n%v\n", req)
+	return resMessage{Success: false, Event: "methodNotSupported", Message: "Method not supported: " + req.Method}
 }
 
-func (p *Playlist) fromFolder(dir string) error {
-	// Remove all items from the current playlist if there are any.
-	p.Items = []Item{}
-	p.Name = dir
+// itemType returns the type of item a file is played as, or "" if it isn't
+// supported.
+func itemType(name string) string {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".mp4", ".webm":
+		return "video"
+	case ".jpg", ".jpeg", ".png":
+		return "image"
+	case ".html":
+		return "browser"
+	}
+	return ""
+}
+
+// fromFolder reads the items in the playlist's folder, or playlist file, in
+// the media folder dir, and replaces the items with them, see setItems.
+func (p *Playlist) fromFolder(plr *Player, dir string) error {
+	p.setRoot(dir)
+
+	if folder := p.folder(); folder != "" {
+		sub := filepath.Join(dir, filepath.FromSlash(folder))
+		switch {
+		case !exists(sub):
+			log.Printf("playlist folder %q is gone, playing %s\n", folder, dir)
+			p.setFolderPath("")
+		case playlistFormat(folder) != "":
+			items, err := p.fromPlaylistFile(dir, sub)
+			if err != nil {
+				return err
+			}
+			p.setItems(plr, items)
+			return nil
+		default:
+			dir = sub
+		}
+	}
 
 	// Read files from a certain folder into a playlist.
 	if !exists(dir) {
@@ -143,16 +201,10 @@ func (p *Playlist) fromFolder(dir string) error {
 	}
 
 	// Filter out all files except for supported ones.
+	items := []Item{}
 	for _, file := range files {
-		c := make(map[string]string)
-		e := strings.ToLower(path.Ext(file.Name()))
-		switch e {
-		case ".mp4", ".webm":
-			p.Items = append(p.Items, Item{Visual: file, Type: "video", Cues: c})
-		case ".jpg", ".jpeg", ".png":
-			p.Items = append(p.Items, Item{Visual: file, Type: "image", Cues: c})
-		case ".html":
-			p.Items = append(p.Items, Item{Visual: file, Type: "browser", Cues: c})
+		if t := itemType(file.Name()); t != "" {
+			items = append(items, Item{Visual: file, Type: t})
 		}
 	}
 
@@ -164,15 +216,15 @@ func (p *Playlist) fromFolder(dir string) error {
 		}
 
 		audioBase := file.Name()[0 : len(file.Name())-len(e)]
-		for i, item := range p.Items {
+		for i, item := range items {
 			visual := item.Visual.Name()
 			visualBase := visual[0 : len(visual)-len(path.Ext(visual))]
 			if audioBase == visualBase {
 				switch e {
 				case ".mp3":
-					p.Items[i].Audio = file
+					items[i].Audio = file
 				case ".mp0":
-					p.Items[i].Cues["clear"] = "audio"
+					items[i].Cues.ClearAudio = true
 				}
 				break
 			}
@@ -181,36 +233,123 @@ func (p *Playlist) fromFolder(dir string) error {
 	}
 
 	// look for presentation file for added cues.
-	file := path.Join(dir, "presentation.json")
-	if _, err := os.Stat(file); !os.IsNotExist(err) {
-		data, err := os.ReadFile(file)
-		if err != nil {
-			log.Printf("Error trying to read presentation file '%s': %v", file, err)
-			return nil
-		}
+	presentation, info := readPresentation(dir)
+	presentation.apply(items)
+	p.setPresentation(info)
+
+	sortItems(items, presentation.Sort, presentation.Order)
+	p.setItems(plr, items)
+	return nil
+}
 
-		var presentation Presentation
+// setItems replaces the items. The current item stays current if it's still
+// in the playlist, and the playback state is moved to its new index.
+func (p *Playlist) setItems(plr *Player, items []Item) {
+	p.itemsMu.Lock()
+	defer p.itemsMu.Unlock()
+
+	index := -1
+	if p.Current != nil {
+		visual := p.Current.String().Visual
+		index = slices.IndexFunc(items, func(item Item) bool {
+			return item.String().Visual == visual
+		})
+	}
 
-		json.Unmarshal(data, &presentation)
+	p.Items = items
+	p.Current = nil
+	if index >= 0 {
+		p.Current = &p.Items[index]
+	}
+	plr.state.setIndex(index)
+}
 
-		// Loop through presentation data and attach cues to items.
-		for _, presItem := range presentation.Items {
-			// Create regex to match on file names.
-			r, err := regexp.Compile(presItem.Visual)
-			if err != nil {
-				log.Printf("Could not compile regex with text '%s', comparing using visual name only.", presItem.Visual)
-			}
-			for _, playItem := range p.Items {
-				// If the regex can't compile, use the file name, otherwise use the regex.
-				if err != nil && presItem.Visual == playItem.Visual.Name() {
-					maps.Copy(playItem.Cues, presItem.Cues)
-					break
-				} else if err == nil && r.MatchString(playItem.Visual.Name()) {
-					maps.Copy(playItem.Cues, presItem.Cues)
-				}
-			}
-		}
+// clearCurrent forgets the current item, when another folder is played.
+func (p *Playlist) clearCurrent() {
+	p.itemsMu.Lock()
+	defer p.itemsMu.Unlock()
+	p.Current = nil
+}
+
+// items returns a copy of the items.
+func (p *Playlist) items() []Item {
+	p.itemsMu.RLock()
+	defer p.itemsMu.RUnlock()
+	return slices.Clone(p.Items)
+}
+
+// count returns the number of items.
+func (p *Playlist) count() int {
+	p.itemsMu.RLock()
+	defer p.itemsMu.RUnlock()
+	return len(p.Items)
+}
+
+// playlistView is a copy of the items and the current one, that pages are
+// rendered with.
+type playlistView struct {
+	Items   []Item
+	Current *Item
+}
+
+// view returns a copy of the items and the current one.
+func (p *Playlist) view() playlistView {
+	p.itemsMu.RLock()
+	defer p.itemsMu.RUnlock()
+
+	v := playlistView{Items: slices.Clone(p.Items)}
+	if p.Current != nil {
+		current := *p.Current
+		v.Current = &current
 	}
+	return v
+}
+
+// position returns the index of the current item, or -1 if nothing has been
+// started, and the number of items.
+func (p *Playlist) position(plr *Player) (int, int) {
+	p.itemsMu.RLock()
+	defer p.itemsMu.RUnlock()
+	return plr.state.snapshot().Current, len(p.Items)
+}
+
+// start makes the item at index the current one, and records it in the
+// playback state.
+func (p *Playlist) start(plr *Player, index int) (Item, error) {
+	p.itemsMu.Lock()
+	defer p.itemsMu.Unlock()
+
+	if index < 0 || index >= len(p.Items) {
+		return Item{}, fmt.Errorf("index %d out of range, the playlist has %d items", index, len(p.Items))
+	}
+	p.Current = &p.Items[index]
+	plr.state.setCurrent(index, p.Current.Name())
+	return *p.Current, nil
+}
+
+// setDir points the playlist, and its watcher, at a new folder, and tells the
+// viewer and control pages to get the new items. The caller resets the mode
+// with resetMode, once it doesn't hold any locks the engine takes.
+func (p *Playlist) setDir(plr *Player, dir string) error {
+	p.unwatchAll()
+	p.setRoot(dir)
+	p.setFolderPath("")
+	if err := p.watchTree(dir); err != nil {
+		return err
+	}
+
+	p.clearCurrent()
+	if err := p.fromFolder(plr, dir); err != nil {
+		return err
+	}
+
+	msg := wsMessage{
+		Component: "playlist",
+		Event:     "newItems",
+		Message:   "media folder changed. Get new items.",
+	}
+	plr.ConnViewer.enqueue(msg)
+	plr.ConnControl.enqueue(msg)
 
 	return nil
 }
@@ -218,7 +357,6 @@ func (p *Playlist) fromFolder(dir string) error {
 // watch for changes in the supplied directory
 func (p *Playlist) watch(plr *Player) {
 	defer p.watcher.Close()
-	send := plr.ConnControl.getChanSend()
 	for {
 		select {
 		case event, ok := <-p.watcher.Events:
@@ -227,16 +365,20 @@ func (p *Playlist) watch(plr *Player) {
 				log.Println("issue getting file change event. Stopping watcher.")
 				return
 			}
-			if plr.conf.Debug {
+			if plr.config().Debug {
 				log.Println("file change event:", event)
 			}
-			// Send a message to the viewer to get new items.
+			p.folderEvent(plr, event)
+			// Send a message to the viewer and control pages to get new items.
+			// Copying a folder of files fires lots of events, but the queues
+			// only keep the latest newItems message.
 			msg := wsMessage{
 				Component: "playlist",
 				Event:     "newItems",
 				Message:   "detected file change. Get new items.",
 			}
-			send <- msg
+			plr.ConnViewer.enqueue(msg)
+			plr.ConnControl.enqueue(msg)
 		case err, ok := <-p.watcher.Errors:
 			if !ok {
 				log.Println("issue getting file change error. Stopping watcher.")
@@ -290,6 +432,9 @@ func (p *Playlist) watch(plr *Player) {
 // }
 
 func (p *Playlist) itemsString() []ItemString {
+	p.itemsMu.RLock()
+	defer p.itemsMu.RUnlock()
+
 	var res []ItemString
 
 	for _, item := range p.Items {
@@ -0,0 +1,340 @@
+package piplayer
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// playlistFormats are the playlist files, eg: from VLC, that are played like
+// a folder. They're read from the media folder, and the paths in them are
+// relative to it.
+var playlistFormats = []string{"m3u", "m3u8", "xspf"}
+
+// xspfNamespace is the XML namespace of XSPF playlists.
+const xspfNamespace = "http://xspf.org/ns/0/"
+
+// playlistEntry is a file in a playlist file.
+type playlistEntry struct {
+	// Path is relative to the media folder, with forward slashes.
+	Path  string
+	Title string
+	// Duration is in seconds, 0 if it isn't known.
+	Duration int
+	// Field is where the entry is in the file, eg: "line 3".
+	Field string
+}
+
+type xspfPlaylist struct {
+	XMLName xml.Name    `xml:"playlist"`
+	Xmlns   string      `xml:"xmlns,attr,omitempty"`
+	Version string      `xml:"version,attr"`
+	Title   string      `xml:"title,omitempty"`
+	Tracks  []xspfTrack `xml:"trackList>track"`
+}
+
+type xspfTrack struct {
+	Location []string `xml:"location"`
+	Title    string   `xml:"title,omitempty"`
+	// Duration is in milliseconds.
+	Duration int `xml:"duration,omitempty"`
+}
+
+// playlistFormat returns the format of a playlist file, or "" if name isn't
+// one.
+func playlistFormat(name string) string {
+	ext := strings.TrimPrefix(strings.ToLower(filepath.Ext(name)), ".")
+	if slices.Contains(playlistFormats, ext) {
+		return ext
+	}
+	return ""
+}
+
+// entryPath resolves a location in a playlist file against the media folder
+// root, returning the path relative to it. Locations are file paths in M3U
+// files and URIs in XSPF ones, and both can be file:// URLs.
+func entryPath(location, root string, uri bool) (string, error) {
+	p := location
+	if u, err := url.Parse(location); err == nil && (uri || u.Scheme != "") {
+		switch u.Scheme {
+		case "", "file":
+			p = u.Path
+		default:
+			// Single letters are Windows drives, eg: C:\media\intro.mp4.
+			if len(u.Scheme) > 1 {
+				return "", fmt.Errorf("%s isn't a file, only files in the media folder can be played", location)
+			}
+		}
+	}
+	p = strings.ReplaceAll(p, `\`, "/")
+
+	if filepath.IsAbs(filepath.FromSlash(p)) {
+		rel, err := filepath.Rel(root, filepath.FromSlash(p))
+		if err != nil {
+			return "", err
+		}
+		p = filepath.ToSlash(rel)
+	}
+
+	p = path.Clean(p)
+	if p == "." || p == ".." || strings.HasPrefix(p, "../") || strings.HasPrefix(p, "/") {
+		return "", fmt.Errorf("%s isn't in the media folder %s", location, root)
+	}
+	return p, nil
+}
+
+// parseM3U reads an M3U or M3U8 playlist. Titles and durations are read from
+// #EXTINF lines. Files that aren't UTF-8 are read as Latin-1, like older
+// players write them.
+func parseM3U(data []byte, root string) ([]playlistEntry, []FieldError) {
+	text := string(data)
+	if !utf8.Valid(data) {
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		text = string(runes)
+	}
+	text = strings.TrimPrefix(text, "\uFEFF")
+
+	errs := &ConfigError{}
+	var entries []playlistEntry
+	var title string
+	var duration int
+
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		field := fmt.Sprintf("line %d", i+1)
+
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXTINF:"):
+			// #EXTINF:<seconds> <attributes>,<title>
+			info, t, _ := strings.Cut(strings.TrimPrefix(line, "#EXTINF:"), ",")
+			d, _, _ := strings.Cut(strings.TrimSpace(info), " ")
+			secs, err := strconv.ParseFloat(d, 64)
+			if err != nil {
+				errs.add(field, "the duration must be a number of seconds, got %q", d)
+			} else if secs > 0 {
+				duration = int(math.Round(secs))
+			}
+			title = strings.TrimSpace(t)
+		case strings.HasPrefix(line, "#"):
+			// Other directives and comments.
+		default:
+			p, err := entryPath(line, root, false)
+			if err != nil {
+				errs.add(field, "%v", err)
+			} else {
+				entries = append(entries, playlistEntry{Path: p, Title: title, Duration: duration, Field: field})
+			}
+			title, duration = "", 0
+		}
+	}
+
+	return entries, errs.Problems
+}
+
+// parseXSPF reads an XSPF playlist. Durations are in milliseconds.
+func parseXSPF(data []byte, root string) ([]playlistEntry, []FieldError) {
+	errs := &ConfigError{}
+
+	var pl xspfPlaylist
+	if err := xml.Unmarshal(data, &pl); err != nil {
+		errs.add("playlist", "%v", err)
+		return nil, errs.Problems
+	}
+
+	var entries []playlistEntry
+	for i, track := range pl.Tracks {
+		field := fmt.Sprintf("trackList.track[%d]", i)
+		if len(track.Location) == 0 {
+			errs.add(field, "has no location")
+			continue
+		}
+		p, err := entryPath(strings.TrimSpace(track.Location[0]), root, true)
+		if err != nil {
+			errs.add(field+".location", "%v", err)
+			continue
+		}
+		duration := int(math.Round(float64(track.Duration) / 1000))
+		entries = append(entries, playlistEntry{Path: p, Title: strings.TrimSpace(track.Title), Duration: max(duration, 0), Field: field})
+	}
+
+	return entries, errs.Problems
+}
+
+// readPlaylistFile reads the entries in a playlist file, with the problems
+// found in it.
+func readPlaylistFile(file, root string) ([]playlistEntry, []FieldError, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if playlistFormat(file) == "xspf" {
+		entries, problems := parseXSPF(data, root)
+		return entries, problems, nil
+	}
+	entries, problems := parseM3U(data, root)
+	return entries, problems, nil
+}
+
+// fromPlaylistFile reads the items in a playlist file in the media folder
+// root. The entries that can't be played are reported like the problems in
+// a presentation.json.
+func (p *Playlist) fromPlaylistFile(root, file string) ([]Item, error) {
+	entries, problems, err := readPlaylistFile(file, root)
+	if err != nil {
+		return nil, fmt.Errorf("fromPlaylistFile: can't read %s: %w", file, err)
+	}
+
+	items := []Item{}
+	errs := &ConfigError{Problems: problems}
+	for _, e := range entries {
+		info, err := os.Stat(filepath.Join(root, filepath.FromSlash(e.Path)))
+		if err != nil || info.IsDir() {
+			errs.add(e.Field, "no file %s in the media folder", e.Path)
+			continue
+		}
+		t := itemType(e.Path)
+		if t == "" {
+			errs.add(e.Field, "%s can't be played", e.Path)
+			continue
+		}
+
+		dir := path.Dir(e.Path)
+		if dir == "." {
+			dir = ""
+		}
+		items = append(items, Item{
+			Visual: fs.FileInfoToDirEntry(info),
+			Dir:    dir,
+			Type:   t,
+			Title:  e.Title,
+			Cues:   Cues{Timeout: e.Duration},
+		})
+	}
+
+	for _, problem := range errs.Problems {
+		log.Printf("problem in playlist file '%s': %v\n", file, problem)
+	}
+	p.setPresentation(presentationInfo{File: file, Problems: append([]FieldError{}, errs.Problems...)})
+	return items, nil
+}
+
+// writePlaylistFile writes the items in a playlist format. The paths are
+// relative to the media folder, with folder the one the items are in.
+func writePlaylistFile(w io.Writer, format, title, folder string, items []Item) error {
+	type entry struct {
+		path, title string
+		duration    int
+	}
+	var entries []entry
+	for _, item := range items {
+		e := entry{path: path.Join(folder, item.Dir, item.Visual.Name()), title: item.Title, duration: item.Cues.Timeout}
+		if e.title == "" {
+			e.title = item.Name()
+		}
+		entries = append(entries, e)
+	}
+
+	switch format {
+	case "m3u", "m3u8":
+		var buf bytes.Buffer
+		buf.WriteString("#EXTM3U\n")
+		if title != "" {
+			fmt.Fprintf(&buf, "#PLAYLIST:%s\n", title)
+		}
+		for _, e := range entries {
+			duration := -1
+			if e.duration > 0 {
+				duration = e.duration
+			}
+			fmt.Fprintf(&buf, "#EXTINF:%d,%s\n%s\n", duration, e.title, e.path)
+		}
+		_, err := w.Write(buf.Bytes())
+		return err
+	case "xspf":
+		pl := xspfPlaylist{Xmlns: xspfNamespace, Version: "1", Title: title}
+		for _, e := range entries {
+			pl.Tracks = append(pl.Tracks, xspfTrack{
+				Location: []string{(&url.URL{Path: e.path}).String()},
+				Title:    e.title,
+				Duration: e.duration * 1000,
+			})
+		}
+		if _, err := io.WriteString(w, xml.Header); err != nil {
+			return err
+		}
+		enc := xml.NewEncoder(w)
+		enc.Indent("", "  ")
+		if err := enc.Encode(pl); err != nil {
+			return err
+		}
+		_, err := io.WriteString(w, "\n")
+		return err
+	}
+
+	return fmt.Errorf("unknown playlist format %q, must be one of %s", format, strings.Join(playlistFormats, ", "))
+}
+
+// PlaylistExportHandler downloads the items in the playlist as a playlist
+// file, in the format in the "format" query parameter: m3u, m3u8 or xspf.
+func PlaylistExportHandler(p *Player) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, loggedIn, err := CheckLogin(w, r)
+		if err != nil {
+			log.Println("error trying to retrieve session:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !loggedIn {
+			http.Error(w, "Not logged in", http.StatusUnauthorized)
+			return
+		}
+
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = "m3u8"
+		}
+
+		title := p.config().Location
+		folder := p.playlist.folder()
+		if playlistFormat(folder) != "" {
+			// Items from a playlist file are already relative to the media folder.
+			title = removeExtension(path.Base(folder))
+			folder = ""
+		} else if folder != "" {
+			title = path.Base(folder)
+		}
+
+		var buf bytes.Buffer
+		if err := writePlaylistFile(&buf, format, title, folder, p.playlist.items()); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		name := strings.ToLower(strings.Join(strings.Fields(title), "-"))
+		contentType := "audio/x-mpegurl"
+		if format == "xspf" {
+			contentType = "application/xspf+xml"
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(name+"."+format)))
+		w.Write(buf.Bytes())
+	}
+}
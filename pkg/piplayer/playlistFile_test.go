@@ -0,0 +1,197 @@
+package piplayer
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseM3U(t *testing.T) {
+	root := "/home/pi/media"
+	data := "\uFEFF#EXTM3U\r\n" +
+		"#EXTINF:12.4,Welcome slide\r\n" +
+		"welcome.jpg\r\n" +
+		"# a comment\n" +
+		"#EXTINF:-1 tvg-id=\"x\",Opening song\n" +
+		"morning/song 1.mp4\n" +
+		"/home/pi/media/notices.png\n" +
+		"file:///home/pi/media/evening/talk.mp4\n" +
+		"../secrets.mp4\n" +
+		"http://example.com/stream.mp4\n" +
+		"#EXTINF:soon,Broken\n" +
+		"end.jpg\n"
+
+	entries, problems := parseM3U([]byte(data), root)
+
+	want := []playlistEntry{
+		{Path: "welcome.jpg", Title: "Welcome slide", Duration: 12, Field: "line 3"},
+		{Path: "morning/song 1.mp4", Title: "Opening song", Field: "line 6"},
+		{Path: "notices.png", Field: "line 7"},
+		{Path: "evening/talk.mp4", Field: "line 8"},
+		{Path: "end.jpg", Title: "Broken", Field: "line 12"},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("got %+v\nwant %+v", entries, want)
+	}
+	if got := problemFields(problems); !reflect.DeepEqual(got, []string{"line 9", "line 10", "line 11"}) {
+		t.Errorf("got problems %v", problems)
+	}
+}
+
+func TestParseM3ULatin1(t *testing.T) {
+	entries, _ := parseM3U([]byte("#EXTINF:5,Caf\xe9\ncaf\xe9.jpg\n"), "/media")
+
+	if len(entries) != 1 || entries[0].Title != "Café" || entries[0].Path != "café.jpg" {
+		t.Errorf("got %+v", entries)
+	}
+}
+
+func TestParseXSPF(t *testing.T) {
+	data := `<?xml version="1.0" encoding="UTF-8"?>
+<playlist xmlns="http://xspf.org/ns/0/" version="1">
+  <trackList>
+    <track><location>morning/song%201.mp4</location><title>Opening song</title><duration>215300</duration></track>
+    <track><location>file:///media/usb/notices.png</location></track>
+    <track><title>No location</title></track>
+  </trackList>
+</playlist>`
+
+	entries, problems := parseXSPF([]byte(data), "/media/usb")
+
+	want := []playlistEntry{
+		{Path: "morning/song 1.mp4", Title: "Opening song", Duration: 215, Field: "trackList.track[0]"},
+		{Path: "notices.png", Field: "trackList.track[1]"},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("got %+v\nwant %+v", entries, want)
+	}
+	if got := problemFields(problems); !reflect.DeepEqual(got, []string{"trackList.track[2]"}) {
+		t.Errorf("got problems %v", problems)
+	}
+
+	if _, problems := parseXSPF([]byte("<playlist><trackList>"), "/media"); len(problems) != 1 {
+		t.Errorf("got %v want a problem for broken XML", problems)
+	}
+}
+
+// playlistFilePlayer returns a player with a playlist file in the media
+// folder that points at files in sub folders.
+func playlistFilePlayer(t *testing.T) *Player {
+	conf := validConfig(t)
+	for _, name := range []string{"welcome.jpg", "morning/song1.mp4", "evening/notice.png"} {
+		if err := os.MkdirAll(filepath.Join(conf.Mount.Dir, filepath.Dir(name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeMedia(t, conf.Mount.Dir, name, 1)
+	}
+	m3u := "#EXTM3U\n#EXTINF:215,Opening song\nmorning/song1.mp4\n#EXTINF:10,Notices\nevening/notice.png\nmissing.mp4\nwelcome.jpg\n"
+	if err := os.WriteFile(filepath.Join(conf.Mount.Dir, "Sunday.m3u8"), []byte(m3u), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return reloadPlayer(t, conf)
+}
+
+func TestPlaylistFileAsFolder(t *testing.T) {
+	p := playlistFilePlayer(t)
+
+	folders := p.playlist.folders()
+	i := slices.IndexFunc(folders, func(f playlistFolder) bool { return f.Path == "Sunday.m3u8" })
+	if i < 0 || !folders[i].File || folders[i].Items != 4 {
+		t.Fatalf("got folders %+v want Sunday.m3u8 with 4 entries", folders)
+	}
+
+	if err := p.playlist.setFolder(p, "Sunday.m3u8"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []ItemString{
+		{Visual: "morning/song1.mp4", Type: "video", Title: "Opening song", Cues: Cues{Timeout: 215}},
+		{Visual: "evening/notice.png", Type: "image", Title: "Notices", Cues: Cues{Timeout: 10}},
+		{Visual: "welcome.jpg", Type: "image"},
+	}
+	if got := p.playlist.itemsString(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+	if dir := p.contentDir(); dir != p.config().Mount.Dir {
+		t.Errorf("got content dir %s want the media folder %s", dir, p.config().Mount.Dir)
+	}
+	if info := p.playlist.presentationInfo(); !reflect.DeepEqual(problemFields(info.Problems), []string{"line 6"}) {
+		t.Errorf("got problems %+v want the missing file", info.Problems)
+	}
+
+	if err := p.playlist.setOrder(p, []string{"welcome.jpg"}); err == nil {
+		t.Error("got nil error reordering a playlist file")
+	}
+	if info := p.playlist.orderInfo(); !info.File {
+		t.Errorf("got %+v want a playlist file", info)
+	}
+}
+
+func TestWritePlaylistFileRoundTrip(t *testing.T) {
+	p := playlistFilePlayer(t)
+	if err := p.playlist.setFolder(p, "Sunday.m3u8"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []string{"m3u", "xspf"} {
+		var buf bytes.Buffer
+		if err := writePlaylistFile(&buf, format, "Sunday", "", p.playlist.Items); err != nil {
+			t.Fatal(err)
+		}
+
+		var entries []playlistEntry
+		var problems []FieldError
+		if format == "xspf" {
+			entries, problems = parseXSPF(buf.Bytes(), p.config().Mount.Dir)
+		} else {
+			entries, problems = parseM3U(buf.Bytes(), p.config().Mount.Dir)
+		}
+
+		var got []string
+		for _, e := range entries {
+			got = append(got, e.Path+"|"+e.Title)
+		}
+		want := []string{"morning/song1.mp4|Opening song", "evening/notice.png|Notices", "welcome.jpg|welcome"}
+		if len(problems) > 0 || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v with problems %v want %v\n%s", format, got, problems, want, buf.String())
+		}
+		if entries[0].Duration != 215 {
+			t.Errorf("%s: got duration %d want 215", format, entries[0].Duration)
+		}
+	}
+
+	if err := writePlaylistFile(&bytes.Buffer{}, "pls", "", "", nil); err == nil {
+		t.Error("got nil error for an unknown format")
+	}
+}
+
+func TestPlaylistExportHandler(t *testing.T) {
+	p := playlistFilePlayer(t)
+	if err := p.playlist.setFolder(p, "morning"); err != nil {
+		t.Fatal(err)
+	}
+	h := PlaylistExportHandler(p)
+
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, "/playlist/export", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d without logging in, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	w = httptest.NewRecorder()
+	h(w, loggedIn(t, http.MethodGet, "/playlist/export?format=xspf", ""))
+	if w.Code != http.StatusOK || !strings.Contains(w.Header().Get("Content-Disposition"), `"morning.xspf"`) {
+		t.Fatalf("got status %d and %q", w.Code, w.Header().Get("Content-Disposition"))
+	}
+	// Paths are relative to the media folder, so the file can be played from
+	// there.
+	if !strings.Contains(w.Body.String(), "<location>morning/song1.mp4</location>") {
+		t.Errorf("got %s", w.Body.String())
+	}
+}
@@ -0,0 +1,257 @@
+package piplayer
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// maxFolderDepth is how deep sub folders of the media folder are played and
+// watched. It keeps a large network share from using up the inotify watches.
+const maxFolderDepth = 4
+
+// playlistFolder is a folder in the media folder that can be played as a
+// playlist, or a playlist file in it.
+type playlistFolder struct {
+	// Path is relative to the media folder, with forward slashes, and empty
+	// for the media folder itself.
+	Path  string `json:"path"`
+	Name  string `json:"name"`
+	Depth int    `json:"depth"`
+	Items int    `json:"items"`
+	// File is set for playlist files, see playlistFormats.
+	File bool `json:"file,omitempty"`
+}
+
+// folderInfo is sent to the control page when folders appear or disappear,
+// and when the playlist switches to another folder.
+type folderInfo struct {
+	Folders []playlistFolder `json:"folders"`
+	Current string           `json:"current"`
+}
+
+// hiddenName reports whether a file or folder is hidden, eg: a partial
+// download or a sync state file.
+func hiddenName(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
+
+// root returns the media folder.
+func (p *Playlist) root() string {
+	p.folderMu.Lock()
+	defer p.folderMu.Unlock()
+	return p.Name
+}
+
+// setRoot changes the media folder.
+func (p *Playlist) setRoot(dir string) {
+	p.folderMu.Lock()
+	defer p.folderMu.Unlock()
+	p.Name = dir
+}
+
+// folder returns the sub folder of the media folder that's playing.
+func (p *Playlist) folder() string {
+	p.folderMu.Lock()
+	defer p.folderMu.Unlock()
+	return p.Folder
+}
+
+func (p *Playlist) setFolderPath(folder string) {
+	p.folderMu.Lock()
+	defer p.folderMu.Unlock()
+	p.Folder = folder
+}
+
+// contentDir returns the folder the items in the playlist are in, the media
+// folder or the playlist folder in it. Items from a playlist file are in the
+// media folder.
+func (p *Player) contentDir() string {
+	dir := p.mediaDir()
+	if p.playlist != nil {
+		if folder := p.playlist.folder(); folder != "" && playlistFormat(folder) == "" {
+			dir = filepath.Join(dir, filepath.FromSlash(folder))
+		}
+	}
+	return dir
+}
+
+// folders returns the media folder and the folders in it, in the order
+// they're shown on the control page.
+func (p *Playlist) folders() []playlistFolder {
+	root := p.root()
+	var folders []playlistFolder
+
+	filepath.WalkDir(root, func(dir string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !d.IsDir() {
+			// Playlist files are only read from the media folder itself.
+			if filepath.Dir(dir) == filepath.Clean(root) && playlistFormat(d.Name()) != "" && !hiddenName(d.Name()) {
+				entries, _, _ := readPlaylistFile(dir, root)
+				folders = append(folders, playlistFolder{Path: d.Name(), Name: d.Name(), Depth: 1, Items: len(entries), File: true})
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(root, dir)
+		if err != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			rel = ""
+		}
+
+		depth := 0
+		if rel != "" {
+			if hiddenName(d.Name()) {
+				return filepath.SkipDir
+			}
+			depth = strings.Count(rel, "/") + 1
+		}
+		folders = append(folders, playlistFolder{Path: rel, Name: d.Name(), Depth: depth, Items: countMedia(dir)})
+		if depth >= maxFolderDepth {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+
+	return folders
+}
+
+// folderInfo returns the folders and the one that's playing.
+func (p *Playlist) folderInfo() folderInfo {
+	return folderInfo{Folders: p.folders(), Current: p.folder()}
+}
+
+// setFolder switches the playlist to a folder in the media folder, and tells
+// the viewer and control pages to get the new items. An empty folder switches
+// back to the media folder itself.
+func (p *Playlist) setFolder(plr *Player, folder string) error {
+	folder = strings.Trim(path.Clean("/"+folder), "/")
+	if !slices.ContainsFunc(p.folders(), func(f playlistFolder) bool { return f.Path == folder }) {
+		return fmt.Errorf("no folder %q in %s", folder, p.root())
+	}
+
+	p.setFolderPath(folder)
+	p.clearCurrent()
+	if err := p.fromFolder(plr, p.root()); err != nil {
+		return err
+	}
+	plr.resetMode()
+	if plr.api.debug.Load() {
+		log.Printf("playlist switched to folder %q\n", folder)
+	}
+
+	items := wsMessage{
+		Component: "playlist",
+		Event:     "newItems",
+		Message:   "playlist folder changed. Get new items.",
+	}
+	plr.ConnViewer.enqueue(items)
+	plr.ConnControl.enqueue(items)
+	plr.ConnControl.enqueue(wsMessage{
+		Component: "playlist",
+		Event:     "folders",
+		Success:   true,
+		Message:   p.folderInfo(),
+	})
+
+	return nil
+}
+
+// stepFolder switches to the folder step places after the current one in
+// the list of folders, wrapping around at the ends.
+func (p *Playlist) stepFolder(plr *Player, step int) error {
+	folders := p.folders()
+	if len(folders) == 0 {
+		return fmt.Errorf("no folders in %s", p.root())
+	}
+
+	current := p.folder()
+	i := slices.IndexFunc(folders, func(f playlistFolder) bool { return f.Path == current })
+	i = ((i+step)%len(folders) + len(folders)) % len(folders)
+	return p.setFolder(plr, folders[i].Path)
+}
+
+// watchTree watches dir and the folders in it, down to maxFolderDepth.
+func (p *Playlist) watchTree(dir string) error {
+	root := p.root()
+	return filepath.WalkDir(dir, func(sub string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if sub == dir {
+				return err
+			}
+			return nil
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if sub != dir && hiddenName(d.Name()) {
+			return filepath.SkipDir
+		}
+		if err := p.watcher.Add(sub); err != nil {
+			return fmt.Errorf("error watching dir %s: %w", sub, err)
+		}
+
+		if rel, err := filepath.Rel(root, sub); err == nil && rel != "." && strings.Count(filepath.ToSlash(rel), "/")+1 >= maxFolderDepth {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+// unwatchAll stops watching every folder.
+func (p *Playlist) unwatchAll() {
+	for _, dir := range p.watcher.WatchList() {
+		p.watcher.Remove(dir)
+	}
+}
+
+// folderEvent handles a file event that might have added or removed a
+// folder. New folders are watched, and the control page is told about it.
+// Removed folders stop being watched on their own.
+func (p *Playlist) folderEvent(plr *Player, event fsnotify.Event) {
+	if hiddenName(filepath.Base(event.Name)) {
+		return
+	}
+
+	switch {
+	case event.Has(fsnotify.Create):
+		info, err := os.Stat(event.Name)
+		if err != nil {
+			return
+		}
+		if !info.IsDir() {
+			if playlistFormat(event.Name) == "" {
+				return
+			}
+			break
+		}
+		if err := p.watchTree(event.Name); err != nil {
+			log.Printf("error trying to watch new folder %s: %v\n", event.Name, err)
+		}
+	case event.Has(fsnotify.Remove), event.Has(fsnotify.Rename):
+		if filepath.Ext(event.Name) != "" && itemType(event.Name) != "" {
+			// A media file, not a folder.
+			return
+		}
+	default:
+		return
+	}
+
+	plr.ConnControl.enqueue(wsMessage{
+		Component: "playlist",
+		Event:     "folders",
+		Success:   true,
+		Message:   p.folderInfo(),
+	})
+}
@@ -0,0 +1,108 @@
+package piplayer
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// folderPlayer returns a player whose media folder has a sub folder for each
+// service, one of them with its own presentation.json, and a hidden folder.
+func folderPlayer(t *testing.T) *Player {
+	conf := validConfig(t)
+	files := map[string]string{
+		"welcome.jpg":                         "image",
+		"morning/song1.mp4":                   "video",
+		"morning/song2.mp4":                   "video",
+		"morning/presentation.json":           `{"Items":[{"Visual":"song2.mp4","Cues":{"clear":"audio"}}]}`,
+		"morning/kids/story.mp4":              "video",
+		"evening/notice.png":                  "image",
+		".sync/partial.mp4":                   "video",
+		"a/b/c/d/too-deep-to-matter/deep.mp4": "video",
+	}
+	for name, data := range files {
+		path := filepath.Join(conf.Mount.Dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return reloadPlayer(t, conf)
+}
+
+func TestFolders(t *testing.T) {
+	p := folderPlayer(t)
+
+	var got []string
+	for _, f := range p.playlist.folders() {
+		got = append(got, f.Path)
+	}
+
+	want := []string{"", "a", "a/b", "a/b/c", "a/b/c/d", "evening", "morning", "morning/kids"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got folders %v want %v", got, want)
+	}
+}
+
+func TestSetFolder(t *testing.T) {
+	p := folderPlayer(t)
+	root := p.config().Mount.Dir
+
+	if err := p.playlist.setFolder(p, "morning"); err != nil {
+		t.Fatalf("got error %v want nil", err)
+	}
+	if len(p.playlist.Items) != 2 || p.playlist.Name != root {
+		t.Fatalf("got %d items in %s, want 2 in %s", len(p.playlist.Items), p.playlist.Name, root)
+	}
+	if cue := p.playlist.Items[1].Cues; !cue.ClearAudio {
+		t.Errorf("got cues %+v from the folder's presentation.json, want ClearAudio", cue)
+	}
+	if dir := p.contentDir(); dir != filepath.Join(root, "morning") {
+		t.Errorf("got content dir %s want %s", dir, filepath.Join(root, "morning"))
+	}
+
+	for _, folder := range []string{"missing", ".sync", "../../etc"} {
+		if err := p.playlist.setFolder(p, folder); err == nil {
+			t.Errorf("got nil error switching to %q", folder)
+		}
+	}
+	if p.playlist.folder() != "morning" {
+		t.Errorf("got folder %q after failed switches, want morning", p.playlist.folder())
+	}
+
+	if err := p.playlist.setFolder(p, ""); err != nil || len(p.playlist.Items) != 1 {
+		t.Errorf("got error %v and %d items switching back, want nil and 1", err, len(p.playlist.Items))
+	}
+}
+
+func TestStepFolderWraps(t *testing.T) {
+	p := folderPlayer(t)
+
+	if err := p.playlist.stepFolder(p, -1); err != nil || p.playlist.folder() != "morning/kids" {
+		t.Errorf("got error %v and folder %q, want morning/kids", err, p.playlist.folder())
+	}
+	if err := p.playlist.stepFolder(p, 1); err != nil || p.playlist.folder() != "" {
+		t.Errorf("got error %v and folder %q, want the media folder", err, p.playlist.folder())
+	}
+}
+
+func TestRemovedFolderFallsBack(t *testing.T) {
+	p := folderPlayer(t)
+	if err := p.playlist.setFolder(p, "evening"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.RemoveAll(filepath.Join(p.config().Mount.Dir, "evening")); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.playlist.fromFolder(p, p.playlist.Name); err != nil {
+		t.Fatalf("got error %v want nil", err)
+	}
+
+	if p.playlist.folder() != "" || len(p.playlist.Items) != 1 {
+		t.Errorf("got folder %q with %d items, want the media folder with 1", p.playlist.folder(), len(p.playlist.Items))
+	}
+}
@@ -0,0 +1,259 @@
+package piplayer
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Sort modes for the items in a folder that aren't in its Order list.
+const (
+	// sortName sorts by file name, with numbers in order, so that
+	// "2 Welcome" comes before "10 Announcements".
+	sortName = "name"
+	// sortModified sorts the oldest files first.
+	sortModified = "modified"
+	// sortNewest sorts the newest files first.
+	sortNewest = "newest"
+)
+
+var sortModes = []string{sortName, sortModified, sortNewest}
+
+// orderInfo is the order of the items in the folder that's playing.
+type orderInfo struct {
+	Sort  string   `json:"sort"`
+	Order []string `json:"order"`
+	// File is set when a playlist file is playing, which sets the order
+	// itself.
+	File bool `json:"file"`
+}
+
+// naturalCompare compares file names ignoring case, and comparing runs of
+// digits by their value.
+func naturalCompare(a, b string) int {
+	a, b = strings.ToLower(a), strings.ToLower(b)
+	for a != "" && b != "" {
+		if isDigit(a[0]) && isDigit(b[0]) {
+			da, db := digits(a), digits(b)
+			na, nb := strings.TrimLeft(a[:da], "0"), strings.TrimLeft(b[:db], "0")
+			if c := cmp.Compare(len(na), len(nb)); c != 0 {
+				return c
+			}
+			if c := strings.Compare(na, nb); c != 0 {
+				return c
+			}
+			a, b = a[da:], b[db:]
+			continue
+		}
+
+		ra, sa := utf8.DecodeRuneInString(a)
+		rb, sb := utf8.DecodeRuneInString(b)
+		if ra != rb {
+			return cmp.Compare(ra, rb)
+		}
+		a, b = a[sa:], b[sb:]
+	}
+	return cmp.Compare(len(a), len(b))
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// digits returns the length of the run of digits at the start of s.
+func digits(s string) int {
+	i := 0
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	return i
+}
+
+// modTime returns when a file was last modified, or the zero time if it's
+// gone.
+func modTime(f fs.DirEntry) time.Time {
+	info, err := f.Info()
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// sortItems puts the items in order first, in that order, followed by the
+// rest sorted by mode. Names in order that aren't in the folder are ignored.
+// An unknown mode, which Presentation.validate reports, sorts by name.
+func sortItems(items []Item, mode string, order []string) {
+
+	pinned := make(map[string]int, len(order))
+	for i, name := range order {
+		if _, ok := pinned[name]; !ok {
+			pinned[name] = i
+		}
+	}
+
+	times := make(map[string]time.Time, len(items))
+	if mode != sortName {
+		for _, item := range items {
+			times[item.Visual.Name()] = modTime(item.Visual)
+		}
+	}
+
+	slices.SortStableFunc(items, func(a, b Item) int {
+		an, bn := a.Visual.Name(), b.Visual.Name()
+		ai, aPinned := pinned[an]
+		bi, bPinned := pinned[bn]
+		switch {
+		case aPinned && bPinned:
+			return cmp.Compare(ai, bi)
+		case aPinned:
+			return -1
+		case bPinned:
+			return 1
+		}
+
+		var c int
+		switch mode {
+		case sortModified:
+			c = times[an].Compare(times[bn])
+		case sortNewest:
+			c = times[bn].Compare(times[an])
+		}
+		if c == 0 {
+			c = naturalCompare(an, bn)
+		}
+		if c == 0 {
+			c = strings.Compare(an, bn)
+		}
+		return c
+	})
+}
+
+// dir returns the folder the items are read from.
+func (p *Playlist) dir() string {
+	if folder := p.folder(); folder != "" {
+		return filepath.Join(p.root(), filepath.FromSlash(folder))
+	}
+	return p.root()
+}
+
+// orderInfo returns the sort mode and order of the folder that's playing.
+func (p *Playlist) orderInfo() orderInfo {
+	info := orderInfo{Sort: sortName, Order: []string{}}
+	if playlistFormat(p.folder()) != "" {
+		info.File = true
+		return info
+	}
+
+	data, err := os.ReadFile(filepath.Join(p.dir(), presentationFile))
+	if err != nil {
+		return info
+	}
+	presentation, _ := parsePresentation(data)
+	if slices.Contains(sortModes, presentation.Sort) {
+		info.Sort = presentation.Sort
+	}
+	if presentation.Order != nil {
+		info.Order = presentation.Order
+	}
+	return info
+}
+
+// updatePresentation changes the fields in the presentation.json of the
+// folder that's playing, keeping the ones it doesn't know about, and tells
+// the viewer and control pages to get the items in their new order.
+// A remote mount's folder is replaced by its content source when it syncs,
+// so the order is set in its manifest instead.
+func (p *Playlist) updatePresentation(plr *Player, fields map[string]any) error {
+	if folder := p.folder(); playlistFormat(folder) != "" {
+		return fmt.Errorf("the order of %s is set in the playlist file", folder)
+	}
+	if conf := plr.config(); conf.Mount.remote() && p.root() == conf.Mount.Dir {
+		return fmt.Errorf("the order of %s is set by its content source, it would be replaced by the next sync", redactURL(conf.Mount.URL.URL))
+	}
+	file := filepath.Join(p.dir(), presentationFile)
+
+	presentation := map[string]json.RawMessage{}
+	data, err := os.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &presentation); err != nil {
+			return fmt.Errorf("can't change %s, it isn't valid JSON: %w", file, err)
+		}
+	}
+
+	for k, v := range fields {
+		if v == nil {
+			delete(presentation, k)
+			continue
+		}
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		presentation[k] = raw
+	}
+
+	data, err = json.MarshalIndent(presentation, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(file, data, 0644); err != nil {
+		return err
+	}
+	if err := p.fromFolder(plr, p.root()); err != nil {
+		return err
+	}
+
+	items := wsMessage{
+		Component: "playlist",
+		Event:     "newItems",
+		Message:   "playlist order changed. Get new items.",
+	}
+	plr.ConnViewer.enqueue(items)
+	plr.ConnControl.enqueue(items)
+	return nil
+}
+
+// setOrder pins the items named in order to the top of the playlist, in that
+// order. An empty order unpins them all.
+func (p *Playlist) setOrder(plr *Player, order []string) error {
+	var names []string
+	for _, name := range order {
+		name = strings.TrimSpace(name)
+		if name == "" || slices.Contains(names, name) {
+			continue
+		}
+		if !validFileName(name) {
+			return fmt.Errorf("invalid file name %q in the order", name)
+		}
+		names = append(names, name)
+	}
+
+	var value any
+	if len(names) > 0 {
+		value = names
+	}
+	return p.updatePresentation(plr, map[string]any{"Order": value})
+}
+
+// setSort sorts the items by mode. The items pinned with setOrder stay first.
+func (p *Playlist) setSort(plr *Player, mode string) error {
+	if !slices.Contains(sortModes, mode) {
+		return fmt.Errorf("unknown sort mode %q, must be one of %s", mode, strings.Join(sortModes, ", "))
+	}
+
+	var value any
+	if mode != sortName {
+		value = mode
+	}
+	return p.updatePresentation(plr, map[string]any{"Sort": value})
+}
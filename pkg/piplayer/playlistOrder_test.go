@@ -0,0 +1,165 @@
+package piplayer
+
+import (
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNaturalCompare(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"2 Welcome.mp4", "10 Announcements.mp4", -1},
+		{"song10.mp4", "song9.mp4", 1},
+		{"Song1.mp4", "song1.mp4", 0},
+		{"007.jpg", "7.jpg", 0},
+		{"a.jpg", "ab.jpg", -1},
+		{"intro.mp4", "10.mp4", 1},
+	}
+	for _, tt := range tests {
+		if got := naturalCompare(tt.a, tt.b); got != tt.want {
+			t.Errorf("naturalCompare(%q, %q) got %d want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+// orderPlayer returns a player with items whose names and modification
+// times sort differently.
+func orderPlayer(t *testing.T) *Player {
+	conf := validConfig(t)
+	start := time.Now().Add(-time.Hour)
+	for i, name := range []string{"10 Announcements.mp4", "2 Welcome.jpg", "1 Countdown.mp4"} {
+		path := writeMedia(t, conf.Mount.Dir, name, 1)
+		mod := start.Add(time.Duration(i) * time.Minute)
+		if err := os.Chtimes(path, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return reloadPlayer(t, conf)
+}
+
+func itemNames(p *Player) []string {
+	var names []string
+	for _, item := range p.playlist.Items {
+		names = append(names, item.Visual.Name())
+	}
+	return names
+}
+
+func TestSortModes(t *testing.T) {
+	p := orderPlayer(t)
+	if err := p.playlist.fromFolder(p, p.playlist.root()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"1 Countdown.mp4", "2 Welcome.jpg", "10 Announcements.mp4"}
+	if got := itemNames(p); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v by name want %v", got, want)
+	}
+
+	if err := p.playlist.setSort(p, sortNewest); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"1 Countdown.mp4", "2 Welcome.jpg", "10 Announcements.mp4"}
+	if got := itemNames(p); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v newest first want %v", got, want)
+	}
+
+	if err := p.playlist.setSort(p, sortModified); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"10 Announcements.mp4", "2 Welcome.jpg", "1 Countdown.mp4"}
+	if got := itemNames(p); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v oldest first want %v", got, want)
+	}
+
+	if err := p.playlist.setSort(p, "random"); err == nil {
+		t.Error("got nil error for an unknown sort mode")
+	}
+}
+
+func TestSetOrder(t *testing.T) {
+	p := orderPlayer(t)
+	file := filepath.Join(p.config().Mount.Dir, presentationFile)
+	cues := `{"Items":[{"Visual":"2 Welcome.jpg","Cues":{"clear":"audio"}}],"Sort":"modified"}`
+	if err := os.WriteFile(file, []byte(cues), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unlisted items follow, oldest first. Names that aren't in the folder
+	// are ignored.
+	if err := p.playlist.setOrder(p, []string{"2 Welcome.jpg", "gone.mp4", "", "gone.mp4"}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"2 Welcome.jpg", "10 Announcements.mp4", "1 Countdown.mp4"}
+	if got := itemNames(p); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+	if !p.playlist.Items[0].Cues.ClearAudio {
+		t.Error("lost the cues in presentation.json")
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var presentation Presentation
+	if err := json.Unmarshal(data, &presentation); err != nil {
+		t.Fatal(err)
+	}
+	if presentation.Sort != sortModified || len(presentation.Items) != 1 ||
+		!reflect.DeepEqual(presentation.Order, []string{"2 Welcome.jpg", "gone.mp4"}) {
+		t.Errorf("got presentation.json %s", data)
+	}
+
+	if info := p.playlist.orderInfo(); info.Sort != sortModified || len(info.Order) != 2 {
+		t.Errorf("got %+v", info)
+	}
+
+	if err := p.playlist.setOrder(p, []string{"../config.json"}); err == nil {
+		t.Error("got nil error for a path in the order")
+	}
+
+	// Sorting keeps the pinned items first.
+	if err := p.playlist.setSort(p, sortName); err != nil {
+		t.Fatal(err)
+	}
+	if info := p.playlist.orderInfo(); info.Sort != sortName || len(info.Order) != 2 {
+		t.Errorf("got %+v after sorting by name, want the order kept", info)
+	}
+	want = []string{"2 Welcome.jpg", "1 Countdown.mp4", "10 Announcements.mp4"}
+	if got := itemNames(p); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+
+	// An empty order unpins them all.
+	if err := p.playlist.setOrder(p, nil); err != nil {
+		t.Fatal(err)
+	}
+	if info := p.playlist.orderInfo(); len(info.Order) != 0 {
+		t.Errorf("got %+v want no order", info)
+	}
+}
+
+func TestSetOrderRemoteMount(t *testing.T) {
+	p := orderPlayer(t)
+	conf := *p.config()
+	conf.Mount.URL = sURL{URL: &url.URL{Scheme: "https", Host: "media.example.com", Path: "/manifest.json"}}
+	p.conf.Store(&conf)
+
+	if err := p.playlist.setOrder(p, []string{"2 Welcome.jpg"}); err == nil {
+		t.Error("got nil error setting the order of a synced folder")
+	}
+	if err := p.playlist.setSort(p, sortNewest); err == nil {
+		t.Error("got nil error setting the sort of a synced folder")
+	}
+	if _, err := os.Stat(filepath.Join(conf.Mount.Dir, presentationFile)); !os.IsNotExist(err) {
+		t.Errorf("got %v want no presentation.json in the synced folder", err)
+	}
+}
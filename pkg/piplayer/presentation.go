@@ -0,0 +1,394 @@
+package piplayer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// presentationVersion is the version of the presentation.json format
+// described by the schema. Files without a Version are version 1.
+const presentationVersion = 2
+
+var (
+	supportedTransitions = []string{"cut", "fade"}
+	matchModes           = []string{"name", "regex"}
+)
+
+// Presentation is used to read the presentation.json file for added cues,
+// and the order of the items.
+type Presentation struct {
+	// Version of the format. Empty is version 1, see presentationV1.
+	Version int `json:",omitempty"`
+	Items   []PresentationItem
+	// Sort is how items that aren't in Order are sorted, see sortModes.
+	// Empty sorts by name.
+	Sort string `json:",omitempty"`
+	// Order is the file names of the items that are played first, in order.
+	Order []string `json:",omitempty"`
+	// Mode is what happens when an item finishes, see playModes. Empty
+	// repeats the playlist, or holds on the last item if the profile is set
+	// to stop at the end.
+	Mode string `json:",omitempty"`
+	// Shuffle plays the items in a random order.
+	Shuffle bool `json:",omitempty"`
+}
+
+// PresentationItem adds cues to the items it matches.
+type PresentationItem struct {
+	// Visual is the file name of the item, or a regular expression if Match
+	// is "regex".
+	Visual string
+	// Match is how Visual is matched, see matchModes. Empty is "name".
+	Match string `json:",omitempty"`
+	Cues  Cues
+}
+
+// Cues change how an item is played.
+type Cues struct {
+	// Timeout is how many seconds the item plays before the next one is
+	// started. 0 waits for the end of a video, or forever for an image.
+	Timeout int `json:",omitempty"`
+	// ClearAudio stops the music of the previous item.
+	ClearAudio bool `json:",omitempty"`
+	// Loop repeats a video until the next item is started. The music of an
+	// image always repeats.
+	Loop bool `json:",omitempty"`
+	// Transition is how the item appears, see supportedTransitions. Empty
+	// cuts.
+	Transition string `json:",omitempty"`
+	// Volume is the volume the item starts at, from 0 to 100. Nil leaves it
+	// as it is.
+	Volume *int `json:",omitempty"`
+	// Notes are shown on the control page while the item plays.
+	Notes string `json:",omitempty"`
+}
+
+// presentationV1 is the format before it had a version. Cues were strings,
+// and Visual was matched as a regular expression, or as the file name if it
+// wasn't a valid one.
+type presentationV1 struct {
+	Items []struct {
+		Visual string
+		Cues   map[string]string
+	}
+	Sort  string
+	Order []string
+}
+
+// presentationInfo is the presentation.json of the folder that's playing, or
+// the playlist file, and the problems found in it.
+type presentationInfo struct {
+	File     string       `json:"file"`
+	Version  int          `json:"version,omitempty"`
+	Mode     string       `json:"mode,omitempty"`
+	Shuffle  bool         `json:"shuffle,omitempty"`
+	Problems []FieldError `json:"problems"`
+}
+
+// merge sets the cues that are set in o.
+func (c *Cues) merge(o Cues) {
+	if o.Timeout != 0 {
+		c.Timeout = o.Timeout
+	}
+	c.ClearAudio = c.ClearAudio || o.ClearAudio
+	c.Loop = c.Loop || o.Loop
+	if o.Transition != "" {
+		c.Transition = o.Transition
+	}
+	if o.Volume != nil {
+		v := *o.Volume
+		c.Volume = &v
+	}
+	if o.Notes != "" {
+		c.Notes = o.Notes
+	}
+}
+
+func (c Cues) validate(field string, errs *ConfigError) {
+	if c.Timeout < 0 {
+		errs.add(field+".Timeout", "can't be negative, got %d", c.Timeout)
+	}
+	if c.Transition != "" && !slices.Contains(supportedTransitions, c.Transition) {
+		errs.add(field+".Transition", "must be one of %s, got %q", strings.Join(supportedTransitions, ", "), c.Transition)
+	}
+	if c.Volume != nil && (*c.Volume < 0 || *c.Volume > 100) {
+		errs.add(field+".Volume", "must be from 0 to 100, got %d", *c.Volume)
+	}
+}
+
+func (item PresentationItem) validate(field string, errs *ConfigError) {
+	if item.Visual == "" {
+		errs.add(field+".Visual", "can't be empty")
+	}
+	switch item.Match {
+	case "", "name":
+	case "regex":
+		if _, err := regexp.Compile(item.Visual); err != nil {
+			errs.add(field+".Visual", "isn't a valid regular expression: %v", err)
+		}
+	default:
+		errs.add(field+".Match", "must be one of %s, got %q", strings.Join(matchModes, ", "), item.Match)
+	}
+	item.Cues.validate(field+".Cues", errs)
+}
+
+// validate records the problems in a presentation in errs.
+func (pr Presentation) validate(errs *ConfigError) {
+	if pr.Version < 0 || pr.Version > presentationVersion {
+		errs.add("Version", "unsupported, must be from 1 to %d, got %d", presentationVersion, pr.Version)
+	}
+	if pr.Sort != "" && !slices.Contains(sortModes, pr.Sort) {
+		errs.add("Sort", "must be one of %s, got %q", strings.Join(sortModes, ", "), pr.Sort)
+	}
+	if pr.Mode != "" && !slices.Contains(playModes, pr.Mode) {
+		errs.add("Mode", "must be one of %s, got %q", strings.Join(playModes, ", "), pr.Mode)
+	}
+	for i, name := range pr.Order {
+		if !validFileName(name) {
+			errs.add(fmt.Sprintf("Order[%d]", i), "must be a file name, got %q", name)
+		}
+	}
+	for i, item := range pr.Items {
+		item.validate(fmt.Sprintf("Items[%d]", i), errs)
+	}
+}
+
+// upgrade converts a version 1 presentation, recording the cues it can't
+// convert in errs.
+func (v1 presentationV1) upgrade(errs *ConfigError) Presentation {
+	pr := Presentation{Version: 1, Sort: v1.Sort, Order: v1.Order}
+
+	for i, old := range v1.Items {
+		field := fmt.Sprintf("Items[%d]", i)
+		item := PresentationItem{Visual: old.Visual, Match: "regex"}
+		if _, err := regexp.Compile(old.Visual); err != nil {
+			errs.add(field+".Visual", "isn't a valid regular expression, matching the file name exactly: %v", err)
+			item.Match = "name"
+		}
+
+		for _, k := range slices.Sorted(maps.Keys(old.Cues)) {
+			v := old.Cues[k]
+			switch k {
+			case "timeout":
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					errs.add(field+".Cues.timeout", "must be a number of seconds, got %q", v)
+					continue
+				}
+				item.Cues.Timeout = n
+			case "clear":
+				if v != "audio" {
+					errs.add(field+".Cues.clear", "must be \"audio\", got %q", v)
+					continue
+				}
+				item.Cues.ClearAudio = true
+			default:
+				errs.add(field+".Cues."+k, "unknown cue, version 1 only has timeout and clear")
+			}
+		}
+		pr.Items = append(pr.Items, item)
+	}
+
+	return pr
+}
+
+// parsePresentation reads a presentation.json of any version. Problems are
+// returned with the entry they're in. Entries with problems are left out
+// when the presentation is applied, but the rest of it is still used. If the
+// file isn't valid JSON, the presentation is empty.
+func parsePresentation(data []byte) (Presentation, []FieldError) {
+	errs := &ConfigError{}
+
+	var header struct{ Version int }
+	if err := json.Unmarshal(data, &header); err != nil {
+		errs.Problems = append(errs.Problems, jsonProblem(data, err))
+		var syntax *json.SyntaxError
+		if errors.As(err, &syntax) {
+			return Presentation{}, errs.Problems
+		}
+	}
+
+	var pr Presentation
+	if header.Version <= 1 {
+		var v1 presentationV1
+		if err := json.Unmarshal(data, &v1); err != nil {
+			errs.Problems = append(errs.Problems, jsonProblem(data, err))
+		}
+		pr = v1.upgrade(errs)
+	} else {
+		if err := json.Unmarshal(data, &pr); err != nil {
+			errs.Problems = append(errs.Problems, jsonProblem(data, err))
+		}
+		// Catch misspelt fields, which would otherwise be ignored.
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&Presentation{}); err != nil && strings.Contains(err.Error(), "unknown field") {
+			_, name, _ := strings.Cut(err.Error(), "unknown field ")
+			line, _ := position(data, int64(bytes.Index(data, []byte(name))))
+			errs.add(presentationFile, "line %d: unknown field %s", line, name)
+		}
+	}
+
+	pr.validate(errs)
+	return pr, errs.Problems
+}
+
+// jsonIndex matches the array indexes in the fields of decoding errors, eg:
+// the 0 in Items.0.Cues, so they can be written like Items[0].Cues.
+var jsonIndex = regexp.MustCompile(`\.([0-9]+)`)
+
+// jsonProblem describes an error decoding data, with the line it's on.
+func jsonProblem(data []byte, err error) FieldError {
+	var syntax *json.SyntaxError
+	var typ *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntax):
+		// Offset is just after the character that's wrong.
+		line, col := position(data, syntax.Offset-1)
+		return FieldError{Field: fmt.Sprintf("line %d", line), Message: fmt.Sprintf("column %d: %v", col, syntax)}
+	case errors.As(err, &typ):
+		line, _ := position(data, typ.Offset)
+		return FieldError{Field: jsonIndex.ReplaceAllString(typ.Field, "[$1]"), Message: fmt.Sprintf("line %d: must be %s, got %s", line, typ.Type, typ.Value)}
+	}
+	return FieldError{Field: "presentation.json", Message: strings.TrimPrefix(err.Error(), "json: ")}
+}
+
+// position returns the line and column of offset in data, counting from 1.
+func position(data []byte, offset int64) (int, int) {
+	offset = min(max(offset, 0), int64(len(data)))
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	col := len(before) - bytes.LastIndexByte(before, '\n')
+	return line, col
+}
+
+// apply adds the cues of the entries to the items they match. Entries with
+// problems are skipped.
+func (pr Presentation) apply(items []Item) {
+	for i, entry := range pr.Items {
+		errs := &ConfigError{}
+		entry.validate(fmt.Sprintf("Items[%d]", i), errs)
+		if len(errs.Problems) > 0 {
+			continue
+		}
+
+		match := func(name string) bool { return name == entry.Visual }
+		if entry.Match == "regex" {
+			match = regexp.MustCompile(entry.Visual).MatchString
+		}
+		for j := range items {
+			if match(items[j].Visual.Name()) {
+				items[j].Cues.merge(entry.Cues)
+			}
+		}
+	}
+}
+
+// readPresentation reads the presentation.json in dir, logging its problems.
+// A missing file is an empty presentation.
+func readPresentation(dir string) (Presentation, presentationInfo) {
+	file := filepath.Join(dir, presentationFile)
+	info := presentationInfo{File: file, Version: presentationVersion, Problems: []FieldError{}}
+
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return Presentation{}, info
+	}
+	if err != nil {
+		log.Printf("Error trying to read presentation file '%s': %v", file, err)
+		info.Problems = append(info.Problems, FieldError{Field: presentationFile, Message: err.Error()})
+		return Presentation{}, info
+	}
+
+	pr, problems := parsePresentation(data)
+	info.Version = max(pr.Version, 1)
+	if slices.Contains(playModes, pr.Mode) {
+		info.Mode = pr.Mode
+	}
+	info.Shuffle = pr.Shuffle
+	info.Problems = append(info.Problems, problems...)
+	for _, p := range problems {
+		log.Printf("problem in presentation file '%s': %v\n", file, p)
+	}
+	return pr, info
+}
+
+func (p *Playlist) setPresentation(info presentationInfo) {
+	p.folderMu.Lock()
+	defer p.folderMu.Unlock()
+	p.presentation = info
+}
+
+// presentationInfo returns the presentation.json the items were last read
+// with, and the problems in it.
+func (p *Playlist) presentationInfo() presentationInfo {
+	p.folderMu.Lock()
+	defer p.folderMu.Unlock()
+	return p.presentation
+}
+
+// presentationSchema returns the JSON Schema for version 2 of
+// presentation.json.
+func presentationSchema() map[string]interface{} {
+	str := map[string]interface{}{"type": "string"}
+	cues := map[string]interface{}{
+		"type":                 "object",
+		"additionalProperties": false,
+		"properties": map[string]interface{}{
+			"Timeout":    map[string]interface{}{"type": "integer", "minimum": 0, "description": "Seconds the item plays before the next one starts."},
+			"ClearAudio": map[string]interface{}{"type": "boolean", "description": "Stop the music of the previous item."},
+			"Loop":       map[string]interface{}{"type": "boolean", "description": "Repeat a video until the next item."},
+			"Transition": map[string]interface{}{"enum": supportedTransitions, "description": "How the item appears."},
+			"Volume":     map[string]interface{}{"type": "integer", "minimum": 0, "maximum": 100, "description": "Volume the item starts at."},
+			"Notes":      map[string]interface{}{"type": "string", "description": "Shown on the control page while the item plays."},
+		},
+	}
+	item := map[string]interface{}{
+		"type":                 "object",
+		"additionalProperties": false,
+		"required":             []string{"Visual"},
+		"properties": map[string]interface{}{
+			"Visual": map[string]interface{}{"type": "string", "minLength": 1, "description": "File name, or a regular expression if Match is regex."},
+			"Match":  map[string]interface{}{"enum": matchModes},
+			"Cues":   cues,
+		},
+	}
+
+	return map[string]interface{}{
+		"$schema":              "https://json-schema.org/draft/2020-12/schema",
+		"$id":                  "/api/schema/presentation",
+		"title":                fmt.Sprintf("pi-player presentation.json, version %d", presentationVersion),
+		"type":                 "object",
+		"additionalProperties": false,
+		"required":             []string{"Version"},
+		"properties": map[string]interface{}{
+			"Version": map[string]interface{}{"const": presentationVersion},
+			"Items":   map[string]interface{}{"type": "array", "items": item},
+			"Sort":    map[string]interface{}{"enum": sortModes},
+			"Order":   map[string]interface{}{"type": "array", "items": str},
+			"Mode":    map[string]interface{}{"enum": playModes, "description": "What happens when an item finishes."},
+			"Shuffle": map[string]interface{}{"type": "boolean", "description": "Play the items in a random order."},
+		},
+	}
+}
+
+// PresentationSchemaHandler serves the JSON Schema for presentation.json.
+func PresentationSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(presentationSchema()); err != nil {
+		log.Println("error trying to write presentation schema:", err)
+	}
+}
@@ -0,0 +1,141 @@
+package piplayer
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func problemFields(problems []FieldError) []string {
+	var fields []string
+	for _, p := range problems {
+		fields = append(fields, p.Field)
+	}
+	return fields
+}
+
+func TestParsePresentationV2(t *testing.T) {
+	data := `{
+  "Version": 2,
+  "Items": [
+    {"Visual": "intro.mp4", "Cues": {"Loop": true, "Volume": 0, "Transition": "fade", "Notes": "Welcome everyone"}},
+    {"Visual": "^slide", "Match": "regex", "Cues": {"Timeout": 8, "ClearAudio": true}},
+    {"Visual": "(", "Match": "regex"},
+    {"Visual": "loud.mp4", "Cues": {"Volume": 150, "Transition": "wipe"}},
+    {"Visual": "", "Match": "glob", "Cues": {"Timout": 3}}
+  ],
+  "Sort": "random",
+  "Order": ["../intro.mp4"]
+}`
+
+	pr, problems := parsePresentation([]byte(data))
+
+	want := []string{
+		"presentation.json",
+		"Sort",
+		"Order[0]",
+		"Items[2].Visual",
+		"Items[3].Cues.Transition",
+		"Items[3].Cues.Volume",
+		"Items[4].Visual",
+		"Items[4].Match",
+	}
+	if got := problemFields(problems); !reflect.DeepEqual(got, want) {
+		t.Errorf("got problems in %v want %v", got, want)
+	}
+	if msg := problems[0].Message; !strings.Contains(msg, `"Timout"`) || !strings.HasPrefix(msg, "line 8:") {
+		t.Errorf("got %q want the misspelt field", problems[0].Message)
+	}
+	if len(pr.Items) != 5 || pr.Items[0].Cues.Volume == nil || *pr.Items[0].Cues.Volume != 0 {
+		t.Errorf("got %+v", pr.Items)
+	}
+}
+
+func TestParsePresentationReportsPosition(t *testing.T) {
+	tests := []struct {
+		data    string
+		field   string
+		message string
+	}{
+		{"{\n  \"Version\": 2,\n  \"Items\": [}\n", "line 3", "column 13"},
+		{"{\"Version\": 2,\n\"Items\": [{\"Visual\": \"a.jpg\", \"Cues\": {\"Timeout\": \"ten\"}}]}", "Items[0].Cues.Timeout", "line 2"},
+	}
+	for _, tt := range tests {
+		_, problems := parsePresentation([]byte(tt.data))
+		if len(problems) == 0 || problems[0].Field != tt.field || !strings.Contains(problems[0].Message, tt.message) {
+			t.Errorf("got %v want %s: %s...", problems, tt.field, tt.message)
+		}
+	}
+}
+
+func TestParsePresentationV1(t *testing.T) {
+	data := `{"Items": [
+  {"Visual": "slide.*", "Cues": {"timeout": "5", "clear": "audio"}},
+  {"Visual": "song(1.mp4", "Cues": {"timeout": "soon", "fade": "yes"}}
+]}`
+
+	pr, problems := parsePresentation([]byte(data))
+
+	want := []string{"Items[1].Visual", "Items[1].Cues.fade", "Items[1].Cues.timeout"}
+	if got := problemFields(problems); !reflect.DeepEqual(got, want) {
+		t.Errorf("got problems in %v want %v", got, want)
+	}
+	wantItems := []PresentationItem{
+		{Visual: "slide.*", Match: "regex", Cues: Cues{Timeout: 5, ClearAudio: true}},
+		{Visual: "song(1.mp4", Match: "name"},
+	}
+	if pr.Version != 1 || !reflect.DeepEqual(pr.Items, wantItems) {
+		t.Errorf("got version %d with %+v want 1 with %+v", pr.Version, pr.Items, wantItems)
+	}
+}
+
+func TestPresentationApply(t *testing.T) {
+	conf := validConfig(t)
+	for _, name := range []string{"intro.mp4", "slide1.jpg", "slide2.jpg"} {
+		writeMedia(t, conf.Mount.Dir, name, 1)
+	}
+	data := `{"Version": 2, "Items": [
+  {"Visual": "^slide", "Match": "regex", "Cues": {"Timeout": 8}},
+  {"Visual": "slide2.jpg", "Cues": {"Notes": "Last slide", "Volume": 101}},
+  {"Visual": "slide2.jpg", "Cues": {"ClearAudio": true}}
+]}`
+	if err := os.WriteFile(filepath.Join(conf.Mount.Dir, presentationFile), []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p := reloadPlayer(t, conf)
+
+	if err := p.playlist.fromFolder(p, p.playlist.Name); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Cues{{}, {Timeout: 8}, {Timeout: 8, ClearAudio: true}}
+	for i, item := range p.playlist.Items {
+		if !reflect.DeepEqual(item.Cues, want[i]) {
+			t.Errorf("got %s cues %+v want %+v", item.Visual.Name(), item.Cues, want[i])
+		}
+	}
+
+	info := p.playlist.presentationInfo()
+	if info.Version != 2 || !reflect.DeepEqual(problemFields(info.Problems), []string{"Items[1].Cues.Volume"}) {
+		t.Errorf("got %+v", info)
+	}
+}
+
+func TestPresentationSchemaCoversCues(t *testing.T) {
+	schema := presentationSchema()
+	item := schema["properties"].(map[string]interface{})["Items"].(map[string]interface{})["items"].(map[string]interface{})
+	cues := item["properties"].(map[string]interface{})["Cues"].(map[string]interface{})["properties"].(map[string]interface{})
+
+	rt := reflect.TypeOf(Cues{})
+	for i := range rt.NumField() {
+		name := rt.Field(i).Name
+		if _, ok := cues[name]; !ok {
+			t.Errorf("schema is missing cue %s", name)
+		}
+	}
+	if len(cues) != rt.NumField() {
+		t.Errorf("got %d cues in the schema want %d", len(cues), rt.NumField())
+	}
+}
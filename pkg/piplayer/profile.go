@@ -0,0 +1,152 @@
+package piplayer
+
+import (
+	"fmt"
+	"log"
+)
+
+// Profile is a named set of settings for an event, eg: "Sunday service" or
+// "Lobby loop". The fields a profile sets are used in place of the settings
+// in config.json while it's active, which are kept for when it isn't.
+// Fields that are left empty use the settings.
+type Profile struct {
+	Name        string
+	Location    string           `json:",omitempty"`
+	Mount       *mount           `json:",omitempty"`
+	AudioOutput string           `json:",omitempty"`
+	Streamer    string           `json:",omitempty"`
+	Playlist    *PlaylistOptions `json:",omitempty"`
+	// Key is the remote key that switches to this profile, eg: KEY_F1.
+	Key string `json:",omitempty"`
+}
+
+// PlaylistOptions change how the playlist is played.
+type PlaylistOptions struct {
+	// StopAtEnd stops on the last item when it finishes, instead of going
+	// back to the first item.
+	StopAtEnd bool
+}
+
+// profileInfo is sent to the viewer and control pages when the profile changes.
+type profileInfo struct {
+	Name      string `json:"name"`
+	Location  string `json:"location"`
+	StopAtEnd bool   `json:"stopAtEnd"`
+}
+
+// findProfile returns the profile with the name.
+func (conf *Config) findProfile(name string) (Profile, bool) {
+	for _, prof := range conf.Profiles {
+		if prof.Name == name {
+			return prof, true
+		}
+	}
+	return Profile{}, false
+}
+
+// profileForKey returns the name of the profile switched to by the remote key,
+// or "" if there isn't one.
+func (conf *Config) profileForKey(key string) string {
+	for _, prof := range conf.Profiles {
+		if prof.Key != "" && prof.Key == key {
+			return prof.Name
+		}
+	}
+	return ""
+}
+
+// useProfile copies the fields set in the named profile into the config.
+func (conf *Config) useProfile(name string) error {
+	prof, ok := conf.findProfile(name)
+	if !ok {
+		return fmt.Errorf("no profile named %q", name)
+	}
+
+	if prof.Location != "" {
+		conf.Location = prof.Location
+	}
+	if prof.Mount != nil {
+		conf.Mount = newMount(prof.Mount.URL.URL)
+	}
+	if prof.AudioOutput != "" {
+		conf.AudioOutput = prof.AudioOutput
+	}
+	if prof.Streamer != "" {
+		conf.Streamer = prof.Streamer
+	}
+	if prof.Playlist != nil {
+		conf.Playlist = *prof.Playlist
+	}
+	conf.ActiveProfile = name
+
+	return nil
+}
+
+func (conf *Config) profileInfo() profileInfo {
+	return profileInfo{
+		Name:      conf.ActiveProfile,
+		Location:  conf.Location,
+		StopAtEnd: conf.Playlist.StopAtEnd,
+	}
+}
+
+// switchProfile switches the running config to the named profile, and saves
+// it as the active profile. Only the name is saved, the settings the profile
+// replaces are kept. Flags and environment variables still take precedence
+// over the profile.
+func (p *Player) switchProfile(name string) error {
+	p.configMu.Lock()
+	defer p.configMu.Unlock()
+
+	newFile := *p.config().fileConfig()
+	newFile.ActiveProfile = name
+	newConf, err := newFile.running(name, p.config().overrides)
+	if err != nil {
+		return err
+	}
+
+	if err := newConf.Validate(); err != nil {
+		return fmt.Errorf("profile %q: %w", name, err)
+	}
+
+	if err := newFile.Save(); err != nil {
+		return fmt.Errorf("error saving config with profile %q: %w", name, err)
+	}
+
+	log.Printf("Switched to profile %q\n", name)
+	p.applyConfig(newConf)
+
+	return nil
+}
+
+// handleProfileAPI handles requests to the profile api.
+func handleProfileAPI(p *Player, req reqMessage) resMessage {
+	switch req.Method {
+	case "list":
+		names := make([]string, len(p.config().Profiles))
+		for i, prof := range p.config().Profiles {
+			names[i] = prof.Name
+		}
+		return resMessage{
+			Success: true,
+			Event:   "profiles",
+			Message: map[string]interface{}{
+				"profiles": names,
+				"active":   p.config().ActiveProfile,
+			},
+		}
+	case "switch":
+		var args profileArgs
+		if err := decodeArgs(req.Arguments, &args); err != nil {
+			return apiError(err.Error())
+		}
+
+		if err := p.switchProfile(args.Name); err != nil {
+			return apiError(err.Error())
+		}
+
+		return resMessage{Success: true, Event: "switched", Message: p.config().profileInfo()}
+	}
+
+	return apiError("Method not supported: " + req.Method)
+}
@@ -0,0 +1,138 @@
+package piplayer
+
+import (
+	"errors"
+	"flag"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func profileConfig(t *testing.T) Config {
+	conf := validConfig(t)
+	lobby := t.TempDir()
+	conf.Profiles = []Profile{
+		{Name: "Sunday service", Location: "Auditorium", AudioOutput: "hdmi"},
+		{
+			Name:     "Lobby loop",
+			Mount:    &mount{URL: sURL{URL: &url.URL{Path: lobby}}},
+			Playlist: &PlaylistOptions{StopAtEnd: true},
+			Key:      "KEY_F2",
+		},
+	}
+	return conf
+}
+
+func TestUseProfile(t *testing.T) {
+	conf := profileConfig(t)
+	want := conf
+	want.Mount = mount{URL: conf.Profiles[1].Mount.URL, Dir: conf.Profiles[1].Mount.URL.Path}
+	want.Playlist = PlaylistOptions{StopAtEnd: true}
+	want.ActiveProfile = "Lobby loop"
+
+	if err := conf.useProfile(conf.profileForKey("KEY_F2")); err != nil {
+		t.Fatalf("got error %v want nil", err)
+	}
+
+	if !reflect.DeepEqual(conf, want) {
+		t.Errorf("got %+v want %+v", conf, want)
+	}
+	if err := conf.Validate(); err != nil {
+		t.Errorf("got error %v want nil", err)
+	}
+
+	if err := conf.useProfile("Kids church"); err == nil {
+		t.Error("got nil error for a profile that doesn't exist")
+	}
+}
+
+// profileOverrides returns overrides parsed from args, without any from the
+// environment.
+func profileOverrides(t *testing.T, args ...string) *Overrides {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	o := NewOverrides(fs)
+	o.getenv = func(string) (string, bool) { return "", false }
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+func TestOverridesTakePrecedenceOverProfile(t *testing.T) {
+	file := profileConfig(t)
+	o := profileOverrides(t, "-audio-output", "local", "-profile", "Sunday service")
+
+	conf, err := file.running(o.startProfile(&file), o)
+	if err != nil {
+		t.Fatalf("got error %v want nil", err)
+	}
+
+	if conf.Location != "Auditorium" || conf.AudioOutput != "local" {
+		t.Errorf("got location %q audio output %q want %q and %q", conf.Location, conf.AudioOutput, "Auditorium", "local")
+	}
+	if got := conf.fileConfig(); got.Location != file.Location || got.AudioOutput != file.AudioOutput || got.ActiveProfile != "" {
+		t.Errorf("profile or overrides leaked into the file config: %+v", got)
+	}
+}
+
+func TestRunningConfigKeepsSwitchedProfile(t *testing.T) {
+	file := profileConfig(t)
+	o := profileOverrides(t, "-profile", "Sunday service")
+	conf, err := file.running(o.startProfile(&file), o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := reloadPlayer(t, conf)
+
+	// Reloading the same file keeps the profile from the flag.
+	got, err := p.runningConfig(&file)
+	if err != nil {
+		t.Fatalf("got error %v want nil", err)
+	}
+	if got.ActiveProfile != "Sunday service" || got.Location != "Auditorium" {
+		t.Errorf("got profile %q location %q want %q and %q", got.ActiveProfile, got.Location, "Sunday service", "Auditorium")
+	}
+
+	// A profile switched to while running wins over the flag.
+	switched := file
+	switched.ActiveProfile = "Lobby loop"
+	if got, err = p.runningConfig(&switched); err != nil {
+		t.Fatalf("got error %v want nil", err)
+	}
+	if got.ActiveProfile != "Lobby loop" || got.Location != file.Location || !got.Playlist.StopAtEnd {
+		t.Errorf("got %+v want the lobby loop profile on top of the file", got)
+	}
+	if got.Mount.Dir != file.Profiles[1].Mount.URL.Path || got.fileConfig().Mount.URL.String() != file.Mount.URL.String() {
+		t.Errorf("got mount %s in %s and %s in the file want the profile's in the running config only", got.Mount.URL, got.Mount.Dir, got.fileConfig().Mount.URL)
+	}
+}
+
+func TestValidateProfiles(t *testing.T) {
+	conf := profileConfig(t)
+	conf.Profiles = append(conf.Profiles,
+		Profile{Name: "Sunday service", Streamer: "vlc", Key: "F1"},
+		Profile{Mount: &mount{URL: sURL{URL: &url.URL{Path: "/does/not/exist"}}}},
+	)
+	conf.ActiveProfile = "Kids church"
+
+	var ce *ConfigError
+	if !errors.As(conf.Validate(), &ce) {
+		t.Fatal("got nil error for invalid profiles")
+	}
+
+	var got []string
+	for _, p := range ce.Problems {
+		got = append(got, p.Field)
+	}
+	want := []string{
+		"Profiles[2].Name",
+		"Profiles[2].Streamer",
+		"Profiles[2].Key",
+		"Profiles[3].Name",
+		"Profiles[3].Mount.URL",
+		"ActiveProfile",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got problems with %v want %v", got, want)
+	}
+}
@@ -0,0 +1,123 @@
+package piplayer
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// sendQueueSize is the number of messages that can wait to be written to a
+// single websocket. When the queue is full the oldest message is dropped.
+const sendQueueSize = 32
+
+// queueStats counts what happened to the messages queued for a connection.
+type queueStats struct {
+	sent      atomic.Uint64
+	dropped   atomic.Uint64
+	coalesced atomic.Uint64
+}
+
+// QueueStats is a snapshot of queueStats that can be sent over the API.
+type QueueStats struct {
+	Sent      uint64 `json:"sent"`
+	Dropped   uint64 `json:"dropped"`
+	Coalesced uint64 `json:"coalesced"`
+}
+
+func (s *queueStats) snapshot() QueueStats {
+	return QueueStats{
+		Sent:      s.sent.Load(),
+		Dropped:   s.dropped.Load(),
+		Coalesced: s.coalesced.Load(),
+	}
+}
+
+// sendQueue is a bounded queue of messages waiting to be written to a
+// websocket. Pushing never blocks, so a missing or slow browser can't hold up
+// the code producing messages.
+type sendQueue struct {
+	mu     sync.Mutex
+	msgs   []wsMessage
+	limit  int
+	closed bool
+	ready  chan struct{}
+	stats  *queueStats
+}
+
+func newSendQueue(limit int, stats *queueStats) *sendQueue {
+	return &sendQueue{
+		limit: limit,
+		ready: make(chan struct{}, 1),
+		stats: stats,
+	}
+}
+
+// push adds a message to the queue. If a message that it supersedes is
+// already waiting, that message is replaced. If the queue is full the oldest
+// message is dropped. Returns false if the queue is closed.
+func (q *sendQueue) push(msg wsMessage) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		q.stats.dropped.Add(1)
+		return false
+	}
+
+	if key := msg.coalesceKey(); key != "" {
+		for i, m := range q.msgs {
+			if m.coalesceKey() == key {
+				q.msgs = append(q.msgs[:i], q.msgs[i+1:]...)
+				q.stats.coalesced.Add(1)
+				break
+			}
+		}
+	}
+
+	if len(q.msgs) >= q.limit {
+		q.msgs = q.msgs[1:]
+		q.stats.dropped.Add(1)
+	}
+
+	q.msgs = append(q.msgs, msg)
+	q.signal()
+
+	return true
+}
+
+// pop removes the next message from the queue without blocking.
+func (q *sendQueue) pop() (wsMessage, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.msgs) == 0 {
+		return wsMessage{}, false
+	}
+
+	msg := q.msgs[0]
+	q.msgs = q.msgs[1:]
+	return msg, true
+}
+
+// close stops the queue from accepting new messages. Messages already in the
+// queue can still be popped, so a final message can be sent before closing.
+func (q *sendQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.signal()
+}
+
+func (q *sendQueue) isClosed() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.closed
+}
+
+// signal wakes up the writer. q.mu must be held.
+func (q *sendQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,54 @@
+package piplayer
+
+import "testing"
+
+func TestSendQueueCoalesce(t *testing.T) {
+	var stats queueStats
+	q := newSendQueue(4, &stats)
+
+	q.push(wsMessage{Component: "playlist", Event: "newItems", Message: "first"})
+	q.push(wsMessage{Component: "remote", Event: "keyDown"})
+	q.push(wsMessage{Component: "playlist", Event: "newItems", Message: "second"})
+
+	want := []wsMessage{
+		{Component: "remote", Event: "keyDown"},
+		{Component: "playlist", Event: "newItems", Message: "second"},
+	}
+
+	for _, w := range want {
+		got, ok := q.pop()
+		if !ok || got.Component != w.Component || got.Message != w.Message {
+			t.Errorf("got %v want %v", got, w)
+		}
+	}
+
+	if _, ok := q.pop(); ok {
+		t.Errorf("queue should be empty")
+	}
+
+	if got := stats.snapshot().Coalesced; got != 1 {
+		t.Errorf("got %d coalesced messages want 1", got)
+	}
+}
+
+func TestSendQueueDropOldest(t *testing.T) {
+	var stats queueStats
+	q := newSendQueue(2, &stats)
+
+	q.push(wsMessage{Method: "1"})
+	q.push(wsMessage{Method: "2"})
+	q.push(wsMessage{Method: "3"})
+
+	if got, _ := q.pop(); got.Method != "2" {
+		t.Errorf("got message %s want 2", got.Method)
+	}
+
+	if got := stats.snapshot().Dropped; got != 1 {
+		t.Errorf("got %d dropped messages want 1", got)
+	}
+
+	q.close()
+	if q.push(wsMessage{Method: "4"}) {
+		t.Errorf("pushed a message to a closed queue")
+	}
+}
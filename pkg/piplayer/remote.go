@@ -17,33 +17,58 @@ type remote struct {
 
 var directions = []string{"UP", "DOWN", "HOLD"}
 
+// remoteRead listens to the remote devices named in the config until ctx is
+// cancelled. The devices are re-opened when reopenRemote is called.
 func remoteRead(ctx context.Context, p *Player) {
-	for {
-		if p.api.debug {
+	for ctx.Err() == nil {
+		lctx, cancel := context.WithCancel(ctx)
+		p.remoteMu.Lock()
+		p.remoteCancel = cancel
+		names := p.config().Remote.Names
+		p.remoteMu.Unlock()
+
+		if p.api.debug.Load() {
 			log.Println("starting remote read for this device")
 		}
-		if err := Listen(ctx, p.conf.Remote.Names, p); err != nil {
-			if p.api.debug {
-				log.Printf("error listening to device, retrying in 3 seconds: %v\n", err)
-				time.Sleep(3 * time.Second)
-			}
+		errs := Listen(lctx, names, p)
+		reopened := lctx.Err() != nil
+		cancel()
+
+		if reopened {
+			continue
+		}
+		if p.api.debug.Load() {
+			log.Printf("error listening to device, retrying in 3 seconds: %v\n", errs)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(3 * time.Second):
 		}
 	}
+}
+
+// reopenRemote stops listening to the current remote devices, so that
+// remoteRead opens the devices named in the config again.
+func (p *Player) reopenRemote() {
+	p.remoteMu.Lock()
+	defer p.remoteMu.Unlock()
 
+	if p.remoteCancel != nil {
+		p.remoteCancel()
+	}
 }
 
 // Listen to all the Input Devices supplied.
 // Return an error if there is a problem, or if one of the devices disconnects.
 func Listen(ctx context.Context, devs []string, p *Player) []error {
 	errs := make([]error, 3)
-	send := p.ConnViewer.getChanSend()
 	kl := keylogger.NewKeyLogger(devs)
 	if len(kl.GetDevices()) <= 0 {
 		return []error{fmt.Errorf("device '%s' not found", devs)}
 	}
 
 	for _, d := range kl.GetDevices() {
-		if p.api.debug {
+		if p.api.debug.Load() {
 			log.Printf("Listening to device %s\n", d.Name)
 		}
 	}
@@ -54,8 +79,19 @@ func Listen(ctx context.Context, devs []string, p *Player) []error {
 
 	go kl.Read(ctx, cwait, cie, cer)
 
+	done := ctx.Done()
 	for {
 		select {
+		case <-done:
+			// Reads block until a key is pressed, so close the devices to
+			// stop them. The readers report the closed files on cer, and
+			// signal cwait once they've all stopped.
+			for _, d := range kl.GetDevices() {
+				if d.File != nil {
+					d.File.Close()
+				}
+			}
+			done = nil
 		case <-cwait:
 			return errs
 		case e, open := <-cie:
@@ -68,7 +104,29 @@ func Listen(ctx context.Context, devs []string, p *Player) []error {
 			}
 			key := e.KeyString()
 
-			if p.api.debug {
+			if name := p.config().profileForKey(key); name != "" {
+				if err := p.switchProfile(name); err != nil {
+					log.Printf("error switching to profile %q: %v\n", name, err)
+				}
+				continue
+			}
+
+			// Pairing is started here, as the viewer can't ask for it.
+			if key == "KEY_HOME" || key == "KEY_HOMEPAGE" {
+				if err := p.pairing.toggle(p); err != nil {
+					log.Printf("error trying to start pairing mode: %v\n", err)
+				}
+				continue
+			}
+
+			if p.config().USB.Key != "" && key == p.config().USB.Key {
+				if err := p.toggleUSB(); err != nil {
+					log.Printf("error switching the USB drive: %v\n", err)
+				}
+				continue
+			}
+
+			if p.api.debug.Load() {
 				log.Printf("Key: %s\tValue: %s\tType: %d\n", key, directions[e.Value], e.Type)
 				log.Println("Sending keypress to page and nothing else.")
 			}
@@ -79,9 +137,9 @@ func Listen(ctx context.Context, devs []string, p *Player) []error {
 				Event:     "keyDown",
 			}
 
-			send <- msg
-
-			if p.api.debug {
+			if !p.ConnViewer.enqueue(msg) {
+				log.Println("viewer not connected, keypress dropped")
+			} else if p.api.debug.Load() {
 				log.Println("Message sent")
 			}
 
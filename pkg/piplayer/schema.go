@@ -0,0 +1,368 @@
+package piplayer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// protocolVersion is the version of the message schema spoken over the
+// websockets. It's negotiated as a websocket subprotocol when connecting.
+const protocolVersion = 1
+
+// protocolName returns the websocket subprotocol for a protocol version.
+func protocolName(version int) string {
+	return fmt.Sprintf("pi-player.v%d", version)
+}
+
+// Argument structs for each message in the catalog.
+// Arguments are sent as strings, and decoded into these by decodeArgs.
+// The arg tag holds the argument name, and whether it's required.
+type (
+	noArgs    struct{}
+	indexArgs struct {
+		Index int `arg:"index,required" min:"0"`
+	}
+	startArgs struct {
+		Index int    `arg:"index,required" min:"0"`
+		Path  string `arg:"path"`
+	}
+	seekArgs struct {
+		Value   int `arg:"value"`
+		Seconds int `arg:"seconds"`
+	}
+	rateArgs struct {
+		Rate int `arg:"rate,required"`
+	}
+	chapterArgs struct {
+		Chapter int `arg:"chapter,required" min:"0"`
+	}
+	volumeArgs struct {
+		Volume int `arg:"volume,required" min:"0"`
+	}
+	streamArgs struct {
+		Stream int `arg:"stream,required" min:"0"`
+	}
+	profileArgs struct {
+		Name string `arg:"name,required"`
+	}
+	folderArgs struct {
+		Path string `arg:"path"`
+	}
+	orderArgs struct {
+		// Order is the file names, as a JSON array.
+		Order []string `arg:"order"`
+	}
+	sortArgs struct {
+		Sort string `arg:"sort,required"`
+	}
+	modeArgs struct {
+		Mode string `arg:"mode,required"`
+	}
+	shuffleArgs struct {
+		Shuffle bool `arg:"shuffle,required"`
+	}
+	usbArgs struct {
+		Path string `arg:"path,required"`
+	}
+	reportStateArgs struct {
+		Playing  bool    `arg:"playing"`
+		Position float64 `arg:"position" min:"0"`
+		Blackout bool    `arg:"blackout"`
+	}
+)
+
+// messageSpec describes one request in the message catalog.
+type messageSpec struct {
+	Component   string
+	Method      string
+	Description string
+	Args        interface{}
+}
+
+// messageCatalog lists every request that can be sent to the api or over a
+// websocket, and the arguments it takes.
+var messageCatalog = []messageSpec{
+	{"player", "start", "Start the item at index.", startArgs{}},
+	{"player", "stop", "Stop playback and black out the screen.", noArgs{}},
+	{"player", "play", "Resume playback.", noArgs{}},
+	{"player", "pause", "Pause playback.", noArgs{}},
+	{"player", "seek", "Seek the video by value seconds.", seekArgs{}},
+	{"player", "next", "Go to the next item.", noArgs{}},
+	{"player", "previous", "Go to the previous item.", noArgs{}},
+	{"player", "playbackRate", "Set the video playback rate.", rateArgs{}},
+	{"player", "chapter", "Go to a chapter in the video.", chapterArgs{}},
+	{"player", "volume", "Set the volume.", volumeArgs{}},
+	{"player", "audioStream", "Set the video audio stream.", streamArgs{}},
+	{"player", "subtitleStream", "Set the video subtitle stream.", streamArgs{}},
+	{"player", "getState", "Get a snapshot of the playback state.", noArgs{}},
+	{"player", "reportState", "Report what the viewer is doing.", reportStateArgs{}},
+	{"player", "ended", "Report that the media of the item at index played to the end.", indexArgs{}},
+	{"player", "getMode", "Get the playback mode and whether the items are shuffled.", noArgs{}},
+	{"player", "setMode", "Set the playback mode: repeat, repeatOne, hold or blackout.", modeArgs{}},
+	{"player", "nextMode", "Change to the next playback mode.", noArgs{}},
+	{"player", "setShuffle", "Turn shuffling on or off.", shuffleArgs{}},
+	{"player", "toggleShuffle", "Turn shuffling on if it's off, and off if it's on.", noArgs{}},
+	{"playlist", "getCurrent", "Get the name of the current item.", noArgs{}},
+	{"playlist", "setCurrent", "Record that the item at index has started, and run its cues.", indexArgs{}},
+	{"playlist", "getItems", "Get the items in the playlist.", noArgs{}},
+	{"playlist", "getFolders", "Get the folders in the media folder and the one playing.", noArgs{}},
+	{"playlist", "setFolder", "Play the items in the folder at path, or the media folder if path is empty.", folderArgs{}},
+	{"playlist", "nextFolder", "Play the items in the next folder.", noArgs{}},
+	{"playlist", "previousFolder", "Play the items in the previous folder.", noArgs{}},
+	{"playlist", "getPresentation", "Get the problems in the presentation.json of the folder playing.", noArgs{}},
+	{"playlist", "getOrder", "Get the sort mode and order of the items in the folder playing.", noArgs{}},
+	{"playlist", "setOrder", "Play the items named in order, a JSON array of file names, first and in that order.", orderArgs{}},
+	{"playlist", "setSort", "Sort the items by sort: name, modified or newest. The items pinned with setOrder stay first.", sortArgs{}},
+	{"pairing", "start", "Show a pairing code on the screen.", noArgs{}},
+	{"pairing", "stop", "Hide the pairing code.", noArgs{}},
+	{"profile", "list", "List the profiles and the active one.", noArgs{}},
+	{"profile", "switch", "Switch to the named profile.", profileArgs{}},
+	{"usb", "list", "List the USB drives with media and the one playing.", noArgs{}},
+	{"usb", "play", "Switch the playlist to the USB drive at path.", usbArgs{}},
+	{"usb", "back", "Switch the playlist back to the configured mount.", noArgs{}},
+	{"connection", "stats", "Get websocket queue statistics.", noArgs{}},
+}
+
+// restrictedMessages lists the requests that write to disk or switch what's
+// playing, and the access they need. The others can be sent by anyone, like
+// the viewer.
+var restrictedMessages = map[string]access{
+	"playlist.setOrder": accessAdmin,
+	"playlist.setSort":  accessAdmin,
+	"pairing.start":     accessAdmin,
+	"profile.switch":    accessAdmin,
+	"usb.play":          accessOperator,
+	"usb.back":          accessOperator,
+}
+
+// requiredAccess returns the access needed to send a request.
+func requiredAccess(component, method string) access {
+	return restrictedMessages[component+"."+method]
+}
+
+// findSpec returns the catalog entry for a component and method.
+func findSpec(component, method string) (messageSpec, bool) {
+	for _, s := range messageCatalog {
+		if s.Component == component && s.Method == method {
+			return s, true
+		}
+	}
+	return messageSpec{}, false
+}
+
+// validateRequest checks that a request is in the message catalog and that
+// its arguments are valid. All the problems are reported at once.
+func validateRequest(req reqMessage) error {
+	spec, ok := findSpec(req.Component, req.Method)
+	if !ok {
+		return fmt.Errorf("unknown request: component %q method %q", req.Component, req.Method)
+	}
+
+	args := reflect.New(reflect.TypeOf(spec.Args)).Interface()
+	return decodeArgs(req.Arguments, args)
+}
+
+// decodeArgs decodes string arguments into the struct pointed to by v,
+// checking for missing, unknown and invalid arguments.
+func decodeArgs(args map[string]string, v interface{}) error {
+	rv := reflect.ValueOf(v).Elem()
+	rt := rv.Type()
+	var errs []error
+	known := make(map[string]bool)
+
+	for i := range rt.NumField() {
+		f := rt.Field(i)
+		name, required := argTag(f)
+		known[name] = true
+
+		raw, ok := args[name]
+		if !ok {
+			if required {
+				errs = append(errs, fmt.Errorf("arguments.%s: required", name))
+			}
+			continue
+		}
+
+		if err := setArg(rv.Field(i), f, raw); err != nil {
+			errs = append(errs, fmt.Errorf("arguments.%s: %w", name, err))
+		}
+	}
+
+	for name := range args {
+		if !known[name] {
+			errs = append(errs, fmt.Errorf("arguments.%s: unknown argument", name))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// argTag returns the name of the argument and whether it's required.
+func argTag(f reflect.StructField) (string, bool) {
+	name, opts, _ := strings.Cut(f.Tag.Get("arg"), ",")
+	return name, opts == "required"
+}
+
+// setArg parses raw into the field, checking the min tag for numbers.
+func setArg(field reflect.Value, f reflect.StructField, raw string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+		return nil
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("must be true or false, got %q", raw)
+		}
+		field.SetBool(b)
+		return nil
+	case reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("must be an integer, got %q", raw)
+		}
+		field.SetInt(int64(n))
+		return checkMin(f, float64(n))
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("must be a number, got %q", raw)
+		}
+		field.SetFloat(n)
+		return checkMin(f, n)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			break
+		}
+		var list []string
+		if err := json.Unmarshal([]byte(raw), &list); err != nil {
+			return fmt.Errorf("must be a JSON array of strings, got %q", raw)
+		}
+		field.Set(reflect.ValueOf(list))
+		return nil
+	}
+
+	return fmt.Errorf("unsupported argument type %s", field.Kind())
+}
+
+func checkMin(f reflect.StructField, n float64) error {
+	m, ok := f.Tag.Lookup("min")
+	if !ok {
+		return nil
+	}
+	min, _ := strconv.ParseFloat(m, 64)
+	if n < min {
+		return fmt.Errorf("must be at least %s, got %v", m, n)
+	}
+	return nil
+}
+
+// messageSchema generates a JSON Schema for the requests in the message
+// catalog, that browsers and other clients can validate against.
+func messageSchema() map[string]interface{} {
+	var variants []interface{}
+
+	for _, spec := range messageCatalog {
+		props := map[string]interface{}{}
+		required := []string{}
+		rt := reflect.TypeOf(spec.Args)
+
+		for i := range rt.NumField() {
+			f := rt.Field(i)
+			name, req := argTag(f)
+			props[name] = argSchema(f)
+			if req {
+				required = append(required, name)
+			}
+		}
+		slices.Sort(required)
+
+		var args interface{} = map[string]interface{}{
+			"type":                 "object",
+			"properties":           props,
+			"additionalProperties": false,
+			"required":             required,
+		}
+		variantRequired := []string{"component", "method", "arguments"}
+		// Arguments can be left out when none of them are required.
+		if len(required) == 0 {
+			args = map[string]interface{}{"oneOf": []interface{}{args, map[string]interface{}{"type": "null"}}}
+			variantRequired = variantRequired[:2]
+		}
+
+		variant := map[string]interface{}{
+			"description": spec.Description,
+			"type":        "object",
+			"properties": map[string]interface{}{
+				"id":        map[string]interface{}{"type": "string"},
+				"component": map[string]interface{}{"const": spec.Component},
+				"method":    map[string]interface{}{"const": spec.Method},
+				"arguments": args,
+			},
+			"required": variantRequired,
+		}
+		variants = append(variants, variant)
+	}
+
+	return map[string]interface{}{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"$id":     "/api/schema",
+		"title":   fmt.Sprintf("pi-player request messages, protocol version %d", protocolVersion),
+		"version": protocolVersion,
+		"oneOf":   variants,
+	}
+}
+
+// argSchema returns the schema for a single argument. All arguments are sent
+// as strings, so numbers and booleans are matched with a pattern.
+func argSchema(f reflect.StructField) map[string]interface{} {
+	s := map[string]interface{}{"type": "string"}
+
+	switch f.Type.Kind() {
+	case reflect.Int:
+		s["pattern"] = `^-?[0-9]+$`
+	case reflect.Float64:
+		s["pattern"] = `^-?[0-9]+(\.[0-9]+)?$`
+	case reflect.Bool:
+		s["enum"] = []string{"true", "false"}
+	case reflect.Slice:
+		s["contentMediaType"] = "application/json"
+		s["description"] = "a JSON array of strings"
+	}
+
+	if m, ok := f.Tag.Lookup("min"); ok {
+		s["description"] = "minimum " + m
+	}
+
+	return s
+}
+
+// SchemaHandler serves the generated JSON Schema for the message catalog.
+func SchemaHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(messageSchema()); err != nil {
+		log.Println("error trying to write message schema:", err)
+	}
+}
+
+// negotiateProtocol checks the websocket subprotocols the browser asked for.
+// Browsers that don't ask for one are assumed to speak version 1.
+func negotiateProtocol(r *http.Request) error {
+	requested := websocket.Subprotocols(r)
+	if len(requested) == 0 || slices.Contains(requested, protocolName(protocolVersion)) {
+		return nil
+	}
+
+	return fmt.Errorf("unsupported protocol %v, this server speaks %s", requested, protocolName(protocolVersion))
+}
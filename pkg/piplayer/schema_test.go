@@ -0,0 +1,107 @@
+package piplayer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     reqMessage
+		wantErr []string
+	}{
+		{
+			name: "valid",
+			req:  reqMessage{Component: "playlist", Method: "setCurrent", Arguments: map[string]string{"index": "2"}},
+		},
+		{
+			name: "no arguments",
+			req:  reqMessage{Component: "player", Method: "play"},
+		},
+		{
+			name:    "unknown method",
+			req:     reqMessage{Component: "player", Method: "explode"},
+			wantErr: []string{"unknown request"},
+		},
+		{
+			name:    "missing argument",
+			req:     reqMessage{Component: "playlist", Method: "setCurrent"},
+			wantErr: []string{"arguments.index: required"},
+		},
+		{
+			name: "JSON array",
+			req:  reqMessage{Component: "playlist", Method: "setOrder", Arguments: map[string]string{"order": `["welcome.jpg", "intro.mp4"]`}},
+		},
+		{
+			name:    "not a JSON array",
+			req:     reqMessage{Component: "playlist", Method: "setOrder", Arguments: map[string]string{"order": "welcome.jpg\nintro.mp4"}},
+			wantErr: []string{"arguments.order: must be a JSON array of strings"},
+		},
+		{
+			name: "all problems reported",
+			req: reqMessage{Component: "player", Method: "reportState", Arguments: map[string]string{
+				"playing":  "maybe",
+				"position": "-1",
+				"rate":     "2",
+			}},
+			wantErr: []string{"arguments.playing", "arguments.position: must be at least 0", "arguments.rate: unknown argument"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateRequest(tt.req)
+			if len(tt.wantErr) == 0 {
+				if err != nil {
+					t.Errorf("got error %v want nil", err)
+				}
+				return
+			}
+
+			if err == nil {
+				t.Fatalf("got nil error want %v", tt.wantErr)
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMessageSchemaCoversCatalog(t *testing.T) {
+	variants := messageSchema()["oneOf"].([]interface{})
+	if len(variants) != len(messageCatalog) {
+		t.Errorf("got %d schema variants want %d", len(variants), len(messageCatalog))
+	}
+}
+
+func TestDispatchChecksAccess(t *testing.T) {
+	for name := range restrictedMessages {
+		component, method, _ := strings.Cut(name, ".")
+		if _, ok := findSpec(component, method); !ok {
+			t.Errorf("restricted message %s isn't in the catalog", name)
+		}
+	}
+
+	tests := []struct {
+		req  reqMessage
+		from access
+	}{
+		{reqMessage{Component: "playlist", Method: "setOrder", Arguments: map[string]string{"order": `["a.jpg"]`}}, accessOperator},
+		{reqMessage{Component: "playlist", Method: "setSort", Arguments: map[string]string{"sort": "name"}}, accessOperator},
+		{reqMessage{Component: "pairing", Method: "start"}, accessOperator},
+		{reqMessage{Component: "profile", Method: "switch", Arguments: map[string]string{"name": "Hall"}}, accessOperator},
+		{reqMessage{Component: "usb", Method: "play", Arguments: map[string]string{"path": "/media/pi/GUEST"}}, accessNone},
+		{reqMessage{Component: "usb", Method: "back"}, accessNone},
+	}
+	a := &APIHandler{}
+	for _, tt := range tests {
+		res := a.dispatch(nil, tt.req, tt.from)
+		if res.Success || res.Event != "forbidden" {
+			t.Errorf("%s %s from %s: got %+v want forbidden", tt.req.Component, tt.req.Method, tt.from, res)
+		}
+	}
+}
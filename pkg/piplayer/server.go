@@ -9,38 +9,46 @@ import (
 
 // NewServer returns a new http.Server for the piplayer interface.
 func NewServer(p *Player, addr string) *http.Server {
-	mux := setupRoutes(p.conf.Mount.Dir, p)
+	mux := setupRoutes(p)
 	serv := http.Server{Addr: addr, Handler: mux}
 
 	return &serv
 }
 
-// setupRoutes registers the routes for the server, accepting a new directory where
-// the content can be found. This will be called whenever there is a change of content
-// given from the settings page.
-func setupRoutes(content string, p *Player) *http.ServeMux {
+// setupRoutes registers the routes for the server. Content is served from the
+// media folder in the config, or the media cache, so changing them doesn't
+// need the routes again.
+func setupRoutes(p *Player) *http.ServeMux {
 	mux := http.NewServeMux()
 
 	mux.Handle("/assets/", http.StripPrefix("/assets/", http.FileServer(http.FS(p.api.statAssets))))
 	// mux.Handle("/assets/", http.StripPrefix("/assets/", http.FileServer(http.Dir("pkg/piplayer/assets"))))
-	mux.HandleFunc("/content/", etagWrapper(content))
+	mux.HandleFunc("/content/", contentHandler(p))
 	mux.HandleFunc("/login", LoginHandler(p))
 	mux.HandleFunc("/logout", LogoutHandler)
+	mux.HandleFunc("/pair", PairHandler(p))
+	mux.HandleFunc("/pair/qr.png", PairQRHandler(p))
 	mux.HandleFunc("/control", p.HandleControl)
-	mux.HandleFunc("/settings", p.conf.SettingsHandler(p))
+	mux.HandleFunc("/settings", SettingsHandler(p))
+	mux.HandleFunc("/playlist/export", PlaylistExportHandler(p))
+	mux.HandleFunc("/settings/backup", BackupHandler(p))
+	mux.HandleFunc("/settings/restore", RestoreHandler(p))
 	mux.HandleFunc("/viewer", p.HandleViewer)
 	mux.HandleFunc("/ws/viewer", p.ConnViewer.HandlerWebsocket(p))
 	mux.HandleFunc("/ws/control", p.ConnControl.HandlerWebsocket(p))
 	mux.HandleFunc("/api", p.api.Handle(p))
+	mux.HandleFunc("/api/schema", SchemaHandler)
+	mux.HandleFunc("/api/schema/presentation", PresentationSchemaHandler)
+	mux.HandleFunc("/api/settings", SettingsAPIHandler(p))
 	mux.HandleFunc("/", p.api.handlerHome)
 
 	return mux
 }
 
 // etagWrapper calculates an Etag value for the requested content.
-func etagWrapper(content string) func(http.ResponseWriter, *http.Request) {
+func etagWrapper(content func() string) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		fs := http.StripPrefix("/content/", http.FileServer(http.Dir(content)))
+		fs := http.StripPrefix("/content/", http.FileServer(http.Dir(content())))
 
 		// TODO: Everything
 
@@ -69,7 +77,6 @@ func Start(plr *Player) {
 	}
 
 	// Restart the server.
-	// TODO: This needs to become a config option
-	plr.Server = NewServer(plr, ":8080")
+	plr.Server = NewServer(plr, plr.config().ListenAddr())
 	Start(plr)
 }
@@ -0,0 +1,427 @@
+package piplayer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// SettingsHandler handles requests to the settings page
+func SettingsHandler(p *Player) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, loggedIn, err := CheckLogin(w, r)
+		if err != nil {
+			log.Println("error trying to retrieve session on login page:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !loggedIn {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		// Paired devices can control playback, but not change settings.
+		if isOperator(session) {
+			http.Redirect(w, r, "/control", http.StatusFound)
+			return
+		}
+
+		if r.Method == "GET" {
+			p.config().fileConfig().renderSettings(p, w, r, nil)
+			return
+		} else if r.Method != "POST" {
+			log.Println("Unsuported request type for Settings page:", r.Method)
+			return
+		}
+
+		// process POST request
+		if err := r.ParseForm(); err != nil {
+			log.Println("Error trying to parse form in settings page.\n", err)
+		}
+
+		// The profile form only switches to another profile.
+		if profile := r.PostFormValue("profile"); profile != "" {
+			if err := p.switchProfile(profile); err != nil {
+				log.Println("error trying to switch profile:", err)
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				p.config().fileConfig().renderSettings(p, w, r, err)
+				return
+			}
+			http.Redirect(w, r, "/settings", http.StatusSeeOther)
+			return
+		}
+
+		p.configMu.Lock()
+		defer p.configMu.Unlock()
+
+		// Apply the changes to a copy of the config file, so that nothing
+		// changes unless the whole config is valid.
+		newConf, formErr := settingsFromForm(*p.config().fileConfig(), r)
+
+		if newConf.Debug {
+			log.Printf("Received settings post: location: %s\nmountURL: %s\n", r.PostFormValue("location"), r.PostFormValue("mountURL"))
+		}
+
+		if err := p.saveSettings(newConf, formErr); err != nil {
+			log.Println("Refusing to save settings:", err)
+			var ce *ConfigError
+			if errors.As(err, &ce) {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+			} else {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			newConf.renderSettings(p, w, r, err)
+			return
+		}
+
+		http.Redirect(w, r, "/control", http.StatusSeeOther)
+	}
+}
+
+// settingsFromForm applies the values posted from the settings page to conf.
+// Values that can't be parsed are left as they were, and returned as problems.
+func settingsFromForm(conf Config, r *http.Request) (Config, *ConfigError) {
+	errs := &ConfigError{}
+	form := r.PostFormValue
+
+	if location := form("location"); location != "" {
+		conf.Location = location
+	}
+
+	if mountURL := form("mountURL"); mountURL != "" {
+		u, err := url.Parse(mountURL)
+		if err != nil {
+			errs.add("Mount.URL", "%v", err)
+		} else if u.String() != conf.Mount.URL.String() {
+			conf.Mount = newMount(u)
+		}
+	}
+
+	if audioOutput := form("audioOutput"); audioOutput != "" {
+		conf.AudioOutput = audioOutput
+	}
+	conf.Streamer = form("streamer")
+	conf.Debug = form("debug") == "on"
+	conf.SingleOperator = form("singleOperator") == "on"
+	conf.Playlist.StopAtEnd = form("stopAtEnd") == "on"
+	conf.Addr = strings.TrimSpace(form("addr"))
+
+	conf.SyncMinutes = parseCount(form("syncMinutes"), "SyncMinutes", conf.SyncMinutes, errs)
+
+	if username, password := form("username"), form("password"); username != "" && password != "" {
+		hashed, err := hash(password)
+		if err != nil {
+			errs.add("Login.Password", "could not be encrypted: %v", err)
+		} else {
+			conf.Login.Username = username
+			conf.Login.Password = hashed
+		}
+	}
+
+	conf.Remote.Names = splitList(form("remoteNames"))
+	conf.Remote.Vendor = parseDeviceID(form("remoteVendor"), "Remote.Vendor", conf.Remote.Vendor, errs)
+	conf.Remote.Product = parseDeviceID(form("remoteProduct"), "Remote.Product", conf.Remote.Product, errs)
+
+	conf.Cache.SizeMB = parseCount(form("cacheSizeMB"), "Cache.SizeMB", conf.Cache.SizeMB, errs)
+	conf.Cache.Prefetch = parseCount(form("cachePrefetch"), "Cache.Prefetch", conf.Cache.Prefetch, errs)
+	conf.Cache.Dir = strings.TrimSpace(form("cacheDir"))
+
+	conf.USB.Roots = splitList(form("usbRoots"))
+	conf.USB.Key = strings.TrimSpace(form("usbKey"))
+
+	// An empty field keeps the profiles, [] removes them.
+	if profiles := strings.TrimSpace(form("profiles")); profiles != "" {
+		var list []Profile
+		if err := json.Unmarshal([]byte(profiles), &list); err != nil {
+			errs.add("Profiles", "must be a JSON list of profiles: %v", err)
+		} else {
+			conf.Profiles = list
+		}
+	}
+	// A profile that was removed can't be the active one anymore.
+	if _, ok := conf.findProfile(conf.ActiveProfile); !ok {
+		conf.ActiveProfile = ""
+	}
+
+	if len(errs.Problems) > 0 {
+		return conf, errs
+	}
+	return conf, nil
+}
+
+// splitList splits a comma or newline separated list, dropping empty entries.
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// parseDeviceID parses a USB vendor or product ID, in decimal or hex with a
+// 0x prefix. An empty value is 0, which matches any device.
+func parseDeviceID(s, field string, current uint16, errs *ConfigError) uint16 {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0
+	}
+
+	id, err := strconv.ParseUint(s, 0, 16)
+	if err != nil {
+		errs.add(field, "must be a number from 0 to 0xffff, got %q", s)
+		return current
+	}
+	return uint16(id)
+}
+
+// parseCount parses a whole number from a form field. Empty is 0, and the
+// current value is kept if it can't be parsed.
+func parseCount(s, field string, current int, errs *ConfigError) int {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0
+	}
+
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		errs.add(field, "must be a whole number, got %q", s)
+		return current
+	}
+	return n
+}
+
+// saveSettings validates newFile, the config as it's saved to config.json,
+// saves it and applies it to the running player with the active profile and
+// overrides on top. Problems already found in newFile, like values that
+// couldn't be parsed, are reported along with the validation problems.
+// p.configMu must be held.
+func (p *Player) saveSettings(newFile Config, problems *ConfigError) error {
+	var ce *ConfigError
+	if err := newFile.Validate(); errors.As(err, &ce) {
+		if problems == nil {
+			problems = &ConfigError{}
+		}
+		problems.Problems = append(problems.Problems, ce.Problems...)
+	}
+	if problems != nil {
+		return problems
+	}
+
+	newConf, err := p.runningConfig(&newFile)
+	if err != nil {
+		return err
+	}
+	if err := newConf.Validate(); err != nil {
+		return err
+	}
+
+	if err := newFile.Save(); err != nil {
+		return fmt.Errorf("could not save config: %w", err)
+	}
+
+	p.applyConfig(newConf)
+	return nil
+}
+
+// renderSettings renders the settings page with the values from conf,
+// and any problems that need to be fixed before it can be saved.
+func (conf *Config) renderSettings(p *Player, w http.ResponseWriter, r *http.Request, err error) {
+	conf.renderSettingsPage(p, w, r, err, nil)
+}
+
+// renderSettingsNotice renders the settings page with a notice, eg: the
+// result of restoring a backup.
+func (conf *Config) renderSettingsNotice(p *Player, w http.ResponseWriter, r *http.Request, notice []string) {
+	conf.renderSettingsPage(p, w, r, nil, notice)
+}
+
+func (conf *Config) renderSettingsPage(p *Player, w http.ResponseWriter, r *http.Request, err error, notice []string) {
+	mu, uerr := url.PathUnescape(conf.Mount.URL.String())
+	if uerr != nil {
+		log.Printf("SettingsHandler: Error unescaping URL '%s'\n", conf.Mount.URL)
+	}
+
+	profiles := ""
+	if len(conf.Profiles) > 0 {
+		data, jerr := json.MarshalIndent(conf.Profiles, "", "  ")
+		if jerr != nil {
+			log.Println("SettingsHandler: Error marshalling profiles:", jerr)
+		}
+		profiles = string(data)
+	}
+
+	var problems []string
+	var fieldErrors map[string]string
+	if err != nil {
+		problems = configProblems(err)
+		fieldErrors = configFieldErrors(err)
+	}
+
+	tempControl := TemplateHandler{
+		filename:      "settings.html",
+		statTemplates: p.api.statTemplates,
+		data: map[string]interface{}{
+			"location":       conf.Location,
+			"audioOutput":    conf.AudioOutput,
+			"streamer":       conf.Streamer,
+			"streamers":      supportedStreamers,
+			"debug":          conf.Debug,
+			"username":       conf.Login.Username,
+			"mount":          conf.Mount,
+			"mountURL":       mu,
+			"remoteNames":    strings.Join(conf.Remote.Names, ", "),
+			"remoteVendor":   fmt.Sprintf("0x%04x", conf.Remote.Vendor),
+			"remoteProduct":  fmt.Sprintf("0x%04x", conf.Remote.Product),
+			"addr":           conf.Addr,
+			"singleOperator": conf.SingleOperator,
+			"syncMinutes":    conf.SyncMinutes,
+			"usbRoots":       strings.Join(conf.USB.Roots, ", "),
+			"usbKey":         conf.USB.Key,
+			"cacheSizeMB":    conf.Cache.SizeMB,
+			"cachePrefetch":  conf.Cache.Prefetch,
+			"cacheDir":       conf.Cache.Dir,
+			"stopAtEnd":      conf.Playlist.StopAtEnd,
+			"profilesJSON":   profiles,
+			"errors":         problems,
+			"notice":         notice,
+			"fieldErrors":    fieldErrors,
+			"profiles":       conf.Profiles,
+			"profile":        p.config().ActiveProfile,
+		},
+	}
+	tempControl.ServeHTTP(w, r)
+}
+
+// configProblems returns the problems in a config validation error as strings.
+func configProblems(err error) []string {
+	var ce *ConfigError
+	if !errors.As(err, &ce) {
+		return []string{err.Error()}
+	}
+
+	problems := make([]string, len(ce.Problems))
+	for i, p := range ce.Problems {
+		problems[i] = p.Error()
+	}
+	return problems
+}
+
+// configFieldErrors returns the problems in a config validation error by the
+// settings form field they belong to, eg: Remote.Names[1] belongs to
+// Remote.Names, and every problem with a profile belongs to Profiles.
+func configFieldErrors(err error) map[string]string {
+	var ce *ConfigError
+	if !errors.As(err, &ce) {
+		return nil
+	}
+
+	fields := make(map[string]string)
+	for _, p := range ce.Problems {
+		field, _, _ := strings.Cut(p.Field, "[")
+		if fields[field] != "" {
+			fields[field] += "; "
+		}
+		fields[field] += p.Message
+	}
+	return fields
+}
+
+// SettingsAPIHandler gets and updates the settings as JSON.
+// GET returns the config as it's saved, without the active profile and
+// overrides, and with secrets redacted. POST or PUT with some or all
+// of the config fields updates them if the resulting config is valid, and
+// replies with every problem otherwise. A plain text Login.Password is hashed
+// before it's saved.
+func SettingsAPIHandler(p *Player) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		session, loggedIn, err := CheckLogin(w, r)
+		if err != nil {
+			log.Println("error trying to retrieve session on settings api:", err)
+			writeSettingsResponse(w, http.StatusInternalServerError, apiError(err.Error()))
+			return
+		}
+		if !loggedIn {
+			writeSettingsResponse(w, http.StatusUnauthorized, apiError("Not logged in"))
+			return
+		}
+		// Paired devices can control playback, but not change settings.
+		if isOperator(session) {
+			writeSettingsResponse(w, http.StatusForbidden, apiError("Operators can't change settings"))
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			writeSettingsResponse(w, http.StatusOK, resMessage{Success: true, Event: "settings", Message: p.config().fileConfig().redacted()})
+			return
+		case http.MethodPost, http.MethodPut:
+		default:
+			writeSettingsResponse(w, http.StatusMethodNotAllowed, apiError("Invalid request method: "+r.Method))
+			return
+		}
+
+		p.configMu.Lock()
+		defer p.configMu.Unlock()
+
+		// Decode onto a copy of the config file, so that fields that aren't
+		// sent keep their values.
+		file := p.config().fileConfig()
+		newConf, err := file.clone()
+		if err != nil {
+			writeSettingsResponse(w, http.StatusInternalServerError, apiError(err.Error()))
+			return
+		}
+		err = json.NewDecoder(r.Body).Decode(&newConf)
+		r.Body.Close()
+		if err != nil {
+			writeSettingsResponse(w, http.StatusBadRequest, apiError("Error decoding JSON settings: "+err.Error()))
+			return
+		}
+
+		newConf.unredact(file)
+		problems := &ConfigError{}
+		switch newConf.Login.Password {
+		case "", redacted:
+			newConf.Login.Password = file.Login.Password
+		case file.Login.Password:
+		default:
+			if newConf.Login.Password, err = hash(newConf.Login.Password); err != nil {
+				problems.add("Login.Password", "could not be encrypted: %v", err)
+			}
+		}
+		if newConf.Mount.URL.URL != nil {
+			newConf.Mount.Dir = newConf.Mount.localDir()
+		}
+		if len(problems.Problems) == 0 {
+			problems = nil
+		}
+
+		if err := p.saveSettings(newConf, problems); err != nil {
+			log.Println("Refusing to save settings:", err)
+			var ce *ConfigError
+			if errors.As(err, &ce) {
+				writeSettingsResponse(w, http.StatusUnprocessableEntity, resMessage{Success: false, Event: "invalidSettings", Message: ce.Problems})
+				return
+			}
+			writeSettingsResponse(w, http.StatusInternalServerError, apiError(err.Error()))
+			return
+		}
+
+		writeSettingsResponse(w, http.StatusOK, resMessage{Success: true, Event: "settingsSaved", Message: p.config().fileConfig().redacted()})
+	}
+}
+
+func writeSettingsResponse(w http.ResponseWriter, status int, res resMessage) {
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Println("error trying to write settings response:", err)
+	}
+}
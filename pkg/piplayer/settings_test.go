@@ -0,0 +1,147 @@
+package piplayer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSettingsFromForm(t *testing.T) {
+	conf := validConfig(t)
+	form := url.Values{
+		"streamer":       {"omx"},
+		"singleOperator": {"on"},
+		"stopAtEnd":      {"on"},
+		"addr":           {" :9090 "},
+		"remoteNames":    {"keyboard, remote\nclicker,"},
+		"remoteVendor":   {"0x1d57"},
+		"remoteProduct":  {"banana"},
+		"profiles":       {`[{"Name": "Lobby loop", "Location": "Lobby"}]`},
+	}
+	r := httptest.NewRequest(http.MethodPost, "/settings", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	got, errs := settingsFromForm(conf, r)
+
+	if got.Streamer != "omx" || !got.SingleOperator || !got.Playlist.StopAtEnd || got.Addr != ":9090" {
+		t.Errorf("form values not applied: %+v", got)
+	}
+	if want := []string{"keyboard", "remote", "clicker"}; !reflect.DeepEqual(got.Remote.Names, want) {
+		t.Errorf("got remote names %v want %v", got.Remote.Names, want)
+	}
+	if got.Remote.Vendor != 0x1d57 {
+		t.Errorf("got vendor %#x want %#x", got.Remote.Vendor, 0x1d57)
+	}
+	if len(got.Profiles) != 1 || got.Profiles[0].Location != "Lobby" {
+		t.Errorf("got profiles %+v", got.Profiles)
+	}
+
+	if errs == nil || len(errs.Problems) != 1 || errs.Problems[0].Field != "Remote.Product" {
+		t.Errorf("got problems %v want one with Remote.Product", errs)
+	}
+
+	// An empty profiles field keeps the profiles.
+	r = httptest.NewRequest(http.MethodPost, "/settings", strings.NewReader(url.Values{"remoteNames": {"keyboard"}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if got, _ = settingsFromForm(got, r); len(got.Profiles) != 1 {
+		t.Errorf("got profiles %+v want them kept", got.Profiles)
+	}
+}
+
+func TestRenderSettingsShowsFieldErrors(t *testing.T) {
+	conf := validConfig(t)
+	conf.Location = ""
+	conf.Remote.Names = []string{"keyboard", ""}
+	p := &Player{api: &APIHandler{statTemplates: os.DirFS("templates")}}
+	p.conf.Store(&conf)
+
+	w := httptest.NewRecorder()
+	conf.renderSettings(p, w, httptest.NewRequest(http.MethodGet, "/settings", nil), conf.Validate())
+
+	body := w.Body.String()
+	for _, want := range []string{
+		`<p class="field-error">can&#39;t be empty</p>`,
+		"Remote.Names[1]: can&#39;t be empty",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("settings page doesn't contain %q", want)
+		}
+	}
+}
+
+// loggedIn returns a request with a session cookie for a logged in admin.
+func loggedIn(t *testing.T, method, target, body string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	session, err := store.Get(r, "piplayer-session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Values["authenticated"] = true
+
+	w := httptest.NewRecorder()
+	if err := session.Save(r, w); err != nil {
+		t.Fatal(err)
+	}
+
+	r = httptest.NewRequest(method, target, strings.NewReader(body))
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+func TestSettingsAPI(t *testing.T) {
+	file := validConfig(t)
+	conf, err := file.running("", profileOverrides(t, "-location", "Overridden"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Player{api: &APIHandler{}}
+	p.conf.Store(&conf)
+	h := SettingsAPIHandler(p)
+
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, "/api/settings", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d without a session want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	w = httptest.NewRecorder()
+	h(w, loggedIn(t, http.MethodGet, "/api/settings", ""))
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), conf.Login.Password) {
+		t.Errorf("got status %d with body %s, want the config with the password redacted", w.Code, w.Body)
+	}
+	if body := w.Body.String(); strings.Contains(body, "Overridden") || !strings.Contains(body, file.Location) {
+		t.Errorf("got body %s want the config file without overrides", body)
+	}
+
+	// Invalid settings are rejected with every problem, and nothing changes.
+	w = httptest.NewRecorder()
+	h(w, loggedIn(t, http.MethodPut, "/api/settings", `{"Streamer": "vlc", "Remote": {"Names": []}}`))
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("got status %d want %d", w.Code, http.StatusUnprocessableEntity)
+	}
+
+	var res struct {
+		Success bool
+		Message []FieldError
+	}
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	want := []FieldError{
+		{"Streamer", `unsupported streamer "vlc", use one of chrome, omx`},
+		{"Remote.Names", `at least one input device name is needed, eg: "keyboard"`},
+	}
+	if res.Success || !reflect.DeepEqual(res.Message, want) {
+		t.Errorf("got %+v want problems %+v", res, want)
+	}
+	if p.config().Streamer != "" || len(p.config().Remote.Names) != 1 {
+		t.Errorf("config changed by invalid settings: %+v", p.config())
+	}
+}
@@ -0,0 +1,109 @@
+package piplayer
+
+import (
+	"sync"
+	"time"
+)
+
+// PlaybackState is the server's view of what's showing on the screen.
+// It's sent to every browser that connects, so a reloaded viewer can resume
+// where it left off and a control page knows what's playing.
+type PlaybackState struct {
+	// Current is the index of the current item, or -1 if nothing has been started.
+	Current int    `json:"current"`
+	Item    string `json:"item"`
+	Playing bool   `json:"playing"`
+	// Position is how far into the current video playback is, in seconds.
+	Position float64 `json:"position"`
+	Blackout bool    `json:"blackout"`
+	// Updated is when the state last changed, in unix milliseconds.
+	Updated int64 `json:"updated"`
+}
+
+// playerState holds the PlaybackState and keeps it safe for concurrent use.
+type playerState struct {
+	mu sync.Mutex
+	s  PlaybackState
+}
+
+func newPlayerState() *playerState {
+	return &playerState{s: PlaybackState{Current: -1}}
+}
+
+// snapshot returns a copy of the state, with the position of a playing video
+// moved forward by the time since it was last reported.
+func (ps *playerState) snapshot() PlaybackState {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	s := ps.s
+	now := time.Now().UnixMilli()
+	if s.Playing && s.Updated > 0 {
+		s.Position += float64(now-s.Updated) / 1000
+	}
+	s.Updated = now
+
+	return s
+}
+
+// setCurrent records that a new item has started from the beginning.
+func (ps *playerState) setCurrent(index int, item string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	ps.s.Current = index
+	ps.s.Item = item
+	ps.s.Playing = true
+	ps.s.Position = 0
+	ps.s.Blackout = false
+	ps.s.Updated = time.Now().UnixMilli()
+}
+
+// setIndex records that the current item moved to index when the items were
+// read again, or that it's gone if index is -1.
+func (ps *playerState) setIndex(index int) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.s.Current == index {
+		return
+	}
+	ps.s.Current = index
+	if index < 0 {
+		ps.s.Item = ""
+	}
+	ps.s.Updated = time.Now().UnixMilli()
+}
+
+// setBlackout records that the screen was blacked out.
+func (ps *playerState) setBlackout() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	ps.s.Playing = false
+	ps.s.Position = 0
+	ps.s.Blackout = true
+	ps.s.Updated = time.Now().UnixMilli()
+}
+
+// report updates the state with what the viewer says is happening.
+func (ps *playerState) report(args reportStateArgs) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	ps.s.Playing = args.Playing
+	ps.s.Position = args.Position
+	ps.s.Blackout = args.Blackout
+	ps.s.Updated = time.Now().UnixMilli()
+}
+
+// snapshotMessage builds the message that's sent as the first frame on every
+// new websocket connection.
+func (p *Player) snapshotMessage() wsMessage {
+	return wsMessage{
+		Component: "player",
+		Event:     "snapshot",
+		Success:   true,
+		Message:   p.state.snapshot(),
+	}
+}
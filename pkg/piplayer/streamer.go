@@ -1,6 +1,9 @@
 package piplayer
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+)
 
 const (
 	statusStopped  = 0
@@ -27,13 +30,32 @@ type Streamer interface {
 	SubtitleStream(stream int) error
 }
 
+// contextStreamer is implemented by streamers whose commands can be
+// cancelled, or given a deadline, by the caller.
+type contextStreamer interface {
+	PlayContext(ctx context.Context) error
+	PauseContext(ctx context.Context) error
+	PlaybackRateContext(ctx context.Context, rate int) error
+	SeekContext(ctx context.Context, seconds int) error
+	ChapterContext(ctx context.Context, chapter int) error
+	VolumeContext(ctx context.Context, volume int) error
+	AudioStreamContext(ctx context.Context, stream int) error
+	SubtitleStreamContext(ctx context.Context, stream int) error
+}
+
+// audioOutputSetter is implemented by streamers that choose the audio output
+// themselves, so a change to the config can be applied without a restart.
+type audioOutputSetter interface {
+	SetAudioOutput(output string)
+}
+
 // NewStreamer creates a new streamer object based on the type supplied.
 func NewStreamer(name string, audioOutput string) (s Streamer, err error) {
 	switch name {
 	case "chrome":
 		s = &Chrome{
 			ConnViewer:  &connWS{},
-			ConnControl: &connWS{},
+			ConnControl: &Hub{},
 		}
 	case "omx":
 		s = &OMXPlayer{
@@ -1,10 +1,12 @@
 package piplayer
 
 import (
+	"context"
 	"errors"
 	"os"
 	"os/exec"
 	"strconv"
+	"time"
 )
 
 // Chrome represents Google Chrome as the video stream playback software.
@@ -15,13 +17,16 @@ type Chrome struct {
 	// closing     chan error
 	cmd         *exec.Cmd
 	ConnViewer  ConnectionWS
-	ConnControl ConnectionWS
+	ConnControl *Hub
+	// Timeout is how long to wait for the viewer to reply to a command.
+	Timeout time.Duration
 }
 
 const (
 	// defaultProgram = "chromium-browser"
 	defaultProgram = "chromium"
 	viewerPage     = "http://localhost:8080/viewer"
+	defaultTimeout = 5 * time.Second
 )
 
 var defaultFlags = []string{
@@ -100,8 +105,6 @@ func (c *Chrome) Open(file string, status chan string, test string, debug bool)
 	}
 
 	c.status = statusStarting
-	// TODO: handle graceful shutdown properly with context
-	// ctxt, cancel := context.WithCancel(context.Background())
 
 	return nil
 }
@@ -109,8 +112,8 @@ func (c *Chrome) Open(file string, status chan string, test string, debug bool)
 // HandleRes checks the WebSocket response for errors.
 func handleRes(res wsMessage) error {
 	if !res.Success {
-		resMsg := res.Message.(string)
-		return errors.New(resMsg)
+		resMsg, _ := res.Message.(string)
+		return &RequestError{ID: res.ID, Method: res.Method, Err: errors.New(resMsg)}
 	}
 	return nil
 }
@@ -121,128 +124,125 @@ func (c *Chrome) Close() error {
 	return nil
 }
 
-// Play sends a play command.
-func (c *Chrome) Play() error {
+// call sends a command to the viewer and waits for its reply.
+// The command fails if the viewer doesn't reply within the Chrome timeout,
+// or when ctx is done, whichever comes first.
+func (c *Chrome) call(ctx context.Context, method string, args map[string]string) error {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
 	msg := wsMessage{
 		Component: "player",
-		Method:    "play",
+		Method:    method,
+		Arguments: args,
 	}
 
-	// TODO: create convenience method that sends and waits?
-	send := c.ConnViewer.getChanSend()
-	send <- msg
-	// Wait for response
-	res := <-c.ConnViewer.getChanReceive()
+	res, err := c.ConnViewer.request(ctx, msg)
+	if err != nil {
+		return err
+	}
 	return handleRes(res)
 }
 
+// Play sends a play command.
+func (c *Chrome) Play() error {
+	return c.PlayContext(context.Background())
+}
+
+// PlayContext sends a play command, giving up when ctx is done.
+func (c *Chrome) PlayContext(ctx context.Context) error {
+	return c.call(ctx, "play", nil)
+}
+
 // Pause sends a pause command.
 func (c *Chrome) Pause() error {
-	msg := wsMessage{
-		Component: "player",
-		Method:    "pause",
-	}
+	return c.PauseContext(context.Background())
+}
 
-	send := c.ConnViewer.getChanSend()
-	send <- msg
-	res := <-c.ConnViewer.getChanReceive()
-	return handleRes(res)
+// PauseContext sends a pause command, giving up when ctx is done.
+func (c *Chrome) PauseContext(ctx context.Context) error {
+	return c.call(ctx, "pause", nil)
 }
 
 // PlaybackRate sets the video playback rate.
 func (c *Chrome) PlaybackRate(rate int) error {
-	msg := wsMessage{
-		Component: "player",
-		Method:    "playbackRate",
-		Arguments: map[string]string{
-			"rate": strconv.Itoa(rate),
-		},
-	}
+	return c.PlaybackRateContext(context.Background(), rate)
+}
 
-	send := c.ConnViewer.getChanSend()
-	send <- msg
-	res := <-c.ConnViewer.getChanReceive()
-	return handleRes(res)
+// PlaybackRateContext sets the video playback rate, giving up when ctx is
+// done.
+func (c *Chrome) PlaybackRateContext(ctx context.Context, rate int) error {
+	return c.call(ctx, "playbackRate", map[string]string{
+		"rate": strconv.Itoa(rate),
+	})
 }
 
 // Seek seeks to a specific time in a video.
 func (c *Chrome) Seek(seconds int) error {
-	msg := wsMessage{
-		Component: "player",
-		Method:    "seek",
-		Arguments: map[string]string{
-			"seconds": strconv.Itoa(seconds),
-		},
-	}
+	return c.SeekContext(context.Background(), seconds)
+}
 
-	send := c.ConnViewer.getChanSend()
-	send <- msg
-	res := <-c.ConnViewer.getChanReceive()
-	return handleRes(res)
+// SeekContext seeks to a specific time in a video, giving up when ctx is
+// done.
+func (c *Chrome) SeekContext(ctx context.Context, seconds int) error {
+	return c.call(ctx, "seek", map[string]string{
+		"seconds": strconv.Itoa(seconds),
+	})
 }
 
 // Chapter seeks to a specific chapter in the video.
 func (c *Chrome) Chapter(chp int) error {
-	msg := wsMessage{
-		Component: "player",
-		Method:    "chapter",
-		Arguments: map[string]string{
-			"chapter": strconv.Itoa(chp),
-		},
-	}
+	return c.ChapterContext(context.Background(), chp)
+}
 
-	send := c.ConnViewer.getChanSend()
-	send <- msg
-	res := <-c.ConnViewer.getChanReceive()
-	return handleRes(res)
+// ChapterContext seeks to a specific chapter in the video, giving up when
+// ctx is done.
+func (c *Chrome) ChapterContext(ctx context.Context, chp int) error {
+	return c.call(ctx, "chapter", map[string]string{
+		"chapter": strconv.Itoa(chp),
+	})
 }
 
 // Volume sets the video volume.
 func (c *Chrome) Volume(v int) error {
-	msg := wsMessage{
-		Component: "player",
-		Method:    "volume",
-		Arguments: map[string]string{
-			"rate": strconv.Itoa(v),
-		},
-	}
+	return c.VolumeContext(context.Background(), v)
+}
 
-	send := c.ConnViewer.getChanSend()
-	send <- msg
-	res := <-c.ConnViewer.getChanReceive()
-	return handleRes(res)
+// VolumeContext sets the video volume, giving up when ctx is done.
+func (c *Chrome) VolumeContext(ctx context.Context, v int) error {
+	return c.call(ctx, "volume", map[string]string{
+		"volume": strconv.Itoa(v),
+	})
 }
 
 // AudioStream sets the video audio stream.
 func (c *Chrome) AudioStream(a int) error {
-	msg := wsMessage{
-		Component: "player",
-		Method:    "audioStream",
-		Arguments: map[string]string{
-			"rate": strconv.Itoa(a),
-		},
-	}
+	return c.AudioStreamContext(context.Background(), a)
+}
 
-	send := c.ConnViewer.getChanSend()
-	send <- msg
-	res := <-c.ConnViewer.getChanReceive()
-	return handleRes(res)
+// AudioStreamContext sets the video audio stream, giving up when ctx is
+// done.
+func (c *Chrome) AudioStreamContext(ctx context.Context, a int) error {
+	return c.call(ctx, "audioStream", map[string]string{
+		"stream": strconv.Itoa(a),
+	})
 }
 
 // SubtitleStream sets the video subtitle stream.
 func (c *Chrome) SubtitleStream(s int) error {
-	msg := wsMessage{
-		Component: "player",
-		Method:    "subtitleStream",
-		Arguments: map[string]string{
-			"rate": strconv.Itoa(s),
-		},
-	}
+	return c.SubtitleStreamContext(context.Background(), s)
+}
 
-	send := c.ConnViewer.getChanSend()
-	send <- msg
-	res := <-c.ConnViewer.getChanReceive()
-	return handleRes(res)
+// SubtitleStreamContext sets the video subtitle stream, giving up when ctx
+// is done.
+func (c *Chrome) SubtitleStreamContext(ctx context.Context, s int) error {
+	return c.call(ctx, "subtitleStream", map[string]string{
+		"stream": strconv.Itoa(s),
+	})
 }
 
 // Listen does nothing for now.
@@ -20,6 +20,11 @@ type OMXPlayer struct {
 	audioOutput  string
 }
 
+// SetAudioOutput sets the audio output used for the next file that's opened.
+func (o *OMXPlayer) SetAudioOutput(output string) {
+	o.audioOutput = output
+}
+
 // Open starts a video file in the OMXPlayer streamer.
 func (o *OMXPlayer) Open(filename string, status chan string, test string, debug bool) error {
 	o.status = statusStarting
@@ -0,0 +1,295 @@
+package piplayer
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// usbScanInterval is how often the removable media roots are checked for
+// drives. Mounting doesn't reliably fire file events in the roots, so they're
+// polled instead of watched.
+const usbScanInterval = 2 * time.Second
+
+// usbOptions configures the detection of USB drives.
+type usbOptions struct {
+	// Roots are the folders removable drives are mounted in, every folder in
+	// a root is a drive. Empty uses /media/<user> and /run/media/<user>.
+	Roots []string `json:",omitempty"`
+	// Key switches to the newest USB drive and back, eg: "KEY_F5".
+	Key string `json:",omitempty"`
+}
+
+// roots returns the folders to look for USB drives in.
+func (o usbOptions) roots() []string {
+	if len(o.Roots) > 0 {
+		return o.Roots
+	}
+
+	u, err := user.Current()
+	if err != nil {
+		return nil
+	}
+	return []string{filepath.Join("/media", u.Username), filepath.Join("/run/media", u.Username)}
+}
+
+// usbVolume is a mounted drive with media files that can be played.
+type usbVolume struct {
+	Name  string `json:"name"`
+	Path  string `json:"path"`
+	Items int    `json:"items"`
+}
+
+// usbInfo is sent to the viewer and control pages when a drive is inserted or
+// removed, and when the playlist switches to a drive or back.
+type usbInfo struct {
+	Volumes []usbVolume `json:"volumes"`
+	// Active is the path of the drive the playlist is playing from, or empty
+	// when it's playing from the configured mount.
+	Active   string `json:"active"`
+	Inserted string `json:"inserted,omitempty"`
+	Removed  string `json:"removed,omitempty"`
+}
+
+// usbDrives keeps track of the USB drives and which one is playing.
+// Switching to a drive changes the playlist only, Config.Mount stays the same.
+type usbDrives struct {
+	mu sync.Mutex
+	// volumes are in the order they were inserted.
+	volumes []usbVolume
+	active  string
+}
+
+// scanUSB returns the drives in roots that have media files, sorted by path.
+func scanUSB(roots []string) []usbVolume {
+	var vols []usbVolume
+	for _, root := range roots {
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			dir := filepath.Join(root, e.Name())
+			if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+				continue
+			}
+			if n := countMedia(dir); n > 0 {
+				vols = append(vols, usbVolume{Name: e.Name(), Path: dir, Items: n})
+			}
+		}
+	}
+	slices.SortFunc(vols, func(a, b usbVolume) int { return cmp.Compare(a.Path, b.Path) })
+	return vols
+}
+
+// countMedia returns the number of files in dir that can be played.
+func countMedia(dir string) int {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for _, e := range entries {
+		if !e.IsDir() && itemType(e.Name()) != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// watchUSB looks for USB drives until ctx is cancelled.
+func (p *Player) watchUSB(ctx context.Context) {
+	ticker := time.NewTicker(usbScanInterval)
+	defer ticker.Stop()
+
+	for {
+		p.usb.update(p, scanUSB(p.config().USB.roots()))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// update records the drives found by a scan, and announces the ones that
+// were inserted or removed. If the drive that's playing was removed the
+// playlist switches back to the configured mount.
+func (d *usbDrives) update(p *Player, found []usbVolume) {
+	switched := false
+	// The engine reads the active drive while it holds its lock, so the mode
+	// is only reset once d.mu is released.
+	defer func() {
+		if switched {
+			p.resetMode()
+		}
+	}()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, v := range slices.Clone(d.volumes) {
+		if slices.ContainsFunc(found, func(f usbVolume) bool { return f.Path == v.Path }) {
+			continue
+		}
+		d.volumes = slices.DeleteFunc(d.volumes, func(o usbVolume) bool { return o.Path == v.Path })
+		log.Printf("USB drive %s removed\n", v.Name)
+		if d.active == v.Path {
+			switched = true
+			if err := d.switchTo(p, ""); err != nil {
+				log.Printf("error trying to switch back from the USB drive:\n%v\n", err)
+				// The drive is gone either way.
+				d.active = ""
+			}
+		}
+		d.announce(p, usbInfo{Removed: v.Name})
+	}
+
+	for _, f := range found {
+		i := slices.IndexFunc(d.volumes, func(v usbVolume) bool { return v.Path == f.Path })
+		if i >= 0 {
+			d.volumes[i] = f
+			continue
+		}
+		d.volumes = append(d.volumes, f)
+		log.Printf("USB drive %s inserted with %d items\n", f.Name, f.Items)
+		d.announce(p, usbInfo{Inserted: f.Name})
+	}
+}
+
+// switchTo switches the playlist to the drive at path, or back to the
+// configured mount if path is empty. The drive only becomes the active one
+// once the playlist has switched to it. d.mu must be held, and the caller
+// resets the mode after releasing it.
+func (d *usbDrives) switchTo(p *Player, path string) error {
+	dir := path
+	if path == "" {
+		dir = p.config().Mount.Dir
+	} else if !slices.ContainsFunc(d.volumes, func(v usbVolume) bool { return v.Path == path }) {
+		return fmt.Errorf("no USB drive at %s", path)
+	}
+
+	if err := p.playlist.setDir(p, dir); err != nil {
+		return err
+	}
+	d.active = path
+	return nil
+}
+
+// announce sends the drives and which one is playing to the viewer and the
+// control page. d.mu must be held.
+func (d *usbDrives) announce(p *Player, info usbInfo) {
+	info.Volumes = slices.Clone(d.volumes)
+	info.Active = d.active
+	msg := wsMessage{
+		Component: "usb",
+		Event:     "volumes",
+		Success:   true,
+		Message:   info,
+	}
+	p.ConnViewer.enqueue(msg)
+	p.ConnControl.enqueue(msg)
+}
+
+// info returns the drives and which one is playing.
+func (d *usbDrives) info() usbInfo {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return usbInfo{Volumes: slices.Clone(d.volumes), Active: d.active}
+}
+
+// playing returns the path of the drive the playlist is playing from, or ""
+// when it's playing from the configured mount.
+func (d *usbDrives) playing() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.active
+}
+
+// playUSB switches the playlist to the drive at path, or back to the
+// configured mount if path is empty.
+func (p *Player) playUSB(path string) error {
+	switched, err := p.usb.play(p, path)
+	if switched {
+		p.resetMode()
+	}
+	return err
+}
+
+// play switches the playlist for playUSB, and reports if it did. The mode
+// isn't reset here, because the engine reads the active drive while it holds
+// its lock.
+func (d *usbDrives) play(p *Player, path string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if path == d.active {
+		return false, nil
+	}
+	if err := d.switchTo(p, path); err != nil {
+		return false, err
+	}
+	if path == "" {
+		log.Println("Switched back from the USB drive")
+	} else {
+		log.Printf("Switched to the USB drive at %s\n", path)
+	}
+	d.announce(p, usbInfo{})
+	return true, nil
+}
+
+// toggleUSB switches to the newest USB drive, or back if a drive is playing.
+func (p *Player) toggleUSB() error {
+	p.usb.mu.Lock()
+	path := ""
+	if p.usb.active == "" {
+		if len(p.usb.volumes) == 0 {
+			p.usb.mu.Unlock()
+			return fmt.Errorf("no USB drive with media files")
+		}
+		path = p.usb.volumes[len(p.usb.volumes)-1].Path
+	}
+	p.usb.mu.Unlock()
+
+	return p.playUSB(path)
+}
+
+// mediaDir returns the folder the playlist plays from: the USB drive if one
+// was switched to, otherwise the configured mount.
+func (p *Player) mediaDir() string {
+	if dir := p.usb.playing(); dir != "" {
+		return dir
+	}
+	return p.config().Mount.Dir
+}
+
+// handleUSBAPI handles requests to the usb api.
+func handleUSBAPI(p *Player, req reqMessage) resMessage {
+	switch req.Method {
+	case "list":
+		return resMessage{Success: true, Event: "volumes", Message: p.usb.info()}
+	case "play":
+		var args usbArgs
+		if err := decodeArgs(req.Arguments, &args); err != nil {
+			return apiError(err.Error())
+		}
+		if err := p.playUSB(args.Path); err != nil {
+			return apiError(err.Error())
+		}
+		return resMessage{Success: true, Event: "volumes", Message: p.usb.info()}
+	case "back":
+		if err := p.playUSB(""); err != nil {
+			return apiError(err.Error())
+		}
+		return resMessage{Success: true, Event: "volumes", Message: p.usb.info()}
+	}
+
+	return apiError("Method not supported: " + req.Method)
+}
@@ -0,0 +1,145 @@
+package piplayer
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// usbRoot returns a folder with a drive that has media files, a drive
+// without any, and a file.
+func usbRoot(t *testing.T) string {
+	root := t.TempDir()
+	files := map[string]string{
+		"GUEST/talk.mp4":     "video",
+		"GUEST/slide.JPG":    "image",
+		"GUEST/notes.txt":    "text",
+		"BACKUP/report.docx": "doc",
+		"stray.mp4":          "video",
+	}
+	for name, data := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestScanUSB(t *testing.T) {
+	root := usbRoot(t)
+
+	got := scanUSB([]string{root, filepath.Join(root, "missing")})
+
+	want := []usbVolume{{Name: "GUEST", Path: filepath.Join(root, "GUEST"), Items: 2}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v want %+v", got, want)
+	}
+}
+
+func TestPlayUSB(t *testing.T) {
+	conf := validConfig(t)
+	p := reloadPlayer(t, conf)
+	root := usbRoot(t)
+	drive := filepath.Join(root, "GUEST")
+
+	p.usb.update(p, scanUSB([]string{root}))
+
+	if err := p.playUSB(filepath.Join(root, "BACKUP")); err == nil {
+		t.Error("got nil error switching to a drive without media")
+	}
+
+	// A drive that can't be played from doesn't become the active one.
+	p.usb.volumes = append(p.usb.volumes, usbVolume{Name: "GONE", Path: filepath.Join(root, "GONE")})
+	if err := p.playUSB(filepath.Join(root, "GONE")); err == nil {
+		t.Error("got nil error switching to a drive that isn't there")
+	}
+	if active := p.usb.playing(); active != "" {
+		t.Errorf("got active drive %s after a failed switch want none", active)
+	}
+	p.usb.volumes = p.usb.volumes[:len(p.usb.volumes)-1]
+	if err := p.playUSB(drive); err != nil {
+		t.Fatalf("got error %v want nil", err)
+	}
+
+	if p.playlist.Name != drive || p.mediaDir() != drive || len(p.playlist.Items) != 2 {
+		t.Errorf("got playlist %s with %d items, want %s with 2", p.playlist.Name, len(p.playlist.Items), drive)
+	}
+	if p.config().Mount.Dir != conf.Mount.Dir {
+		t.Errorf("got mount %s want %s unchanged", p.config().Mount.Dir, conf.Mount.Dir)
+	}
+
+	// Pulling the drive out switches back to the configured mount.
+	if err := os.RemoveAll(drive); err != nil {
+		t.Fatal(err)
+	}
+	p.usb.update(p, scanUSB([]string{root}))
+
+	if info := p.usb.info(); info.Active != "" || len(info.Volumes) != 0 {
+		t.Errorf("got %+v want no drives", info)
+	}
+	if p.playlist.Name != conf.Mount.Dir || p.mediaDir() != conf.Mount.Dir {
+		t.Errorf("got playlist %s want %s", p.playlist.Name, conf.Mount.Dir)
+	}
+}
+
+func TestToggleUSB(t *testing.T) {
+	conf := validConfig(t)
+	p := reloadPlayer(t, conf)
+
+	if err := p.toggleUSB(); err == nil {
+		t.Error("got nil error without a drive")
+	}
+
+	root := usbRoot(t)
+	p.usb.update(p, scanUSB([]string{root}))
+
+	if err := p.toggleUSB(); err != nil || p.mediaDir() != filepath.Join(root, "GUEST") {
+		t.Errorf("got error %v and media folder %s, want the drive", err, p.mediaDir())
+	}
+	if err := p.toggleUSB(); err != nil || p.mediaDir() != conf.Mount.Dir {
+		t.Errorf("got error %v and media folder %s, want %s", err, p.mediaDir(), conf.Mount.Dir)
+	}
+}
+
+func TestPlayUSBWhilePlaying(t *testing.T) {
+	conf := validConfig(t)
+	p, _ := enginePlayer(t, conf, "")
+	c, err := newMediaCache(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.cache.Store(c)
+	root := usbRoot(t)
+	drive := filepath.Join(root, "GUEST")
+	p.usb.update(p, scanUSB([]string{root}))
+
+	// Switching drives while the engine starts items, and looks up the
+	// media folder for the cache, mustn't deadlock. If it does the test
+	// times out.
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			p.Next()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 500; i++ {
+			if err := p.playUSB(drive); err != nil {
+				t.Error(err)
+			}
+			if err := p.playUSB(""); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	wg.Wait()
+}